@@ -9,45 +9,50 @@ import (
 
 	"github.com/mycujoo/kube-deploy/cli"
 	"github.com/mycujoo/kube-deploy/config"
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/logger"
 )
 
 const testCommandImage = "mycujoo/gcloud-docker"
 
 var repoConfig config.RepoConfigMap
 
-func MakeAndPushBuild(forcePush bool, dirtyWorkDirOverride bool, keepTestContainer bool, repoConfigParam config.RepoConfigMap) {
-	MakeAndTestBuild(dirtyWorkDirOverride, keepTestContainer, repoConfigParam)
-	var pushExitCode int
-	if forcePush {
-		pushExitCode = forcePushDockerImage()
-	} else {
-		pushExitCode = askPushDockerImage()
+func MakeAndPushBuild(forcePush bool, dirtyWorkDirOverride bool, keepTestContainer bool, repoConfigParam config.RepoConfigMap) error {
+	if err := MakeAndTestBuild(dirtyWorkDirOverride, keepTestContainer, repoConfigParam); err != nil {
+		return err
 	}
-	if pushExitCode != 0 {
-		os.Exit(1)
+	if !forcePush {
+		if err := askPushDockerImage(); err != nil {
+			return err
+		}
 	}
+	return pushImage()
 }
-func MakeAndTestBuild(dirtyWorkDirOverride bool, keepTestContainer bool, repoConfigParam config.RepoConfigMap) {
-	if !DockerAmLoggedIn() {
-		fmt.Println("=> Uh oh, you're not logged into the configured docker remote for this repo. You won't be able to push!")
-		os.Exit(1)
-	}
-
+func MakeAndTestBuild(dirtyWorkDirOverride bool, keepTestContainer bool, repoConfigParam config.RepoConfigMap) error {
 	repoConfig = repoConfigParam
 
+	loggedIn, err := DockerAmLoggedIn()
+	if err != nil {
+		return err
+	}
+	if !loggedIn {
+		return failure.New(failure.Build, "Uh oh, you're not logged into the configured docker remote for this repo. You won't be able to push!")
+	}
+
 	// Builds the docker image and tags it with the image short-name (ie. without the registry path)
 	if repoConfig.ClusterName == "production" && !workingDirectoryIsClean() {
 		if dirtyWorkDirOverride {
-			fmt.Println("=> Respecting your wishes to override the dirty working directory and build anyway.")
+			logger.Info("=> Respecting your wishes to override the dirty working directory and build anyway.")
 		} else {
-			fmt.Println("=> Oh no! You have uncommited changes in the working tree. Please commit or stash before deploying to production.")
-			fmt.Println("=> If you're really, really sure, you can override this warning with the '--override-dirty-workdir' flag.")
-			os.Exit(1)
+			return failure.New(failure.Build, "Oh no! You have uncommited changes in the working tree. Please commit or stash before deploying to production.\n"+
+				"=> If you're really, really sure, you can override this warning with the '--override-dirty-workdir' flag.")
 		}
 	}
 
-	makeBuild()
-	RunBuildTests(keepTestContainer)
+	if err := makeBuild(); err != nil {
+		return err
+	}
+	return RunBuildTests(keepTestContainer)
 }
 
 func workingDirectoryIsClean() bool {
@@ -64,118 +69,112 @@ func workingDirectoryIsClean() bool {
 	return true
 }
 
-func makeBuild() {
+func makeBuild() error {
 
-	fmt.Println("=> Okay, let's start the build process!")
-	fmt.Printf("=> First, let's build the image with tag: %s\n\n", repoConfig.ImageFullPath)
+	logger.Info("=> Okay, let's start the build process!")
+	logger.Info("=> First, let's build the image with tag: %s\n\n", repoConfig.ImageFullPath)
 	time.Sleep(1 * time.Second)
 
-	// Run docker build
-	if exitCode := cli.StreamAndGetCommandExitCode(
-		"docker",
-		fmt.Sprintf("build -t %s %s", repoConfig.ImageFullPath, repoConfig.PWD),
-	); exitCode != 0 {
-		os.Exit(1)
-	}
+	return buildImage()
 }
 
-func RunBuildTests(keepTestContainer bool) {
+func RunBuildTests(keepTestContainer bool) error {
 	// Start container and run tests
-	tests := repoConfig.Tests
-	for _, testSet := range tests {
-		fmt.Printf("\n\n=> Setting up test set: %s\n", testSet.Name)
-
-		// Start the test container
-		var (
-			containerName string
-			exitCode      int
-		)
-		if testSet.Type != "host-only" { // 'host-only' skips running the test docker container (for env setup)
-			fmt.Printf("=> Starting docker image: %s\n", repoConfig.ImageFullPath)
-
-			var dockerRunCommand string
-			if testSet.DockerArgs != "" {
-				dockerRunCommand = fmt.Sprintf("%s %s", testSet.DockerArgs, repoConfig.ImageFullPath)
-			} else {
-				dockerRunCommand = repoConfig.ImageFullPath
-			}
-			if testSet.DockerCommand != "" {
-				dockerRunCommand = dockerRunCommand + " " + testSet.DockerCommand
-			}
-
-			containerName, exitCode = cli.StreamAndGetCommandOutputAndExitCode("docker",
-				strings.Join([]string{"run", dockerRunCommand}, " "))
-			if exitCode != 0 {
-				teardownTest(containerName, true, keepTestContainer)
-			}
+	for i := range repoConfig.Tests {
+		if err := runTestSet(i, keepTestContainer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs one of the test sets, always tearing down its test container afterwards
+func runTestSet(index int, keepTestContainer bool) error {
+	testSet := repoConfig.Tests[index]
+	logger.Info("\n\n=> Setting up test set: %s\n", testSet.Name)
+
+	// The tests stop when they're interrupted, and the test container is torn down however they end
+	defer cli.HandleAborts()()
+
+	// Start the test container
+	var containerID string
+	if testSet.Type != "host-only" { // 'host-only' skips running the test docker container (for env setup)
+		logger.Info("=> Starting docker image: %s\n", repoConfig.ImageFullPath)
+		var err error
+		if containerID, err = startTestContainer(index); err != nil {
+			teardownTest(containerID, keepTestContainer)
+			return abortedOr(err)
 		}
+	}
+	defer teardownTest(containerID, keepTestContainer)
 
+	// Wait two seconds for it to come alive
+	if err := cli.Sleep(2 * time.Second); err != nil {
+		return err
+	}
+
+	// Run all tests
+	for _, testCommand := range testSet.Commands {
 		// Wait two seconds for it to come alive
-		time.Sleep(2 * time.Second)
-
-		// Run all tests
-		for _, testCommand := range testSet.Commands {
-			// Wait two seconds for it to come alive
-			time.Sleep(2 * time.Second)
-			fmt.Printf("=> Executing test command: %s\n", testCommand)
-			// commandSplit := strings.SplitN(testCommand, " ", 2)
-			// Run the test command
-			switch t := testSet.Type; t {
-			case "on-host", "host-only":
-				commandSplit := strings.SplitN(testCommand, " ", 2)
-				if exitCode := cli.StreamAndGetCommandExitCode(commandSplit[0], commandSplit[1]); exitCode != 0 {
-					teardownTest(containerName, true, keepTestContainer)
-					break
-				}
-			case "in-test-container":
-				if exitCode := cli.StreamAndGetCommandExitCode("docker", fmt.Sprintf("exec %s %s", containerName, testCommand)); exitCode != 0 {
-					teardownTest(containerName, true, keepTestContainer)
-					break
-				}
-			case "in-external-container":
-				if exitCode := cli.StreamAndGetCommandExitCode("docker", fmt.Sprintf("run --rm --network container:%s %s %s", containerName, testCommandImage, testCommand)); exitCode != 0 {
-					teardownTest(containerName, true, keepTestContainer)
-					break
-				}
-			default:
-				fmt.Printf("=> Since you didn't specify where to run test %s, I'll run it in an external container (attached to the same network).\n", testCommand)
-				if exitCode := cli.StreamAndGetCommandExitCode("docker", fmt.Sprintf("run --rm --network container:%s %s %s", containerName, testCommandImage, testCommand)); exitCode != 0 {
-					teardownTest(containerName, true, keepTestContainer)
-				}
-			}
+		if err := cli.Sleep(2 * time.Second); err != nil {
+			return err
+		}
+		logger.Info("=> Executing test command: %s\n", testCommand)
+		// Run the test command
+		var exitCode int
+		var err error
+		switch testSet.Type {
+		case "on-host", "host-only":
+			commandSplit := append(strings.SplitN(testCommand, " ", 2), "")
+			exitCode = cli.StreamAndGetCommandExitCode(commandSplit[0], commandSplit[1])
+		case "in-test-container":
+			exitCode, err = execInContainer(containerID, testCommand)
+		case "in-external-container":
+			exitCode, err = runInExternalContainer(containerID, testCommand)
+		default:
+			logger.Info("=> Since you didn't specify where to run test %s, I'll run it in an external container (attached to the same network).\n", testCommand)
+			exitCode, err = runInExternalContainer(containerID, testCommand)
+		}
+		if err != nil {
+			return abortedOr(failure.Wrap(failure.Test, err, "Uh oh, I couldn't run the test command '%s' in test set '%s'", testCommand, testSet.Name))
+		}
+		if err := cli.Aborted(); err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return failure.New(failure.Test, "The test command '%s' in test set '%s' failed", testCommand, testSet.Name)
 		}
-		teardownTest(containerName, false, keepTestContainer)
 	}
+	return nil
 }
 
-func teardownTest(containerName string, exit bool, keepTestContainer bool) {
-	if containerName != "" {
-		fmt.Println("=> Stopping test container.")
-		cli.GetCommandOutput("docker", fmt.Sprintf("stop %s", containerName))
+// When the tests were interrupted, that's what went wrong, rather than err
+func abortedOr(err error) error {
+	if aborted := cli.Aborted(); aborted != nil {
+		return aborted
+	}
+	return err
+}
+
+func teardownTest(containerID string, keepTestContainer bool) {
+	if containerID != "" {
+		logger.Info("=> Stopping test container.")
+		stopContainer(containerID)
 		if keepTestContainer {
-			fmt.Println("=> Leaving the test container without deleting, like you asked.\n")
+			logger.Info("=> Leaving the test container without deleting, like you asked.\n")
 		} else {
-			fmt.Println("=> Removing test container.")
-			cli.GetCommandOutput("docker", fmt.Sprintf("rm %s", containerName))
+			logger.Info("=> Removing test container.")
+			removeContainer(containerID)
 		}
 	}
-	if exit {
-		os.Exit(1)
-	}
 }
 
-func askPushDockerImage() int {
+func askPushDockerImage() error {
 	fmt.Print("=> Yay, all the tests passed! Would you like to push this to the remote now?\n=> Press 'y' to push, anything else to exit.\n>>> ") // TODO - make this pluggable
 	reader := bufio.NewReader(os.Stdin)
 	confirm, _ := reader.ReadString('\n')
 	if confirm != "y\n" && confirm != "Y" {
-		fmt.Println("=> Thanks for building, Bob!")
-		os.Exit(0)
+		return failure.New(failure.Cancelled, "Thanks for building, Bob!")
 	}
-	return cli.StreamAndGetCommandExitCode("docker", fmt.Sprintf("push %s", repoConfig.ImageFullPath))
-
-}
-
-func forcePushDockerImage() int {
-	return cli.StreamAndGetCommandExitCode("docker", fmt.Sprintf("push %s", repoConfig.ImageFullPath))
+	return nil
 }
@@ -3,12 +3,11 @@ package build
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"strings"
-	"text/tabwriter"
 
 	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/config"
+	"github.com/mycujoo/kube-deploy/failure"
 )
 
 type gcloudDockerTag struct {
@@ -19,65 +18,56 @@ type gcloudDockerTag struct {
 	}
 }
 
-func DockerListTags() {
+// DockerTag : a single image in the remote repository, and the tags it has
+type DockerTag struct {
+	Tags       []string `json:"tags" yaml:"tags"`
+	Digest     string   `json:"digest" yaml:"digest"`
+	DateTagged string   `json:"dateTagged" yaml:"dateTagged"`
+}
+
+func DockerListTags(repoConfigParam config.RepoConfigMap) ([]DockerTag, error) {
+	repoConfig = repoConfigParam
 	if !strings.Contains(repoConfig.DockerRepository.RegistryRoot, "gcr.io") {
-		fmt.Println("=> Sorry, the 'list-tags' feature only works with Google Cloud Registry.")
-		os.Exit(1)
+		return nil, failure.New(failure.Config, "Sorry, the 'list-tags' feature only works with Google Cloud Registry.")
 	}
 
-	jsonTags := cli.GetCommandOutput("gcloud", fmt.Sprintf("container images list-tags --format=json eu.gcr.io/mycujoo-development/mycujoo-thumbs")) // %s", repoConfig.ImagePath))
+	imagePath := strings.TrimSuffix(repoConfig.ImageFullPath, ":"+repoConfig.ImageTag)
+	jsonTags := cli.GetCommandOutput("gcloud", fmt.Sprintf("container images list-tags --format=json %s", imagePath))
 	decodedTags := []gcloudDockerTag{}
 
 	if err := json.Unmarshal([]byte(jsonTags), &decodedTags); err != nil {
-		panic(err)
-	}
-	// prettyPrint, _ := json.MarshalIndent(decodedTags, "", "\t")
-	// fmt.Println(string(prettyPrint))
-
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.AlignRight)
-	fmt.Fprintln(w, fmt.Sprintf("%s  \t  %s", "List of Tags", "Date Tagged"))
-	fmt.Fprintln(w, fmt.Sprintf("%s  \t  %s", "----------", "----------"))
-	for _, tag := range decodedTags {
-		// fmt.Println(tag)
-		fmt.Fprintln(w, fmt.Sprintf("%s  \t  %s", strings.Join(tag.Tags, ", "), tag.Timestamp.Datetime))
+		return nil, failure.Wrap(failure.Unknown, err, "I couldn't read the list of tags from gcloud")
 	}
-	w.Flush()
-}
-
-func DockerImageExistsLocal() bool {
-	exitCode := cli.GetCommandExitCode("docker", fmt.Sprintf("inspect %s", repoConfig.ImageFullPath))
 
-	if exitCode != 0 {
-		return false
+	tags := make([]DockerTag, len(decodedTags))
+	for i, tag := range decodedTags {
+		tags[i] = DockerTag{
+			Tags:       tag.Tags,
+			Digest:     tag.Digest,
+			DateTagged: tag.Timestamp.Datetime,
+		}
 	}
-	return true
+	return tags, nil
 }
 
-func DockerImageExistsRemote() bool {
-	exitCode := cli.GetCommandExitCode("docker", fmt.Sprintf("pull %s", repoConfig.ImageFullPath))
+func DockerImageExistsLocal(repoConfigParam config.RepoConfigMap) (bool, error) {
+	repoConfig = repoConfigParam
+	return imageExistsLocal(repoConfig.ImageFullPath)
+}
 
-	if exitCode != 0 {
-		return false
-	}
-	return true
+func DockerImageExistsRemote(repoConfigParam config.RepoConfigMap) (bool, error) {
+	repoConfig = repoConfigParam
+	return imageExistsRemote(repoConfig.ImageFullPath)
 }
 
-func DockerAmLoggedIn() bool {
+func DockerAmLoggedIn() (bool, error) {
 
-	dockerAuthFile, err := ioutil.ReadFile(os.Getenv("HOME") + "/.docker/config.json")
+	dockerAuthData, err := readDockerConfig()
 	if err != nil {
-		fmt.Println("=> There was a problem reading your docker config file, so I don't know if you're logged in!")
-		panic(err.Error())
-	}
-
-	var dockerAuthData map[string]interface{}
-	json.Unmarshal(dockerAuthFile, &dockerAuthData)
-
-	auths := dockerAuthData["auths"].(map[string]interface{})
-	var credHelpers map[string]interface{}
-	if dockerAuthData["credHelpers"] != nil {
-		credHelpers = dockerAuthData["credHelpers"].(map[string]interface{})
+		return false, err
 	}
+	auths := dockerAuthData.Auths
+	credHelpers := dockerAuthData.CredHelpers
 
 	loggedInRemotes := make([]string, len(auths)+len(credHelpers))
 	i := 0
@@ -100,9 +90,9 @@ func DockerAmLoggedIn() bool {
 
 	for _, remoteName := range loggedInRemotes {
 		if remoteName == authToLookFor || remoteName == "https://"+authToLookFor {
-			return true
+			return true, nil
 		}
 	}
 
-	return false
+	return false, nil
 }
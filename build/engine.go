@@ -0,0 +1,313 @@
+package build
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	cerrdefs "github.com/containerd/errdefs"
+	"github.com/distribution/reference"
+	buildtypes "github.com/docker/docker/api/types/build"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/moby/go-archive"
+	"github.com/moby/patternmatcher/ignorefile"
+
+	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/logger"
+)
+
+// The name a Dockerfile from outside the build context is sent to the Docker Engine as
+const outsideDockerfileName = ".kube-deploy.Dockerfile"
+
+var engineClient *client.Client
+
+// The Docker Engine client, which finds the engine the same way the docker CLI does ($DOCKER_HOST and friends)
+func dockerEngine() (*client.Client, error) {
+	if engineClient != nil {
+		return engineClient, nil
+	}
+	engine, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, failure.Wrap(failure.Build, err, "Uh oh, I couldn't connect to the Docker Engine")
+	}
+	engineClient = engine
+	return engineClient, nil
+}
+
+// Prints the JSON progress messages the engine streams while building, pulling or pushing, and returns the error
+// from the stream if there is one
+func showProgress(progress io.ReadCloser) error {
+	defer progress.Close()
+	return jsonmessage.DisplayJSONMessagesStream(progress, cli.StreamWriter, 0, false, nil)
+}
+
+// dockerConfig : the parts of ~/.docker/config.json about logging into registries
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"` // base64 of 'username:password'
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredHelpers map[string]string `json:"credHelpers"` // Registry to the credential helper for it
+	CredsStore  string            `json:"credsStore"`  // The credential helper for every other registry
+}
+
+// Reads ~/.docker/config.json - without one, there aren't any credentials, which is fine for public images
+func readDockerConfig() (dockerConfig, error) {
+	var config dockerConfig
+	dockerConfigFile, err := ioutil.ReadFile(os.Getenv("HOME") + "/.docker/config.json")
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, failure.Wrap(failure.Build, err, "There was a problem reading your docker config file, so I don't know if you're logged in!")
+	}
+	if err := json.Unmarshal(dockerConfigFile, &config); err != nil {
+		return config, failure.Wrap(failure.Build, err, "There was a problem parsing your docker config file, so I don't know if you're logged in!")
+	}
+	return config, nil
+}
+
+// The encoded credentials for the registry an image is in, from ~/.docker/config.json - or "" to go without
+func registryAuth(imageRef string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageRef)
+	if err != nil {
+		return "", failure.Wrap(failure.Config, err, "Uh oh, '%s' isn't an image name I understand", imageRef)
+	}
+	host := reference.Domain(named)
+	keys := []string{host, "https://" + host}
+	if host == "docker.io" {
+		// Docker Hub logins are kept under the old index address
+		keys = append([]string{"https://index.docker.io/v1/", "index.docker.io/v1/"}, keys...)
+	}
+
+	config, err := readDockerConfig()
+	if err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		if helper := config.CredHelpers[key]; helper != "" {
+			authConfig, err := credentialsFromHelper(helper, key)
+			if err != nil {
+				return "", failure.Wrap(failure.Build, err, "Uh oh, I couldn't get your credentials for %s", host)
+			}
+			return registry.EncodeAuthConfig(authConfig)
+		}
+		if auth, ok := config.Auths[key]; ok && (auth.Auth != "" || auth.IdentityToken != "") {
+			authConfig := registry.AuthConfig{ServerAddress: key, IdentityToken: auth.IdentityToken}
+			if decoded, err := base64.StdEncoding.DecodeString(auth.Auth); err == nil {
+				if userAndPassword := strings.SplitN(string(decoded), ":", 2); len(userAndPassword) == 2 {
+					authConfig.Username, authConfig.Password = userAndPassword[0], userAndPassword[1]
+					logger.AddSecret(authConfig.Password)
+				}
+			}
+			return registry.EncodeAuthConfig(authConfig)
+		}
+	}
+	// The credentials store has every other registry you've logged into
+	if config.CredsStore != "" {
+		for _, key := range keys {
+			if authConfig, err := credentialsFromHelper(config.CredsStore, key); err == nil {
+				return registry.EncodeAuthConfig(authConfig)
+			}
+		}
+	}
+	return "", nil
+}
+
+// Asks a docker credential helper (like 'gcr' for docker-credential-gcr) for the credentials for a registry
+func credentialsFromHelper(helper string, serverAddress string) (registry.AuthConfig, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverAddress)
+	output, err := cmd.Output()
+	if err != nil {
+		return registry.AuthConfig{}, fmt.Errorf("docker-credential-%s failed: %s", helper, err)
+	}
+	var credentials struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(output, &credentials); err != nil {
+		return registry.AuthConfig{}, fmt.Errorf("docker-credential-%s said something I couldn't read: %s", helper, err)
+	}
+	logger.AddSecret(credentials.Secret)
+	// Helpers give identity tokens with this as the username
+	if credentials.Username == "<token>" {
+		return registry.AuthConfig{ServerAddress: serverAddress, IdentityToken: credentials.Secret}, nil
+	}
+	return registry.AuthConfig{ServerAddress: serverAddress, Username: credentials.Username, Password: credentials.Secret}, nil
+}
+
+// Whether an image is already on this machine
+func imageExistsLocal(imageRef string) (bool, error) {
+	engine, err := dockerEngine()
+	if err != nil {
+		return false, err
+	}
+	if _, err := engine.ImageInspect(cli.AbortContext(), imageRef); err != nil {
+		if client.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, failure.Wrap(failure.Build, err, "Uh oh, I couldn't look for the image %s", imageRef)
+	}
+	return true, nil
+}
+
+// Pulls an image unless it's already on this machine
+func ensureImage(imageRef string) error {
+	if exists, err := imageExistsLocal(imageRef); err != nil || exists {
+		return err
+	}
+	engine, err := dockerEngine()
+	if err != nil {
+		return err
+	}
+	auth, err := registryAuth(imageRef)
+	if err != nil {
+		return err
+	}
+	logger.Info("=> Pulling the image %s\n", imageRef)
+	progress, err := engine.ImagePull(cli.AbortContext(), imageRef, image.PullOptions{RegistryAuth: auth})
+	if err == nil {
+		err = showProgress(progress)
+	}
+	return failure.Wrap(failure.Build, err, "Pulling the image %s failed", imageRef)
+}
+
+// Packs up the build context (leaving out what's in its .dockerignore) to send to the engine, and works out where
+// the Dockerfile is in it
+func buildContextArchive() (io.ReadCloser, string, error) {
+	contextDir := filepath.Join(repoConfig.PWD, repoConfig.Application.BuildContext)
+	dockerfile := "Dockerfile"
+	if repoConfig.Application.Dockerfile != "" {
+		dockerfile = filepath.Join(repoConfig.PWD, repoConfig.Application.Dockerfile)
+		relative, err := filepath.Rel(contextDir, dockerfile)
+		if err == nil && !strings.HasPrefix(relative, "..") {
+			dockerfile = relative
+		}
+	}
+
+	var excludes []string
+	if ignoreFile, err := os.Open(filepath.Join(contextDir, ".dockerignore")); err == nil {
+		excludes, err = ignorefile.ReadAll(ignoreFile)
+		ignoreFile.Close()
+		if err != nil {
+			return nil, "", failure.Wrap(failure.Config, err, "Uh oh, I couldn't read the .dockerignore in %s", contextDir)
+		}
+	}
+	if !filepath.IsAbs(dockerfile) {
+		// Like the docker CLI, the Dockerfile is always sent, even if it's ignored
+		excludes = append(excludes, "!"+filepath.ToSlash(dockerfile), "!.dockerignore")
+	}
+	buildContext, err := archive.TarWithOptions(contextDir, &archive.TarOptions{ExcludePatterns: excludes})
+	if err != nil {
+		return nil, "", failure.Wrap(failure.Config, err, "Uh oh, I couldn't pack up the build context %s", contextDir)
+	}
+	if !filepath.IsAbs(dockerfile) {
+		return buildContext, filepath.ToSlash(dockerfile), nil
+	}
+
+	// A Dockerfile outside the build context is added to it under another name
+	contents, err := ioutil.ReadFile(dockerfile)
+	if err != nil {
+		buildContext.Close()
+		return nil, "", failure.Wrap(failure.Config, err, "Uh oh, I couldn't read the Dockerfile %s", dockerfile)
+	}
+	buildContext = archive.ReplaceFileTarWrapper(buildContext, map[string]archive.TarModifierFunc{
+		outsideDockerfileName: func(_ string, _ *tar.Header, _ io.Reader) (*tar.Header, []byte, error) {
+			return &tar.Header{Name: outsideDockerfileName, Mode: 0600, Size: int64(len(contents)), ModTime: time.Now(), Typeflag: tar.TypeReg}, contents, nil
+		},
+	})
+	return buildContext, outsideDockerfileName, nil
+}
+
+// Builds the image, showing the engine's progress as it goes
+func buildImage() error {
+	engine, err := dockerEngine()
+	if err != nil {
+		return err
+	}
+	buildContext, dockerfile, err := buildContextArchive()
+	if err != nil {
+		return err
+	}
+	defer buildContext.Close()
+
+	response, err := engine.ImageBuild(cli.AbortContext(), buildContext, buildtypes.ImageBuildOptions{
+		Tags:        []string{repoConfig.ImageFullPath},
+		Dockerfile:  dockerfile,
+		Remove:      true,
+		ForceRemove: true,
+	})
+	if err == nil {
+		err = showProgress(response.Body)
+	}
+	return failure.Wrap(failure.Build, err, "Building the image %s failed", repoConfig.ImageFullPath)
+}
+
+// Pushes the image to its registry, with the credentials from ~/.docker/config.json
+func pushImage() error {
+	engine, err := dockerEngine()
+	if err != nil {
+		return err
+	}
+	auth, err := registryAuth(repoConfig.ImageFullPath)
+	if err != nil {
+		return err
+	}
+	progress, err := engine.ImagePush(cli.AbortContext(), repoConfig.ImageFullPath, image.PushOptions{RegistryAuth: auth})
+	if err == nil {
+		err = showProgress(progress)
+	}
+	return failure.Wrap(failure.Build, err, "Pushing the image %s failed", repoConfig.ImageFullPath)
+}
+
+// Whether the image is in its registry, asking the registry for its manifest rather than pulling it
+func imageExistsRemote(imageRef string) (bool, error) {
+	engine, err := dockerEngine()
+	if err != nil {
+		return false, err
+	}
+	auth, err := registryAuth(imageRef)
+	if err != nil {
+		return false, err
+	}
+	if _, err := engine.DistributionInspect(cli.AbortContext(), imageRef, auth); err != nil {
+		if err := cli.Aborted(); err != nil {
+			return false, err
+		}
+		if !isNotFoundInRegistry(err) {
+			// Building again over an image which is there (because of a login or network problem) would be worse than stopping
+			return false, failure.Wrap(failure.Build, err, "I couldn't check whether %s is in its registry - check your login with 'docker login' and try again", imageRef)
+		}
+		logger.Debug("=> Couldn't find %s in its registry: %s", imageRef, err)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Registries say a tag or repository isn't there in a few ways, and the Docker Engine only passes some of them on as
+// a 404 - the rest just come back with the registry's own message
+func isNotFoundInRegistry(err error) bool {
+	if cerrdefs.IsNotFound(err) {
+		return true
+	}
+	message := strings.ToLower(err.Error())
+	for _, notFound := range []string{"manifest unknown", "name unknown", "unknown tag", "not found"} {
+		if strings.Contains(message, notFound) {
+			return true
+		}
+	}
+	return false
+}
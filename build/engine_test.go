@@ -0,0 +1,29 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	cerrdefs "github.com/containerd/errdefs"
+)
+
+func TestIsNotFoundInRegistry(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: fmt.Errorf("inspecting: %w", cerrdefs.ErrNotFound), want: true},
+		{err: errors.New("Error response from daemon: manifest unknown: manifest unknown"), want: true},
+		{err: errors.New("Error response from daemon: unknown tag=master-abc1234"), want: true},
+		{err: errors.New("Error response from daemon: name unknown: repository name not known to registry"), want: true},
+		{err: errors.New("Error response from daemon: unauthorized: authentication required")},
+		{err: errors.New("Error response from daemon: Get \"https://eu.gcr.io/v2/\": dial tcp: i/o timeout")},
+		{err: errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?")},
+	}
+	for _, test := range tests {
+		if got := isNotFoundInRegistry(test.err); got != test.want {
+			t.Errorf("isNotFoundInRegistry(%q) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+	units "github.com/docker/go-units"
+
+	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/config"
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/logger"
+)
+
+// containerSpec : what a test container is created with, from the 'docker run' options in a test set's dockerArgs
+type containerSpec struct {
+	name       string
+	detach     bool
+	config     container.Config
+	hostConfig container.HostConfig
+}
+
+// The 'docker run' options dockerArgs can use which take a value, by their long names
+var runOptionsWithValues = map[string]string{
+	"-e": "--env", "-p": "--publish", "-v": "--volume", "-w": "--workdir", "-u": "--user", "-l": "--label",
+	"--env": "", "--env-file": "", "--publish": "", "--volume": "", "--workdir": "", "--user": "", "--label": "",
+	"--name": "", "--network": "", "--net": "--network", "--entrypoint": "", "--add-host": "", "--hostname": "", "-h": "--hostname",
+	"-m": "--memory", "--memory": "", "--memory-swap": "", "--cpus": "", "-c": "--cpu-shares", "--cpu-shares": "",
+	"--shm-size": "", "--tmpfs": "", "--cap-add": "", "--cap-drop": "", "--security-opt": "", "--ulimit": "",
+	"--device": "", "--dns": "", "--ipc": "", "--pid": "",
+}
+
+// The 'docker run' options dockerArgs can use which are on or off, by their long names - like 'docker run', they can
+// be given a value too (eg. '--privileged=false')
+var runOptionsWithoutValues = map[string]string{
+	"-d": "--detach", "--detach": "", "--privileged": "", "--init": "", "--read-only": "",
+}
+
+// The 'docker run' options which don't change anything here - nothing is attached to the test container's terminal,
+// and it's removed afterwards unless '--keep-test-container' is used
+var ignoredRunOptions = []string{"-i", "--interactive", "-t", "--tty", "-it", "-ti", "--rm"}
+
+// Reads the 'docker run' options of a test set's dockerArgs
+func parseRunArgs(dockerArgs string) (containerSpec, error) {
+	var spec containerSpec
+	var ports []string
+	args := cli.SplitArgs(dockerArgs)
+	for i := 0; i < len(args); i++ {
+		option, value, hasValue := args[i], "", false
+		if j := strings.Index(option, "="); strings.HasPrefix(option, "--") && j >= 0 {
+			option, value, hasValue = option[:j], option[j+1:], true
+		}
+		if contains(ignoredRunOptions, option) {
+			continue
+		}
+		if longName, isSwitch := runOptionsWithoutValues[option]; isSwitch {
+			if longName != "" {
+				option = longName
+			}
+			on := true
+			if hasValue {
+				var err error
+				if on, err = strconv.ParseBool(value); err != nil {
+					return spec, failure.New(failure.Config, "Uh oh, '%s' in the dockerArgs should be true or false", args[i])
+				}
+			}
+			switch option {
+			case "--detach":
+				spec.detach = on
+			case "--privileged":
+				spec.hostConfig.Privileged = on
+			case "--init":
+				spec.hostConfig.Init = &on
+			case "--read-only":
+				spec.hostConfig.ReadonlyRootfs = on
+			}
+			continue
+		}
+		longName, takesValue := runOptionsWithValues[option]
+		if !takesValue {
+			return spec, failure.New(failure.Config, "Uh oh, '%s' in the dockerArgs isn't a 'docker run' option I know how to use for the test containers - the README lists the ones I know", args[i])
+		}
+		if longName != "" {
+			option = longName
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return spec, failure.New(failure.Config, "Uh oh, '%s' in the dockerArgs needs a value", args[i])
+			}
+			i++
+			value = args[i]
+		}
+		if option == "--publish" {
+			ports = append(ports, value)
+		} else if err := setRunOption(&spec, option, value); err != nil {
+			return spec, err
+		}
+	}
+
+	exposedPorts, portBindings, err := nat.ParsePortSpecs(ports)
+	if err != nil {
+		return spec, failure.Wrap(failure.Config, err, "Uh oh, the ports to publish in the dockerArgs are broken")
+	}
+	spec.config.ExposedPorts, spec.hostConfig.PortBindings = exposedPorts, portBindings
+	return spec, nil
+}
+
+// Sets what an option with a value (by its long name) changes in the container
+func setRunOption(spec *containerSpec, option string, value string) error {
+	switch option {
+	case "--name":
+		spec.name = value
+	case "--env":
+		if !strings.Contains(value, "=") {
+			// Like 'docker run', a name on its own is passed through from this environment
+			if v, ok := os.LookupEnv(value); ok {
+				value += "=" + v
+			}
+		}
+		spec.config.Env = append(spec.config.Env, value)
+	case "--env-file":
+		data, err := ioutil.ReadFile(value)
+		if err != nil {
+			return failure.Wrap(failure.Config, err, "Uh oh, couldn't read the env file %s from the dockerArgs", value)
+		}
+		variables, err := config.ReadVariables(data, config.VariableFormatEnv)
+		if err != nil {
+			return failure.Wrap(failure.Config, err, "Uh oh, couldn't read the env file %s from the dockerArgs", value)
+		}
+		for _, v := range variables {
+			spec.config.Env = append(spec.config.Env, v.Name+"="+v.Value)
+		}
+	case "--volume":
+		spec.hostConfig.Binds = append(spec.hostConfig.Binds, value)
+	case "--network":
+		spec.hostConfig.NetworkMode = container.NetworkMode(value)
+	case "--workdir":
+		spec.config.WorkingDir = value
+	case "--entrypoint":
+		spec.config.Entrypoint = cli.SplitArgs(value)
+	case "--user":
+		spec.config.User = value
+	case "--label":
+		if spec.config.Labels == nil {
+			spec.config.Labels = make(map[string]string)
+		}
+		keyAndValue := strings.SplitN(value, "=", 2)
+		spec.config.Labels[keyAndValue[0]] = strings.Join(keyAndValue[1:], "")
+	case "--add-host":
+		spec.hostConfig.ExtraHosts = append(spec.hostConfig.ExtraHosts, value)
+	case "--hostname":
+		spec.config.Hostname = value
+	case "--memory", "--memory-swap", "--shm-size":
+		bytes, err := units.RAMInBytes(value)
+		if err != nil {
+			return failure.Wrap(failure.Config, err, "Uh oh, the %s in the dockerArgs should be a size, like 512m or 2g", option)
+		}
+		switch option {
+		case "--memory":
+			spec.hostConfig.Memory = bytes
+		case "--memory-swap":
+			spec.hostConfig.MemorySwap = bytes
+		case "--shm-size":
+			spec.hostConfig.ShmSize = bytes
+		}
+	case "--cpus":
+		cpus, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return failure.Wrap(failure.Config, err, "Uh oh, the --cpus in the dockerArgs should be a number, like 1.5")
+		}
+		spec.hostConfig.NanoCPUs = int64(cpus * 1e9)
+	case "--cpu-shares":
+		shares, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return failure.Wrap(failure.Config, err, "Uh oh, the --cpu-shares in the dockerArgs should be a whole number")
+		}
+		spec.hostConfig.CPUShares = shares
+	case "--tmpfs":
+		if spec.hostConfig.Tmpfs == nil {
+			spec.hostConfig.Tmpfs = make(map[string]string)
+		}
+		pathAndOptions := strings.SplitN(value, ":", 2)
+		spec.hostConfig.Tmpfs[pathAndOptions[0]] = strings.Join(pathAndOptions[1:], "")
+	case "--cap-add":
+		spec.hostConfig.CapAdd = append(spec.hostConfig.CapAdd, value)
+	case "--cap-drop":
+		spec.hostConfig.CapDrop = append(spec.hostConfig.CapDrop, value)
+	case "--security-opt":
+		spec.hostConfig.SecurityOpt = append(spec.hostConfig.SecurityOpt, value)
+	case "--ulimit":
+		ulimit, err := units.ParseUlimit(value)
+		if err != nil {
+			return failure.Wrap(failure.Config, err, "Uh oh, the --ulimit in the dockerArgs should look like nofile=1024:2048")
+		}
+		spec.hostConfig.Ulimits = append(spec.hostConfig.Ulimits, ulimit)
+	case "--device":
+		// Like 'docker run': host path, then optionally the path in the container and the permissions
+		parts := strings.Split(value, ":")
+		device := container.DeviceMapping{PathOnHost: parts[0], PathInContainer: parts[0], CgroupPermissions: "rwm"}
+		if len(parts) > 1 {
+			device.PathInContainer = parts[1]
+		}
+		if len(parts) > 2 {
+			device.CgroupPermissions = parts[2]
+		}
+		spec.hostConfig.Devices = append(spec.hostConfig.Devices, device)
+	case "--dns":
+		spec.hostConfig.DNS = append(spec.hostConfig.DNS, value)
+	case "--ipc":
+		spec.hostConfig.IpcMode = container.IpcMode(value)
+	case "--pid":
+		spec.hostConfig.PidMode = container.PidMode(value)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Creates and starts a container, pulling its image first if it has to. The ID of the container is returned even if
+// it didn't start, so it can be torn down. Like waiting for containers and running commands in them, this stops when
+// kube-deploy is told to - stopping and removing them doesn't, so they can still be torn down.
+func startContainer(spec containerSpec) (string, error) {
+	engine, err := dockerEngine()
+	if err != nil {
+		return "", err
+	}
+	if err := ensureImage(spec.config.Image); err != nil {
+		return "", err
+	}
+	created, err := engine.ContainerCreate(cli.AbortContext(), &spec.config, &spec.hostConfig, nil, nil, spec.name)
+	if err != nil {
+		return "", err
+	}
+	for _, warning := range created.Warnings {
+		logger.Warn("=> Docker says: %s", warning)
+	}
+	return created.ID, engine.ContainerStart(cli.AbortContext(), created.ID, container.StartOptions{})
+}
+
+// Streams the output of a container until it stops, and returns its exit code
+func waitForContainer(containerID string) (int64, error) {
+	engine, err := dockerEngine()
+	if err != nil {
+		return -1, err
+	}
+	logs, err := engine.ContainerLogs(cli.AbortContext(), containerID, container.LogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if err != nil {
+		return -1, err
+	}
+	defer logs.Close()
+	if _, err := stdcopy.StdCopy(cli.StreamWriter, cli.StreamWriter, logs); err != nil {
+		return -1, err
+	}
+
+	statuses, errs := engine.ContainerWait(cli.AbortContext(), containerID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errs:
+		return -1, err
+	case status := <-statuses:
+		if status.Error != nil {
+			return status.StatusCode, fmt.Errorf("%s", status.Error.Message)
+		}
+		return status.StatusCode, nil
+	}
+}
+
+// Starts the test set's container from the image that was built - and unless its dockerArgs have '-d', waits for it
+// to finish, like 'docker run' would
+func startTestContainer(index int) (string, error) {
+	test := repoConfig.Tests[index]
+	spec, err := parseRunArgs(test.DockerArgs)
+	if err != nil {
+		return "", err
+	}
+	spec.config.Image = repoConfig.ImageFullPath
+	if test.DockerCommand != "" {
+		spec.config.Cmd = cli.SplitArgs(test.DockerCommand)
+	}
+
+	containerID, err := startContainer(spec)
+	if err != nil {
+		return containerID, failure.Wrap(failure.Test, err, "The test container for test set '%s' didn't start", test.Name)
+	}
+	logger.Info("=> Started the test container %s\n", shortID(containerID))
+	if spec.detach {
+		return containerID, nil
+	}
+	exitCode, err := waitForContainer(containerID)
+	if err != nil {
+		return containerID, failure.Wrap(failure.Test, err, "Uh oh, I lost track of the test container for test set '%s'", test.Name)
+	}
+	if exitCode != 0 {
+		return containerID, failure.New(failure.Test, "The test container for test set '%s' exited with %d", test.Name, exitCode)
+	}
+	return containerID, nil
+}
+
+// Runs a test command inside the test container, and returns its exit code
+func execInContainer(containerID string, command string) (int, error) {
+	engine, err := dockerEngine()
+	if err != nil {
+		return -1, err
+	}
+	execution, err := engine.ContainerExecCreate(cli.AbortContext(), containerID, container.ExecOptions{
+		Cmd:          cli.SplitArgs(command),
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return -1, err
+	}
+	attached, err := engine.ContainerExecAttach(cli.AbortContext(), execution.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return -1, err
+	}
+	defer attached.Close()
+	if _, err := stdcopy.StdCopy(cli.StreamWriter, cli.StreamWriter, attached.Reader); err != nil {
+		return -1, err
+	}
+	inspected, err := engine.ContainerExecInspect(cli.AbortContext(), execution.ID)
+	if err != nil {
+		return -1, err
+	}
+	return inspected.ExitCode, nil
+}
+
+// Runs a test command in a new container from the test command image, on the test container's network, and returns
+// its exit code. The new container is always removed.
+func runInExternalContainer(containerID string, command string) (int, error) {
+	spec := containerSpec{
+		config:     container.Config{Image: testCommandImage, Cmd: cli.SplitArgs(command)},
+		hostConfig: container.HostConfig{NetworkMode: container.NetworkMode("container:" + containerID)},
+	}
+	externalID, err := startContainer(spec)
+	if externalID != "" {
+		defer removeContainer(externalID)
+	}
+	if err != nil {
+		return -1, err
+	}
+	exitCode, err := waitForContainer(externalID)
+	return int(exitCode), err
+}
+
+func stopContainer(containerID string) {
+	engine, err := dockerEngine()
+	if err != nil {
+		return
+	}
+	if err := engine.ContainerStop(context.Background(), containerID, container.StopOptions{}); err != nil && !client.IsErrNotFound(err) {
+		logger.Warn("=> Couldn't stop the container %s: %s", shortID(containerID), err)
+	}
+}
+
+func removeContainer(containerID string) {
+	engine, err := dockerEngine()
+	if err != nil {
+		return
+	}
+	if err := engine.ContainerRemove(context.Background(), containerID, container.RemoveOptions{Force: true}); err != nil && !client.IsErrNotFound(err) {
+		logger.Warn("=> Couldn't remove the container %s: %s", shortID(containerID), err)
+	}
+}
+
+// The short form of a container ID, the way the docker CLI shows them
+func shortID(containerID string) string {
+	if len(containerID) > 12 {
+		return containerID[:12]
+	}
+	return containerID
+}
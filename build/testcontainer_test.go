@@ -0,0 +1,135 @@
+package build
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	units "github.com/docker/go-units"
+
+	"github.com/mycujoo/kube-deploy/failure"
+)
+
+func TestParseRunArgs(t *testing.T) {
+	on, off := true, false
+	tests := []struct {
+		name       string
+		dockerArgs string
+		want       containerSpec
+		wantErr    bool
+	}{
+		{
+			name: "nothing",
+		},
+		{
+			name:       "the common options, short and long",
+			dockerArgs: "-d --name db -e A=1 --env=B=2 -w /app -u node -l team=video -h db.local --add-host api:10.0.0.1 --network test -it --rm",
+			want: containerSpec{
+				name:       "db",
+				detach:     true,
+				config:     container.Config{Env: []string{"A=1", "B=2"}, WorkingDir: "/app", User: "node", Labels: map[string]string{"team": "video"}, Hostname: "db.local"},
+				hostConfig: container.HostConfig{ExtraHosts: []string{"api:10.0.0.1"}, NetworkMode: "test"},
+			},
+		},
+		{
+			name:       "published ports and volumes",
+			dockerArgs: "-p 3000:3000 -v /tmp:/data",
+			want: containerSpec{
+				config: container.Config{ExposedPorts: nat.PortSet{"3000/tcp": {}}},
+				hostConfig: container.HostConfig{
+					Binds:        []string{"/tmp:/data"},
+					PortBindings: nat.PortMap{"3000/tcp": []nat.PortBinding{{HostPort: "3000"}}},
+				},
+			},
+		},
+		{
+			name:       "switches",
+			dockerArgs: "--privileged --init --read-only --detach=false",
+			want:       containerSpec{hostConfig: container.HostConfig{Privileged: true, Init: &on, ReadonlyRootfs: true}},
+		},
+		{
+			name:       "a switch turned off",
+			dockerArgs: "--init=false",
+			want:       containerSpec{hostConfig: container.HostConfig{Init: &off}},
+		},
+		{
+			name:       "resources",
+			dockerArgs: "-m 512m --memory-swap 1g --cpus 1.5 -c 512 --shm-size=64m --ulimit nofile=1024:2048",
+			want: containerSpec{hostConfig: container.HostConfig{
+				ShmSize: 64 * 1024 * 1024,
+				Resources: container.Resources{
+					Memory:     512 * 1024 * 1024,
+					MemorySwap: 1024 * 1024 * 1024,
+					NanoCPUs:   1500000000,
+					CPUShares:  512,
+					Ulimits:    []*units.Ulimit{{Name: "nofile", Soft: 1024, Hard: 2048}},
+				},
+			}},
+		},
+		{
+			name:       "the rest of the host config",
+			dockerArgs: "--tmpfs /run:rw,size=64m --tmpfs /tmp --cap-add NET_ADMIN --cap-drop MKNOD --security-opt seccomp=unconfined --device /dev/fuse --device /dev/sda:/dev/xvda:r --dns 8.8.8.8 --ipc host --pid host",
+			want: containerSpec{hostConfig: container.HostConfig{
+				Tmpfs:       map[string]string{"/run": "rw,size=64m", "/tmp": ""},
+				CapAdd:      []string{"NET_ADMIN"},
+				CapDrop:     []string{"MKNOD"},
+				SecurityOpt: []string{"seccomp=unconfined"},
+				DNS:         []string{"8.8.8.8"},
+				IpcMode:     "host",
+				PidMode:     "host",
+				Resources: container.Resources{Devices: []container.DeviceMapping{
+					{PathOnHost: "/dev/fuse", PathInContainer: "/dev/fuse", CgroupPermissions: "rwm"},
+					{PathOnHost: "/dev/sda", PathInContainer: "/dev/xvda", CgroupPermissions: "r"},
+				}},
+			}},
+		},
+		{
+			name:       "an option it doesn't know",
+			dockerArgs: "--gpus all",
+			wantErr:    true,
+		},
+		{
+			name:       "an option without its value",
+			dockerArgs: "-d --name",
+			wantErr:    true,
+		},
+		{
+			name:       "a switch with a value which isn't true or false",
+			dockerArgs: "--privileged=yes please",
+			wantErr:    true,
+		},
+		{
+			name:       "a bad size",
+			dockerArgs: "--memory lots",
+			wantErr:    true,
+		},
+		{
+			name:       "bad ports",
+			dockerArgs: "-p 3000:notaport",
+			wantErr:    true,
+		},
+	}
+	for _, test := range tests {
+		spec, err := parseRunArgs(test.dockerArgs)
+		if test.wantErr {
+			if !failure.Is(err, failure.Config) {
+				t.Errorf("%s: parseRunArgs() = %v, want a config error", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parseRunArgs() = %v", test.name, err)
+			continue
+		}
+		if test.want.config.ExposedPorts == nil {
+			test.want.config.ExposedPorts = nat.PortSet{}
+		}
+		if test.want.hostConfig.PortBindings == nil {
+			test.want.hostConfig.PortBindings = nat.PortMap{}
+		}
+		if !reflect.DeepEqual(spec, test.want) {
+			t.Errorf("%s: parseRunArgs() = %+v, want %+v", test.name, spec, test.want)
+		}
+	}
+}
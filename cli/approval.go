@@ -0,0 +1,133 @@
+package cli
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/logger"
+)
+
+var approvalsRootPath = "/kube-deploy/approvals/"
+
+type approvalFileContents struct {
+	Approver    string
+	Approved    bool
+	DateDecided string
+}
+
+// ClearApproval removes any decision left over from an earlier canary point, so a new one has to be made
+func ClearApproval(applicationName string) error {
+	if err := makeApprovalsDir(); err != nil {
+		return err
+	}
+	if err := os.Remove(approvalsRootPath + applicationName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Only the user running the rollout can write in the approvals directory - otherwise anyone on the deployment server
+// could write a decision, whoever the approvers are
+func makeApprovalsDir() error {
+	if err := os.MkdirAll(approvalsRootPath, 0700); err != nil {
+		return failure.Wrap(failure.Unknown, err, "Uh oh, I couldn't create %s", approvalsRootPath)
+	}
+	// Older versions made it writable by everyone
+	if err := os.Chmod(approvalsRootPath, 0700); err != nil {
+		return failure.Wrap(failure.Config, err, "Uh oh, %s should only be writable by the user running the rollout", approvalsRootPath)
+	}
+	return nil
+}
+
+// WriteApproval records the current user's decision for the canary point the application's rollout is waiting at. When
+// there are approvers, the user has to be one of them - going by their login, rather than $USER, which anyone can set.
+func WriteApproval(applicationName string, approvers []string, approved bool) error {
+	currentUser, err := user.Current()
+	if err != nil {
+		return failure.Wrap(failure.Unknown, err, "Uh oh, I couldn't tell who you are")
+	}
+	if len(approvers) > 0 && !IsApprover(approvers, currentUser.Username) {
+		return failure.New(failure.PolicyDenied, "Sorry, %s isn't one of the approvers for %s", currentUser.Username, applicationName)
+	}
+	return WriteApprovalBy(applicationName, currentUser.Username, approved)
+}
+
+// WriteApprovalBy records a decision made by someone other than the current user (eg. through the approval endpoint)
+func WriteApprovalBy(applicationName string, approver string, approved bool) error {
+	if err := makeApprovalsDir(); err != nil {
+		return err
+	}
+	approvalData := approvalFileContents{
+		Approver:    approver,
+		Approved:    approved,
+		DateDecided: time.Now().Format("Jan _2 15:04:05"),
+	}
+	jsonBytes, err := json.Marshal(approvalData)
+	if err != nil {
+		return err
+	}
+	// Written to a new file (which only the current user can write) and moved into place, so it's never seen half-written
+	file, err := ioutil.TempFile(approvalsRootPath, "."+applicationName+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(jsonBytes); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), approvalsRootPath+applicationName); err != nil {
+		return err
+	}
+	logger.Info("=> Successfully recorded your decision for '%s'.\n\n", applicationName)
+	return nil
+}
+
+// ReadApproval returns whether a decision has been made yet, and if so, what it was and who made it. A decision
+// someone else could have written is removed and ignored.
+func ReadApproval(applicationName string) (decided bool, approved bool, approver string, err error) {
+	approvalFile := approvalsRootPath + applicationName
+	info, err := os.Lstat(approvalFile)
+	if os.IsNotExist(err) {
+		return false, false, "", nil
+	} else if err != nil {
+		return false, false, "", err
+	}
+	if !isOwnFile(info) {
+		logger.Warn("=> Ignoring the decision in %s, since it wasn't written by the user running the rollout.", filepath.Clean(approvalFile))
+		if err := os.Remove(approvalFile); err != nil {
+			return false, false, "", err
+		}
+		return false, false, "", nil
+	}
+
+	fileBytes, err := ioutil.ReadFile(approvalFile)
+	if err != nil {
+		return false, false, "", err
+	}
+
+	approvalData := approvalFileContents{}
+	if err := json.Unmarshal(fileBytes, &approvalData); err != nil {
+		// Might be only partially written, so try again next time
+		return false, false, "", nil
+	}
+	return true, approvalData.Approved, approvalData.Approver, nil
+}
+
+// Whether the file is a plain file which belongs to the current user (or root), and no one else can write to
+func isOwnFile(info os.FileInfo) bool {
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0022 != 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && (int(stat.Uid) == os.Getuid() || stat.Uid == 0)
+}
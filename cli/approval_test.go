@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const plantedApproval = `{"Approver":"alice","Approved":true,"DateDecided":"Jan  1 00:00:00"}`
+
+func TestReadApprovalIgnoresFilesOthersCanWrite(t *testing.T) {
+	useTempApprovals(t)
+	if err := ClearApproval("api"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(approvalsRootPath); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0700 {
+		t.Fatalf("the approvals directory is %v, want it only writable by its owner", info.Mode().Perm())
+	}
+
+	if err := ioutil.WriteFile(approvalsRootPath+"api", []byte(plantedApproval), 0666); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(approvalsRootPath+"api", 0666)
+	if decided, _, _, err := ReadApproval("api"); decided || err != nil {
+		t.Errorf("ReadApproval() of a world-writable file = %v, %v, want it ignored", decided, err)
+	}
+	if _, err := os.Stat(approvalsRootPath + "api"); !os.IsNotExist(err) {
+		t.Error("the world-writable file was left in place")
+	}
+}
+
+func TestReadApprovalIgnoresPlantedFiles(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("only root can plant a file owned by someone else")
+	}
+	useTempApprovals(t)
+	if err := ioutil.WriteFile(approvalsRootPath+"api", []byte(plantedApproval), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(approvalsRootPath+"api", 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	if decided, _, _, err := ReadApproval("api"); decided || err != nil {
+		t.Errorf("ReadApproval() of a file owned by someone else = %v, %v, want it ignored", decided, err)
+	}
+}
+
+func TestWriteApprovalOnlyLetsTheOwnerWrite(t *testing.T) {
+	useTempApprovals(t)
+	// A directory left writable by an older version is tightened up
+	os.Chmod(approvalsRootPath, 0777)
+	if err := WriteApprovalBy("api", "alice", true); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]os.FileMode{approvalsRootPath: 0700, approvalsRootPath + "api": 0600} {
+		if info, err := os.Stat(path); err != nil {
+			t.Error(err)
+		} else if info.Mode().Perm() != want {
+			t.Errorf("%s is %v, want %v", path, info.Mode().Perm(), want)
+		}
+	}
+	if decided, approved, approver, err := ReadApproval("api"); !decided || !approved || approver != "alice" || err != nil {
+		t.Errorf("ReadApproval() = %v, %v, %q, %v, want an approval by alice", decided, approved, approver, err)
+	}
+}
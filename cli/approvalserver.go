@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/logger"
+)
+
+// ApprovalSecretEnvVar : where the deployment server keeps the secret the approvers' tokens are signed with
+const ApprovalSecretEnvVar = "KUBEDEPLOY_APPROVAL_SECRET"
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// ApprovalServer lets canary points be approved remotely, by following the links posted to the approval webhook
+type ApprovalServer struct {
+	applicationName string
+	approvers       []string
+	secret          string
+
+	mutex sync.Mutex
+	token string
+}
+
+// ApprovalToken is an approver's personal token, which they give with their name to prove who they are
+func ApprovalToken(secret string, approver string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(approver))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// StartApprovalServer listens for approvals in the background, for as long as kube-deploy is running. Approvers have
+// to give their personal token (see ApprovalToken) when there's a secret - without one, anyone with the link can approve.
+func StartApprovalServer(listenAddress string, applicationName string, approvers []string, secret string) (*ApprovalServer, error) {
+	listener, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		return nil, failure.Wrap(failure.Config, err, "Uh oh, I couldn't listen for approvals on %s", listenAddress)
+	}
+	server := newApprovalServer(applicationName, approvers, secret)
+	go func() {
+		if err := http.Serve(listener, server); err != nil {
+			logger.Error("=> Uh oh, the approval endpoint stopped: %s", err)
+		}
+	}()
+	logger.Info("=> Listening for approvals on %s.\n", listener.Addr())
+	return server, nil
+}
+
+func newApprovalServer(applicationName string, approvers []string, secret string) *ApprovalServer {
+	return &ApprovalServer{
+		applicationName: applicationName,
+		approvers:       approvers,
+		secret:          secret,
+	}
+}
+
+func (s *ApprovalServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/approve":
+		s.handle(w, r, true)
+	case "/reject":
+		s.handle(w, r, false)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// NewToken starts a new canary point - only links with the returned token will be accepted
+func (s *ApprovalServer) NewToken() (string, error) {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.token = hex.EncodeToString(tokenBytes)
+	return s.token, nil
+}
+
+// Following a link only shows a confirmation form, so that link previews in chat apps can't approve anything
+func (s *ApprovalServer) handle(w http.ResponseWriter, r *http.Request, approved bool) {
+	token := r.FormValue("token")
+	s.mutex.Lock()
+	validToken := s.token != "" && hmac.Equal([]byte(token), []byte(s.token))
+	s.mutex.Unlock()
+	if !validToken {
+		http.Error(w, "This approval link has expired.", http.StatusForbidden)
+		return
+	}
+
+	action := "reject"
+	if approved {
+		action = "approve"
+	}
+
+	if r.Method != http.MethodPost {
+		approverToken := ""
+		if s.secret != "" {
+			approverToken = ` Your token: <input name="approverToken" type="password">`
+		}
+		fmt.Fprintf(w, `<form method="post"><input type="hidden" name="token" value="%s">Your name: <input name="approver">%s <button>%s %s</button></form>`,
+			html.EscapeString(token), approverToken, action, html.EscapeString(s.applicationName))
+		return
+	}
+
+	approver := r.PostFormValue("approver")
+	if !s.isApprover(approver, r.PostFormValue("approverToken")) {
+		http.Error(w, fmt.Sprintf("'%s' isn't allowed to approve rollouts of %s, or that isn't their token.", approver, s.applicationName), http.StatusForbidden)
+		return
+	}
+
+	// Each token can only be used once
+	s.mutex.Lock()
+	if s.token != token {
+		s.mutex.Unlock()
+		http.Error(w, "This approval link has expired.", http.StatusForbidden)
+		return
+	}
+	s.token = ""
+	s.mutex.Unlock()
+
+	if err := WriteApprovalBy(s.applicationName, approver, approved); err != nil {
+		http.Error(w, fmt.Sprintf("I couldn't record your decision: %s", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Thanks %s - the rollout of %s will %s.", html.EscapeString(approver), html.EscapeString(s.applicationName), map[bool]string{true: "proceed", false: "bail out"}[approved])
+}
+
+// With a secret, the approver has to give their own token. With no approvers configured, anyone can approve.
+func (s *ApprovalServer) isApprover(name string, approverToken string) bool {
+	if name == "" {
+		return false
+	}
+	if s.secret != "" && !hmac.Equal([]byte(approverToken), []byte(ApprovalToken(s.secret, name))) {
+		return false
+	}
+	return len(s.approvers) == 0 || IsApprover(s.approvers, name)
+}
+
+// IsApprover checks whether someone is in the list of approvers
+func IsApprover(approvers []string, name string) bool {
+	for _, approver := range approvers {
+		if approver == name {
+			return true
+		}
+	}
+	return false
+}
+
+// PostApprovalRequest sends the approve and reject links to a Slack-compatible incoming webhook
+func PostApprovalRequest(webhookURL string, message string) error {
+	jsonBytes, err := json.Marshal(map[string]string{"text": message})
+	if err != nil {
+		return err
+	}
+
+	response, err := webhookClient.Post(webhookURL, "application/json", bytes.NewReader(jsonBytes))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("the webhook responded with status %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package cli
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/user"
+	"strings"
+	"testing"
+
+	"github.com/mycujoo/kube-deploy/failure"
+)
+
+func useTempApprovals(t *testing.T) {
+	previous := approvalsRootPath
+	approvalsRootPath = t.TempDir() + "/"
+	t.Cleanup(func() { approvalsRootPath = previous })
+}
+
+func post(t *testing.T, endpoint string, form url.Values) (int, string) {
+	t.Helper()
+	response, err := http.PostForm(endpoint, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	return response.StatusCode, string(body)
+}
+
+func TestApprovalServer(t *testing.T) {
+	useTempApprovals(t)
+	const secret = "s3cret"
+	server := newApprovalServer("api", []string{"alice", "bob"}, secret)
+	endpoint := httptest.NewServer(server)
+	defer endpoint.Close()
+
+	token, err := server.NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Following the link only shows the form
+	response, err := http.Get(endpoint.URL + "/approve?token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || !strings.Contains(string(body), `name="approverToken"`) {
+		t.Errorf("GET /approve = %d %q, want the form asking for a token", response.StatusCode, body)
+	}
+	if decided, _, _, _ := ReadApproval("api"); decided {
+		t.Fatal("following the link recorded a decision")
+	}
+
+	tests := []struct {
+		name     string
+		form     url.Values
+		wantCode int
+	}{
+		{"wrong link token", url.Values{"token": {"nope"}, "approver": {"alice"}, "approverToken": {ApprovalToken(secret, "alice")}}, http.StatusForbidden},
+		{"no name", url.Values{"token": {token}, "approverToken": {ApprovalToken(secret, "")}}, http.StatusForbidden},
+		{"not an approver", url.Values{"token": {token}, "approver": {"mallory"}, "approverToken": {ApprovalToken(secret, "mallory")}}, http.StatusForbidden},
+		{"no approver token", url.Values{"token": {token}, "approver": {"alice"}}, http.StatusForbidden},
+		{"someone else's token", url.Values{"token": {token}, "approver": {"alice"}, "approverToken": {ApprovalToken(secret, "bob")}}, http.StatusForbidden},
+		{"token signed with another secret", url.Values{"token": {token}, "approver": {"alice"}, "approverToken": {ApprovalToken("guess", "alice")}}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if code, body := post(t, endpoint.URL+"/approve", test.form); code != test.wantCode {
+			t.Errorf("%s: got %d %q, want %d", test.name, code, body, test.wantCode)
+		}
+	}
+	if decided, _, _, _ := ReadApproval("api"); decided {
+		t.Fatal("a rejected request recorded a decision")
+	}
+
+	approval := url.Values{"token": {token}, "approver": {"alice"}, "approverToken": {ApprovalToken(secret, "alice")}}
+	if code, body := post(t, endpoint.URL+"/approve", approval); code != http.StatusOK {
+		t.Fatalf("approving got %d %q, want 200", code, body)
+	}
+	decided, approved, approver, err := ReadApproval("api")
+	if err != nil || !decided || !approved || approver != "alice" {
+		t.Errorf("ReadApproval() = %v, %v, %q, %v, want an approval by alice", decided, approved, approver, err)
+	}
+
+	// Each link only works once
+	if code, _ := post(t, endpoint.URL+"/reject", approval); code != http.StatusForbidden {
+		t.Errorf("reusing the link got %d, want 403", code)
+	}
+}
+
+func TestApprovalServerReject(t *testing.T) {
+	useTempApprovals(t)
+	server := newApprovalServer("api", []string{"bob"}, "s3cret")
+	endpoint := httptest.NewServer(server)
+	defer endpoint.Close()
+
+	token, _ := server.NewToken()
+	form := url.Values{"token": {token}, "approver": {"bob"}, "approverToken": {ApprovalToken("s3cret", "bob")}}
+	if code, body := post(t, endpoint.URL+"/reject", form); code != http.StatusOK {
+		t.Fatalf("rejecting got %d %q, want 200", code, body)
+	}
+	if decided, approved, approver, _ := ReadApproval("api"); !decided || approved || approver != "bob" {
+		t.Errorf("ReadApproval() = %v, %v, %q, want a rejection by bob", decided, approved, approver)
+	}
+}
+
+func TestApprovalServerWithoutSecret(t *testing.T) {
+	useTempApprovals(t)
+	server := newApprovalServer("api", nil, "")
+	endpoint := httptest.NewServer(server)
+	defer endpoint.Close()
+
+	token, _ := server.NewToken()
+	if code, body := post(t, endpoint.URL+"/approve", url.Values{"token": {token}, "approver": {"anyone"}}); code != http.StatusOK {
+		t.Fatalf("approving without approvers or a secret got %d %q, want 200", code, body)
+	}
+	if code, _ := post(t, endpoint.URL+"/elsewhere", url.Values{"token": {token}}); code != http.StatusNotFound {
+		t.Errorf("an unknown path got %d, want 404", code)
+	}
+}
+
+func TestWriteApprovalChecksApprovers(t *testing.T) {
+	useTempApprovals(t)
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	err = WriteApproval("api", []string{currentUser.Username + "-not"}, true)
+	if !failure.Is(err, failure.PolicyDenied) {
+		t.Errorf("WriteApproval() by someone who isn't an approver = %v, want a PolicyDenied failure", err)
+	}
+	if decided, _, _, _ := ReadApproval("api"); decided {
+		t.Error("a decision was recorded for someone who isn't an approver")
+	}
+
+	if err := WriteApproval("api", []string{currentUser.Username}, true); err != nil {
+		t.Fatalf("WriteApproval() by an approver = %v", err)
+	}
+	if decided, approved, approver, _ := ReadApproval("api"); !decided || !approved || approver != currentUser.Username {
+		t.Errorf("ReadApproval() = %v, %v, %q, want an approval by %s", decided, approved, approver, currentUser.Username)
+	}
+}
+
+func TestPostApprovalRequest(t *testing.T) {
+	var received map[string]string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer webhook.Close()
+
+	if err := PostApprovalRequest(webhook.URL, "Approve: https://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if received["text"] != "Approve: https://example.com" {
+		t.Errorf("the webhook got %v", received)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	if err := PostApprovalRequest(failing.URL, "hi"); err == nil {
+		t.Error("PostApprovalRequest() to a failing webhook didn't return an error")
+	}
+}
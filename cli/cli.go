@@ -2,40 +2,43 @@ package cli
 
 import (
 	"bytes"
-	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"regexp"
 	"strings"
 	"syscall"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/logger"
 )
 
 func GetCommandOutput(cmdName string, cmdArgs string) string {
-	output, _ := runCommand(cmdName, cmdArgs, false, false)
+	output, _ := runCommand(cmdName, cmdArgs, false, false, nil)
 	return output
 }
 
 func GetCommandExitCode(cmdName string, cmdArgs string) int {
-	_, exit := runCommand(cmdName, cmdArgs, false, true) // Sends quiet signal
+	_, exit := runCommand(cmdName, cmdArgs, false, true, nil) // Sends quiet signal
 	return exit
 }
 
 func GetCommandOutputAndExitCode(cmdName string, cmdArgs string) (string, int) {
-	output, exit := runCommand(cmdName, cmdArgs, false, false)
+	output, exit := runCommand(cmdName, cmdArgs, false, false, nil)
 	return output, exit
 }
 
 func StreamAndGetCommandOutput(cmdName string, cmdArgs string) string {
-	output, _ := runCommand(cmdName, cmdArgs, true, false)
+	output, _ := runCommand(cmdName, cmdArgs, true, false, nil)
 	return output
 }
 func StreamAndGetCommandOutputAndExitCode(cmdName string, cmdArgs string) (string, int) {
-	output, exit := runCommand(cmdName, cmdArgs, true, false)
+	output, exit := runCommand(cmdName, cmdArgs, true, false, nil)
 	return output, exit
 }
 
 func StreamAndGetCommandExitCode(cmdName string, cmdArgs string) int {
-	_, exit := runCommand(cmdName, cmdArgs, true, false)
+	_, exit := runCommand(cmdName, cmdArgs, true, false, nil)
 	return exit
 }
 
@@ -47,15 +50,25 @@ type output struct {
 
 func (o *output) Write(p []byte) (int, error) {
 	if o.stream {
-		splitByNewline := strings.Split(strings.Trim(string(p), "\n"), "\n")
-		for _, l := range splitByNewline {
-			fmt.Println("\t| ", l)
-		}
+		StreamWriter.Write(p)
 	}
 	o.combinedOut.Write(string(p))
 	return o.buf.Write(p)
 }
 
+// StreamWriter prints everything written to it the way the output of commands is streamed
+var StreamWriter io.Writer = streamWriter{}
+
+type streamWriter struct{}
+
+func (streamWriter) Write(p []byte) (int, error) {
+	splitByNewline := strings.Split(strings.Trim(string(p), "\n"), "\n")
+	for _, l := range splitByNewline {
+		logger.Info("\t|  %s", l)
+	}
+	return len(p), nil
+}
+
 type combinedOutput struct {
 	lines []string
 }
@@ -64,8 +77,8 @@ func (c *combinedOutput) Write(s string) {
 	c.lines = append(c.lines, s)
 }
 
-func runCommand(cmdName string, cmdArgs string, stream bool, quiet bool) (string, int) {
-
+// SplitArgs splits a string of arguments the way the commands are run - by whitespace, except inside quotation marks
+func SplitArgs(cmdArgs string) []string {
 	// This cmdArgs mess is to facilitate running arbitrary shell commands via `bash -c "<command>"`
 	// Regex will split into groups either by whitespace or by quotation marks
 	splitRe := regexp.MustCompile(`"(.+)"|(\S+)`)
@@ -76,8 +89,26 @@ func runCommand(cmdName string, cmdArgs string, stream bool, quiet bool) (string
 			brokenArgs[i] = strings.Replace(s, "\"", "", -1)
 		}
 	}
+	return brokenArgs
+}
 
-	cmd := exec.Command(cmdName, brokenArgs...)
+// GetCommandOutputAndExitCodeWithEnv runs the command with extra environment variables ('NAME=value'), which only it sees
+func GetCommandOutputAndExitCodeWithEnv(cmdName string, cmdArgs string, env []string) (string, int) {
+	return runCommand(cmdName, cmdArgs, false, false, env)
+}
+
+func runCommand(cmdName string, cmdArgs string, stream bool, quiet bool, env []string) (string, int) {
+	cmd := exec.CommandContext(commandContext(), cmdName, SplitArgs(cmdArgs)...)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	// In its own process group, a Ctrl-C at the terminal doesn't stop the command - kube-deploy does that itself, along
+	// with anything the command started, once it's really been told to stop
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 10 * time.Second
 
 	combinedOutput := &combinedOutput{
 		lines: []string{},
@@ -97,19 +128,9 @@ func runCommand(cmdName string, cmdArgs string, stream bool, quiet bool) (string
 	cmd.Stderr = serr
 
 	if err := cmd.Start(); err != nil {
-		fmt.Fprint(
-			os.Stderr,
-			"=> There was an error starting command: `",
-			cmdName, " ",
-			strings.Trim(fmt.Sprint(cmdArgs), "[]"),
-			"`, resulting in the error: ",
-			err,
-			"\n")
-		if !stream {
-			fmt.Println("\n\t| ", strings.Join(combinedOutput.lines, "\n\t| "))
-		}
-		fmt.Printf("\n")
-		os.Exit(1)
+		logger.Error("=> There was an error starting command: `%s %s`, resulting in the error: %s", cmdName, cmdArgs, err)
+		// The same exit code a shell uses when it can't find the command
+		return "", 127
 	}
 
 	var exitCode int
@@ -120,18 +141,10 @@ func runCommand(cmdName string, cmdArgs string, stream bool, quiet bool) (string
 			}
 		}
 		if !quiet {
-			fmt.Fprint(
-				os.Stderr,
-				"=> There was an error while running command: `",
-				cmdName, " ",
-				strings.Trim(fmt.Sprint(cmdArgs), "[]"),
-				"`, resulting in the error: ",
-				err,
-				"\n")
+			logger.Warn("=> There was an error while running command: `%s %s`, resulting in the error: %s", cmdName, cmdArgs, err)
 			if !stream {
-				fmt.Println("\n\t| ", strings.Join(combinedOutput.lines, "\n\t| "))
+				logger.Warn("\n\t|  %s\n", strings.Join(combinedOutput.lines, "\n\t| "))
 			}
-			fmt.Printf("\n")
 		}
 	}
 
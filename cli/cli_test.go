@@ -0,0 +1,22 @@
+package cli
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCommandEnvOnlyReachesTheCommand(t *testing.T) {
+	output, exitCode := GetCommandOutputAndExitCodeWithEnv("sh", `-c "echo $KD_TEST_ONLY_VAR"`, []string{"KD_TEST_ONLY_VAR=app-a"})
+	if exitCode != 0 || strings.TrimSpace(output) != "app-a" {
+		t.Errorf("the command printed %q (exit code %d), want \"app-a\"", output, exitCode)
+	}
+	if _, ok := os.LookupEnv("KD_TEST_ONLY_VAR"); ok {
+		t.Error("the variable was left in kube-deploy's own environment")
+	}
+
+	output, _ = GetCommandOutputAndExitCode("sh", `-c "echo $KD_TEST_ONLY_VAR"`)
+	if strings.TrimSpace(output) != "" {
+		t.Errorf("the next command still saw %q", output)
+	}
+}
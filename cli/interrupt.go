@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/logger"
+
+	"golang.org/x/term"
+)
+
+// How long a second Ctrl-C has to come after the first, to abort an interactive run
+const abortConfirmTime = 5 * time.Second
+
+var (
+	abortContext, abort = context.WithCancel(context.Background())
+
+	handlersMutex sync.Mutex
+	handlers      int  // How much of the work in progress stops and cleans up after itself when aborted
+	bailingOut    bool // Once bailing out, commands aren't stopped by the abort any more
+)
+
+// HandleAborts says the caller stops and cleans up after itself once kube-deploy is told to stop (see Aborted), so an
+// interrupt no longer ends kube-deploy straight away - call the returned function once it's done.
+func HandleAborts() (done func()) {
+	handlersMutex.Lock()
+	defer handlersMutex.Unlock()
+	handlers++
+	return func() {
+		handlersMutex.Lock()
+		defer handlersMutex.Unlock()
+		handlers--
+	}
+}
+
+// AbortContext is cancelled once kube-deploy is told to stop
+func AbortContext() context.Context {
+	return abortContext
+}
+
+// Aborted returns an Interrupted failure once kube-deploy has been told to stop, for the work in progress to bail out with
+func Aborted() error {
+	if abortContext.Err() != nil {
+		return failure.New(failure.Interrupted, "Interrupted, so I stopped")
+	}
+	return nil
+}
+
+// Sleep waits for d, unless kube-deploy is told to stop first
+func Sleep(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-abortContext.Done():
+	case <-timer.C:
+	}
+	return Aborted()
+}
+
+// StartBailingOut lets commands run to the end again, so bailing out isn't cut short by the interrupt which caused it
+func StartBailingOut() {
+	handlersMutex.Lock()
+	defer handlersMutex.Unlock()
+	bailingOut = true
+}
+
+// The context commands are run with - they're stopped when kube-deploy is, unless it's bailing out
+func commandContext() context.Context {
+	handlersMutex.Lock()
+	defer handlersMutex.Unlock()
+	if bailingOut {
+		return context.Background()
+	}
+	return abortContext
+}
+
+// CatchInterrupts catches SIGINT and SIGTERM, and tells the work in progress to stop. If none of it handles that (see
+// HandleAborts), exit is called straight away. When run from a terminal, the first Ctrl-C only offers to abort, and a
+// second one does it.
+func CatchInterrupts(exit func(err error)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		var offeredAt time.Time
+		for s := range signals {
+			if abortContext.Err() != nil {
+				logger.Warn("\n=> I'm already stopping - hang on while I clean up.")
+				continue
+			}
+			if s == os.Interrupt && IsInteractive() && handlingAborts() && time.Since(offeredAt) > abortConfirmTime {
+				offeredAt = time.Now()
+				logger.Warn("\n=> Whoah there! Press Ctrl-C again within %d seconds and I'll stop, clean up, and bail out of anything in progress.", int(abortConfirmTime.Seconds()))
+				continue
+			}
+			abort()
+			if !handlingAborts() {
+				exit(Aborted())
+			}
+			logger.Warn("\n=> Interrupted! Cleaning up before I stop...")
+		}
+	}()
+}
+
+// IsInteractive is true when someone is at a terminal to answer questions
+func IsInteractive() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+func handlingAborts() bool {
+	handlersMutex.Lock()
+	defer handlersMutex.Unlock()
+	return handlers > 0
+}
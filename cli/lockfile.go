@@ -6,6 +6,9 @@ import (
 	"io/ioutil"
 	"os"
 	"time"
+
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/logger"
 )
 
 const locksRootPath string = "/kube-deploy/locks/"
@@ -32,21 +35,20 @@ func lockFileExists(filename string) bool {
 	return true
 }
 
-func readLockFile(filename string) lockFileContents {
+func readLockFile(filename string) (lockFileContents, error) {
+	lockFileData := lockFileContents{}
 	fileBytes, err := ioutil.ReadFile(locksRootPath + filename)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Failed reading repo config file:", err)
-		os.Exit(1)
+		return lockFileData, failure.Wrap(failure.Unknown, err, "Failed reading lockfile")
 	}
 
-	lockFileData := lockFileContents{}
 	if err := json.Unmarshal(fileBytes, &lockFileData); err != nil {
-		panic(err)
+		return lockFileData, failure.Wrap(failure.Unknown, err, "Failed parsing lockfile")
 	}
-	return lockFileData
+	return lockFileData, nil
 }
 
-func WriteLockFile(filename, reason string) {
+func WriteLockFile(filename, reason string) error {
 	currentUser := os.Getenv("USER")
 	lockFileData := lockFileContents{
 		Author:      currentUser,
@@ -55,52 +57,102 @@ func WriteLockFile(filename, reason string) {
 	}
 	jsonBytes, err := json.Marshal(lockFileData)
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
 	err = ioutil.WriteFile(locksRootPath+filename, jsonBytes, 0666)
 	if err != nil {
-		panic(err.Error())
+		return failure.Wrap(failure.Unknown, err, "Failed writing lockfile")
 	}
-	fmt.Printf("=> Successfully wrote lockfile for '%s'.\n\n", filename)
+	logger.Info("=> Successfully wrote lockfile for '%s'.\n\n", filename)
+	return nil
 }
 
-func DeleteLockFile(filename string) {
-	err := os.Remove(locksRootPath + filename)
-	if err != nil {
-		panic(err.Error())
+func DeleteLockFile(filename string) error {
+	if err := os.Remove(locksRootPath + filename); err != nil {
+		return failure.Wrap(failure.Unknown, err, "Failed removing lockfile")
 	}
+	return nil
 }
 
-func IsLocked(applicationName string) bool {
-	if lockFileExists("all") {
-		fmt.Println("=> All rollouts are currently blocked.")
-		lock := readLockFile("all")
-		fmt.Printf("\tBlocked by: %s\n\tFor reason: %s\n\tOn date: %s\n",
-			lock.Author, lock.Reason, lock.DateStarted)
-		return true
-	}
-	if lockFileExists(applicationName) {
-		fmt.Printf("=> Rollouts for %s are blocked.\n", applicationName)
-		lock := readLockFile(applicationName)
-		fmt.Printf("\tBlocked by: %s\n\tFor reason: %s\n\tOn date: %s\n",
-			lock.Author, lock.Reason, lock.DateStarted)
-		return true
+// LockStatus : whether rollouts of an application are blocked, and by whom
+type LockStatus struct {
+	Locked      bool    `json:"locked" yaml:"locked"`
+	Scope       string  `json:"scope,omitempty" yaml:"scope,omitempty"` // 'all', or the application name
+	Author      string  `json:"author,omitempty" yaml:"author,omitempty"`
+	Reason      string  `json:"reason,omitempty" yaml:"reason,omitempty"`
+	DateStarted string  `json:"dateStarted,omitempty" yaml:"dateStarted,omitempty"`
+	Freeze      *Freeze `json:"freeze,omitempty" yaml:"freeze,omitempty"` // Any freeze window the environment is in
+}
+
+// Freeze : a scheduled window when rollouts are frozen, which only '--break-freeze' gets past
+type Freeze struct {
+	Name   string    `json:"name" yaml:"name"`
+	Reason string    `json:"reason" yaml:"reason"`
+	Until  time.Time `json:"until" yaml:"until"`
+}
+
+// GetLockStatus checks the lockfiles without printing anything
+func GetLockStatus(applicationName string) (LockStatus, error) {
+	for _, scope := range []string{"all", applicationName} {
+		if lockFileExists(scope) {
+			lock, err := readLockFile(scope)
+			if err != nil {
+				return LockStatus{}, err
+			}
+			return LockStatus{
+				Locked:      true,
+				Scope:       scope,
+				Author:      lock.Author,
+				Reason:      lock.Reason,
+				DateStarted: lock.DateStarted,
+			}, nil
+		}
 	}
-	return false
+	return LockStatus{Locked: false}, nil
 }
 
-func LockBeforeRollout(applicationName string, force bool) {
-	if !IsLocked(applicationName) {
-		WriteLockFile(applicationName, "rollout in progress")
+func IsLocked(applicationName string) (bool, error) {
+	status, err := GetLockStatus(applicationName)
+	if err != nil || !status.Locked {
+		return false, err
+	}
+	if status.Scope == "all" {
+		logger.Warn("=> All rollouts are currently blocked.")
 	} else {
-		if force {
-			fmt.Println("=> Lockfile exists, but proceeding anyway due to '--force'.")
-			return
+		logger.Warn("=> Rollouts for %s are blocked.\n", applicationName)
+	}
+	logger.Warn("\tBlocked by: %s\n\tFor reason: %s\n\tOn date: %s\n",
+		status.Author, status.Reason, status.DateStarted)
+	return true, nil
+}
+
+// LockBeforeRollout writes the lockfile, unless someone else holds it or the environment is frozen. A freeze is only
+// broken with a reason for doing so.
+func LockBeforeRollout(applicationName string, force bool, freeze *Freeze, breakFreeze string) error {
+	reason := "rollout in progress"
+	if freeze != nil {
+		logger.Warn("=> Rollouts are frozen until %s, for '%s': %s", freeze.Until.Format("Mon Jan _2 15:04 MST"), freeze.Name, freeze.Reason)
+		if breakFreeze == "" {
+			return failure.New(failure.LockHeld, "Rollouts are frozen, so I'm not going to start - if it really can't wait, add --break-freeze \"<reason>\"")
 		}
-		os.Exit(1)
+		logger.Warn("=> Breaking the freeze, because: %s", breakFreeze)
+		reason = fmt.Sprintf("rollout in progress, breaking the freeze '%s' (%s)", freeze.Name, breakFreeze)
+	}
+
+	locked, err := IsLocked(applicationName)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return WriteLockFile(applicationName, reason)
+	}
+	if force {
+		logger.Warn("=> Lockfile exists, but proceeding anyway due to '--force'.")
+		return nil
 	}
+	return failure.New(failure.LockHeld, "Someone else is rolling out (or rollouts are blocked), so I'm not going to start")
 }
 
-func UnlockAfterRollout(applicationName string) {
-	DeleteLockFile(applicationName)
+func UnlockAfterRollout(applicationName string) error {
+	return DeleteLockFile(applicationName)
 }
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/build"
+	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/logger"
+	"github.com/mycujoo/kube-deploy/notify"
+	"github.com/simonleung8/flags"
+)
+
+// flagDefinition : a command line flag, which commands pick by name
+type flagDefinition struct {
+	Name         string
+	Short        string
+	Usage        string
+	IsBool       bool
+	DefaultValue string
+	Values       []string // The values it can take, for shell completion
+	EnvVar       string   // Used when the flag isn't given
+}
+
+// command : one of the kube-deploy subcommands, with its own flags and arguments
+type command struct {
+	Name        string
+	Aliases     []string
+	Group       string
+	Arguments   string   // eg. '<replicas>', for the usage line
+	ArgValues   []string // The values the first argument can take, for shell completion
+	MinArgs     int
+	MaxArgs     int
+	Description string
+	Flags       []string
+	Standalone  bool // Doesn't need the repo configuration (or the internet)
+	AllApps     bool // Works for every application at once, so it's only run once in a monorepo
+	ChangedApps bool // In a monorepo without '--app', only runs for the applications that have changed since their live release
+	OneApp      bool // Changes a single application, so a monorepo needs '--app' - the rest run for every application
+	Run         func(args []string) error
+}
+
+// The command groups, in the order they're shown in the help
+var commandGroups = []string{"Context", "Building", "Rolling Out", "Kubernetes", "Help"}
+
+var flagDefinitions = []flagDefinition{
+	{Name: "help", Short: "h", Usage: "Shows the help for a command.", IsBool: true},
+	{Name: "debug", Usage: "Print extra-fun information (the same as '--log-level debug').", IsBool: true},
+	{Name: "quiet", Short: "q", Usage: "Silences as much output as possible (the same as '--log-level warn').", IsBool: true},
+	{Name: "log-level", Usage: "Only print messages at this level or above: debug, info, warn or error.", DefaultValue: "info", Values: []string{"debug", "info", "warn", "error"}},
+	{Name: "log-format", Usage: "How messages are printed: text, or json (one object per line, for CI log ingestion).", DefaultValue: "text", Values: []string{"text", "json"}},
+	{Name: "log-file", Usage: "Also append every message to this file."},
+	{Name: "test-only", Usage: "Skips the run configuration and only tests that the binary can start.", IsBool: true},
+	{Name: "app-dir", Usage: "The directory of the app to work with, instead of the current one.", EnvVar: "KUBEDEPLOY_APP_DIR"},
+	{Name: "config", Usage: "The deploy.yaml to read, instead of the one in the app directory.", EnvVar: "KUBEDEPLOY_CONFIG"},
+	{Name: "app", Usage: "The application to work with, when the deploy.yaml has several - by default, every one (or for build and start-rollout, every one that has changed since its live release).", EnvVar: "KUBEDEPLOY_APP"},
+	{Name: "namespace", Usage: "The Kubernetes namespace (environment) to use, instead of the one for the git branch.", EnvVar: "KUBEDEPLOY_NAMESPACE"},
+	{Name: "cluster", Usage: "The name of the cluster to use, instead of the one for the git branch.", EnvVar: "KUBEDEPLOY_CLUSTER"},
+	{Name: "image-tag", Usage: "The Docker image tag to build and roll out, instead of '<version>-<branch>-<sha>'.", EnvVar: "KUBEDEPLOY_IMAGE_TAG"},
+	{Name: "output", Short: "o", Usage: "Output format: table, json or yaml.", DefaultValue: outputTable, Values: []string{outputTable, outputJSON, outputYAML}},
+	{Name: "override-dirty-workdir", Usage: "Forces a build even if the git working directory is dirty (only needed for 'production' and 'master' branches).", IsBool: true},
+	{Name: "force", Usage: "Unwisely bypasses the lockfile, which you really need. Even you.", IsBool: true},
+	{Name: "break-freeze", Usage: "Goes ahead during a freeze window - give the reason, which is recorded on the release and sent to the notifications."},
+	{Name: "force-push-image", Usage: "Automatically push the built Docker image if the tests pass (useful for CI/CD).", IsBool: true},
+	{Name: "keep-test-container", Usage: "Don't clean up (docker rm) the test containers (Default false).", IsBool: true},
+	{Name: "no-canary", Usage: "Bypass the canary release points entirely.", IsBool: true},
+	{Name: "approval-mode", Usage: "How canary points are approved: interactive (default), auto-after-hold, automated-analysis-only or external-approval (useful for CI/CD).", Values: []string{approvalModeInteractive, approvalModeAutoAfterHold, approvalModeAutomatedAnalysis, approvalModeExternal}},
+	{Name: "no-lint", Usage: "Skips linting the Kubernetes files before the rollout.", IsBool: true},
+	{Name: "show-secrets", Usage: "Shows the values of variables which look like secrets, instead of '<redacted>'.", IsBool: true},
+	{Name: "keep-kubernetes-template-files", Usage: "Leaves the templated-out kubernetes files under the directory '.kubedeploy-temp'.", IsBool: true},
+}
+
+// Every command gets these
+var globalFlags = []string{"help", "debug", "quiet", "log-level", "log-format", "log-file", "test-only", "app-dir", "config", "app", "namespace", "cluster", "image-tag"}
+
+var buildFlags = []string{"force-push-image", "override-dirty-workdir", "keep-test-container"}
+
+var commands []*command
+
+func init() {
+	// Set up in init, since 'help' and 'completion' refer back to the commands
+	commands = []*command{
+		{Name: "name", Group: "Context", Flags: []string{"output"},
+			Description: "Prints the full path of the docker image that `kube-deploy` would currently build and roll out.",
+			Run:         func(args []string) error { return printValue("imageFullPath", repoConfig.ImageFullPath) }},
+		{Name: "environment", Group: "Context", Flags: []string{"output"},
+			Description: "Prints the current environment/namespace being considered - one of 'production', 'staging', or 'development' - unless overridden.",
+			Run:         func(args []string) error { return printValue("environment", repoConfig.Namespace) }},
+		{Name: "release", Group: "Context", Flags: []string{"output"},
+			Description: "Prints the name of the release (the Deployment name) that a rollout would create.",
+			Run:         func(args []string) error { return printValue("releaseName", repoConfig.ReleaseName) }},
+		{Name: "info", Group: "Context", Flags: []string{"output"},
+			Description: "Prints everything `kube-deploy` knows about the current project and branch: the application, git data, image, environment, cluster and release.",
+			Run:         func(args []string) error { return printInfo() }},
+		{Name: "cluster", Group: "Context", Flags: []string{"output"},
+			Description: "Prints the name of the cluster to be rolled out to - 'production' for the 'production' and 'staging' environments, 'development' otherwise.",
+			Run:         func(args []string) error { return printValue("cluster", repoConfig.ClusterName) }},
+		{Name: "vars", Group: "Context", Flags: []string{"output", "show-secrets"},
+			Description: "Prints every template variable for the current branch, with its value and where it came from.",
+			Run:         func(args []string) error { return printTemplateVariables() }},
+		{Name: "validate", Group: "Context", Standalone: true,
+			Description: "Checks the deploy.yaml for mistakes - unknown settings, bad values, broken template variables and missing files - without building or rolling out anything.",
+			Run:         func(args []string) error { return validateRepoConfig() }},
+		{Name: "config", Group: "Context", Arguments: "<migrate>", ArgValues: []string{"migrate"}, MinArgs: 1, MaxArgs: 1, Standalone: true,
+			Description: "'config migrate' rewrites the deploy.yaml in the current format (its 'apiVersion'), keeping its comments.",
+			Run: func(args []string) error {
+				if args[0] != "migrate" {
+					return failure.New(failure.Config, "Uh oh - 'config' can only 'migrate', not '%s'.", args[0])
+				}
+				return migrateRepoConfig()
+			}},
+
+		{Name: "build", Aliases: []string{"make"}, Group: "Building", ChangedApps: true, Flags: buildFlags,
+			Description: "Builds a Docker image, runs the build tests, and pushes the image to the remote repository.",
+			Run: func(args []string) error {
+				return build.MakeAndPushBuild(runFlags.Bool("force-push-image"), runFlags.Bool("override-dirty-workdir"), runFlags.Bool("keep-test-container"), repoConfig)
+			}},
+		{Name: "test", Group: "Building", ChangedApps: true, Flags: []string{"override-dirty-workdir", "keep-test-container"},
+			Description: "Makes a build and runs the build tests, but does not push the build.",
+			Run: func(args []string) error {
+				return build.MakeAndTestBuild(runFlags.Bool("override-dirty-workdir"), runFlags.Bool("keep-test-container"), repoConfig)
+			}},
+		{Name: "testonly", Group: "Building", ChangedApps: true, Flags: []string{"keep-test-container"},
+			Description: "Runs the tests without making a build - only use if you're certain you haven't changed anything since the last build.",
+			Run:         func(args []string) error { return build.RunBuildTests(runFlags.Bool("keep-test-container")) }},
+		{Name: "list-tags", Group: "Building", Flags: []string{"output"},
+			Description: "Prints a list of available docker tags in the remote repository that match the current git branch (Google Cloud Registry only).",
+			Run:         func(args []string) error { return printDockerTags() }},
+
+		{Name: "start-rollout", Group: "Rolling Out", ChangedApps: true, Flags: append([]string{"force", "break-freeze", "no-canary", "no-lint", "approval-mode", "keep-kubernetes-template-files"}, buildFlags...),
+			Description: "Starts a new rollout, building and pushing the image first if there isn't one yet.",
+			Run:         func(args []string) error { return kubeStartRollout() }},
+		{Name: "rollback", Group: "Rolling Out", OneApp: true, Flags: []string{"no-canary", "approval-mode"},
+			Description: "Immediately rolls back to the previous release.",
+			Run:         func(args []string) error { return kubeInstantRollback() }},
+		{Name: "status", Group: "Rolling Out", Flags: []string{"output"},
+			Description: "Checks the lockfile to see if anyone is currently rolling out from this machine.",
+			Run:         func(args []string) error { return printLockStatus() }},
+		{Name: "lock", Group: "Rolling Out", OneApp: true,
+			Description: "Writes the lockfile (prevents others from starting a deployment) for this project without starting a deployment.",
+			Run: func(args []string) error {
+				return lockRollouts(repoConfig.Application.Name, "manually blocked rollouts for "+repoConfig.Application.Name, "Blocked rollouts for "+repoConfig.Application.Name)
+			}},
+		{Name: "unlock", Group: "Rolling Out", OneApp: true,
+			Description: "Removes the lockfile, if it was created from the 'lock' command.",
+			Run: func(args []string) error {
+				return unlockRollouts(repoConfig.Application.Name, "Unblocked rollouts for "+repoConfig.Application.Name)
+			}},
+		{Name: "lock-all", Group: "Rolling Out", AllApps: true,
+			Description: "Writes the lockfile (prevents others from starting a deployment) for ALL projects.",
+			Run: func(args []string) error {
+				return lockRollouts("all", "manually blocked all rollouts", "Blocked all rollouts")
+			}},
+		{Name: "unlock-all", Group: "Rolling Out", AllApps: true,
+			Description: "Removes the lockfile for ALL projects, if it was created from the 'lock-all' command.",
+			Run:         func(args []string) error { return unlockRollouts("all", "Unblocked all rollouts") }},
+		{Name: "approve", Group: "Rolling Out", OneApp: true,
+			Description: "Approves the canary point a rollout is waiting at (with the 'external-approval' approval mode) - if there are approvers, you have to be one.",
+			Run: func(args []string) error {
+				return cli.WriteApproval(repoConfig.Application.Name, repoConfig.Rollout.Approval.Approvers, true)
+			}},
+		{Name: "reject", Group: "Rolling Out", OneApp: true,
+			Description: "Rejects the canary point a rollout is waiting at, which bails out of the rollout.",
+			Run: func(args []string) error {
+				return cli.WriteApproval(repoConfig.Application.Name, repoConfig.Rollout.Approval.Approvers, false)
+			}},
+		{Name: "approval-token", Group: "Rolling Out", Arguments: "<approver>", MinArgs: 1, MaxArgs: 1, Standalone: true,
+			Description: "Prints an approver's personal token for approving canary points remotely, signed with $KUBEDEPLOY_APPROVAL_SECRET.",
+			Run:         func(args []string) error { return printApprovalToken(args[0]) }},
+
+		{Name: "active-deployments", Group: "Kubernetes", Flags: []string{"output"},
+			Description: "Lists the Deployments currently associated with this project and branch, as well as their replica count and creation date.",
+			Run:         func(args []string) error { return kubeListDeployments() }},
+		{Name: "rolling-restart", Group: "Kubernetes", OneApp: true,
+			Description: "Will create a new ReplicaSet of the same image, to gradually restart all pods for the Deployment.",
+			Run:         func(args []string) error { return kubeRollingRestart() }},
+		{Name: "scale", Group: "Kubernetes", OneApp: true, Arguments: "<replicas>", MinArgs: 1, MaxArgs: 1,
+			Description: "Scales the current deployment for this project and branch to the provided number of pods.",
+			Run: func(args []string) error {
+				replicas, err := strconv.ParseInt(args[0], 0, 32)
+				if err != nil || replicas < 0 {
+					return failure.New(failure.Config, "'%s' isn't a number of replicas", args[0])
+				}
+				return kubeScaleDeployment(int32(replicas))
+			}},
+		{Name: "template-only", Group: "Kubernetes",
+			Description: "Templates the Kubernetes files into '.kubedeploy-temp' without applying them, and prints where they are.",
+			Run: func(args []string) error {
+				templates, err := kubeMakeTemplates()
+				if err != nil {
+					return err
+				}
+				logger.Info("The files can be found at: ")
+				fmt.Print(strings.Join(templates, "\n"))
+				return nil
+			}},
+		{Name: "lint", Group: "Kubernetes", Flags: []string{"keep-kubernetes-template-files"},
+			Description: "Templates the Kubernetes files and checks them against the Kubernetes schema and the lint policies (resources, probes, image tags and labels).",
+			Run:         func(args []string) error { return kubeLint() }},
+		{Name: "remove", Group: "Kubernetes", OneApp: true, Flags: []string{"force", "break-freeze", "keep-kubernetes-template-files"},
+			Description: "Deletes everything in the Kubernetes files (Deployments, Services, Secrets and Ingresses) from the cluster.",
+			Run:         func(args []string) error { return kubeRemove() }},
+
+		{Name: "help", Group: "Help", Arguments: "[command]", MaxArgs: 1, Standalone: true,
+			Description: "Shows the list of commands, or the help for one command.",
+			Run: func(args []string) error {
+				if len(args) == 0 {
+					showHelp(os.Stdout)
+					return nil
+				}
+				c := findCommand(args[0])
+				if c == nil {
+					return unknownCommand(args[0])
+				}
+				showCommandHelp(os.Stdout, c)
+				return nil
+			}},
+		{Name: "completion", Group: "Help", Arguments: "<bash|zsh|fish>", ArgValues: completionShells, MinArgs: 1, MaxArgs: 1, Standalone: true,
+			Description: "Prints a shell completion script, eg. 'source <(kube-deploy completion bash)'.",
+			Run:         func(args []string) error { return printCompletion(os.Stdout, args[0]) }},
+	}
+	findCommand("help").ArgValues = commandNames()
+}
+
+func findFlag(name string) *flagDefinition {
+	for i := range flagDefinitions {
+		if flagDefinitions[i].Name == name {
+			return &flagDefinitions[i]
+		}
+	}
+	return nil
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+		for _, alias := range c.Aliases {
+			if alias == name {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// Lists every command name, including the aliases
+func commandNames() []string {
+	var names []string
+	for _, c := range commands {
+		names = append(names, c.Name)
+		names = append(names, c.Aliases...)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The command's own flags, then the global ones
+func (c *command) flagNames() []string {
+	return append(append([]string{}, c.Flags...), globalFlags...)
+}
+
+func (c *command) usage() string {
+	usage := "kube-deploy " + c.Name
+	if c.Arguments != "" {
+		usage += " " + c.Arguments
+	}
+	return usage + " [flags]"
+}
+
+func (c *command) hasFlag(name string) bool {
+	for _, f := range c.Flags {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+func newFlagContext(names []string) flags.FlagContext {
+	context := flags.New()
+	for _, name := range names {
+		f := findFlag(name)
+		switch {
+		case f.IsBool:
+			context.NewBoolFlag(f.Name, f.Short, f.Usage)
+		case f.DefaultValue != "":
+			context.NewStringFlagWithDefault(f.Name, f.Short, f.Usage, f.DefaultValue)
+		default:
+			context.NewStringFlag(f.Name, f.Short, f.Usage)
+		}
+	}
+	return context
+}
+
+var args []string
+var runFlags flags.FlagContext
+
+// The value of a string flag, falling back to its environment variable
+func flagValue(name string) string {
+	if value := runFlags.String(name); value != "" {
+		return value
+	}
+	if f := findFlag(name); f.EnvVar != "" {
+		return os.Getenv(f.EnvVar)
+	}
+	return ""
+}
+
+// Finds the command to run, and parses only the flags it knows about
+func parseFlags() (*command, error) {
+	// The first pass knows every flag, just to find the command among them
+	var allFlags []string
+	for _, f := range flagDefinitions {
+		allFlags = append(allFlags, f.Name)
+	}
+	runFlags = newFlagContext(allFlags)
+	if err := runFlags.Parse(os.Args...); err != nil {
+		return nil, failure.Wrap(failure.Config, err, "Oh no, I don't know what to do with those command line flags. Sorry... Try 'kube-deploy help'")
+	}
+	args = runFlags.Args()
+
+	// args has to have at least length 2, since the first element is the executable name
+	if len(args) < 2 {
+		return findCommand("help"), nil
+	}
+	c := findCommand(args[1])
+	if c == nil {
+		return nil, unknownCommand(args[1])
+	}
+
+	// The second pass only knows the command's own flags, so anything else is a mistake
+	runFlags = newFlagContext(c.flagNames())
+	if err := runFlags.Parse(os.Args...); err != nil {
+		return nil, failure.Wrap(failure.Config, err, "Oh no, '%s' doesn't know what to do with those command line flags. Try 'kube-deploy help %s'", c.Name, c.Name)
+	}
+	args = runFlags.Args()
+	return c, nil
+}
+
+// Makes sure the command got the arguments it needs
+func checkArguments(c *command, commandArgs []string) error {
+	if len(commandArgs) < c.MinArgs || len(commandArgs) > c.MaxArgs {
+		return failure.New(failure.Config, "Uh oh - that's not how to use '%s'. It goes: %s", c.Name, c.usage())
+	}
+	return nil
+}
+
+func unknownCommand(name string) error {
+	return failure.New(failure.Config, "Uh oh - the command '%s' isn't recognised. Run 'kube-deploy help' to see the commands there are.", name)
+}
+
+func lockRollouts(scope string, reason string, message string) error {
+	if err := cli.WriteLockFile(scope, reason); err != nil {
+		return err
+	}
+	notify.Send(repoConfig, notify.Locked, message)
+	return nil
+}
+
+func unlockRollouts(scope string, message string) error {
+	if err := cli.DeleteLockFile(scope); err != nil {
+		return err
+	}
+	notify.Send(repoConfig, notify.Unlocked, message)
+	return nil
+}
+
+// The freeze window this command broke with '--break-freeze', if it did
+var brokenFreeze *cli.Freeze
+
+// Takes the lockfile before changing what's in the cluster, as long as the environment isn't frozen (or the freeze
+// is being broken on purpose)
+func lockBeforeRollout() error {
+	freeze, err := repoConfig.ActiveFreeze(time.Now())
+	if err != nil {
+		return failure.Wrap(failure.Config, err, "Uh oh, couldn't check the freeze windows")
+	}
+	breakFreeze := runFlags.String("break-freeze")
+	if err := cli.LockBeforeRollout(repoConfig.Application.Name, runFlags.Bool("force"), freeze, breakFreeze); err != nil {
+		return err
+	}
+	if freeze != nil {
+		brokenFreeze = freeze
+		notify.Send(repoConfig, notify.FreezeBroken, fmt.Sprintf("Broke the freeze '%s', because: %s", freeze.Name, breakFreeze))
+	}
+	return nil
+}
+
+func showHelp(w io.Writer) {
+	fmt.Fprint(w, "kube-deploy - an opinionated but friendly deployment tool for Kubernetes.\n\nUsage: kube-deploy <command> [arguments] [flags]\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, group := range commandGroups {
+		fmt.Fprintf(tw, "\n%s:\n", group)
+		for _, c := range commands {
+			if c.Group != group {
+				continue
+			}
+			name := c.Name
+			if len(c.Aliases) > 0 {
+				name += ", " + strings.Join(c.Aliases, ", ")
+			}
+			fmt.Fprintf(tw, "    %s\t%s\n", name, c.Description)
+		}
+	}
+	tw.Flush()
+	fmt.Fprint(w, "\nGlobal flags:\n")
+	showFlags(w, globalFlags)
+	fmt.Fprint(w, "\nRun 'kube-deploy help <command>' to see the flags and arguments of a command.\n")
+}
+
+func showCommandHelp(w io.Writer, c *command) {
+	fmt.Fprintf(w, "Usage: %s\n\n%s\n", c.usage(), c.Description)
+	if len(c.Aliases) > 0 {
+		fmt.Fprintf(w, "\nAliases: %s\n", strings.Join(c.Aliases, ", "))
+	}
+	if len(c.Flags) > 0 {
+		fmt.Fprint(w, "\nFlags:\n")
+		showFlags(w, c.Flags)
+	}
+	fmt.Fprint(w, "\nGlobal flags:\n")
+	showFlags(w, globalFlags)
+}
+
+func showFlags(w io.Writer, names []string) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range names {
+		f := findFlag(name)
+		flag := "--" + f.Name
+		if f.Short != "" {
+			flag = "-" + f.Short + ", " + flag
+		}
+		if !f.IsBool {
+			flag += " <value>"
+		}
+		usage := f.Usage
+		if f.DefaultValue != "" {
+			usage += fmt.Sprintf(" (default '%s')", f.DefaultValue)
+		}
+		if f.EnvVar != "" {
+			usage += fmt.Sprintf(" (or $%s)", f.EnvVar)
+		}
+		fmt.Fprintf(tw, "    %s\t%s\n", flag, usage)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mycujoo/kube-deploy/failure"
+)
+
+// The shells 'completion' can write a script for
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// Writes the completion script for the shell, generated from the commands and their flags
+func printCompletion(w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		printBashCompletion(w)
+	case "zsh":
+		printZshCompletion(w)
+	case "fish":
+		printFishCompletion(w)
+	default:
+		return failure.New(failure.Config, "Uh oh - I can't write completions for the shell '%s'. It should be one of: %s.", shell, strings.Join(completionShells, ", "))
+	}
+	return nil
+}
+
+// Every way of writing the flags, eg. '-o' and '--output'
+func flagSpellings(names []string) []string {
+	var spellings []string
+	for _, name := range names {
+		f := findFlag(name)
+		spellings = append(spellings, "--"+f.Name)
+		if f.Short != "" {
+			spellings = append(spellings, "-"+f.Short)
+		}
+	}
+	return spellings
+}
+
+func printBashCompletion(w io.Writer) {
+	fmt.Fprint(w, `# bash completion for kube-deploy - load it with: source <(kube-deploy completion bash)
+_kube_deploy() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local prev="${COMP_WORDS[COMP_CWORD-1]}"
+    if [ "$COMP_CWORD" -eq 1 ]; then
+        COMPREPLY=($(compgen -W "`+strings.Join(commandNames(), " ")+`" -- "$cur"))
+        return
+    fi
+
+    case "$prev" in
+`)
+	for _, f := range flagDefinitions {
+		if f.IsBool {
+			continue
+		}
+		// Flags without a list of values take a file name
+		compgen := "-f"
+		if len(f.Values) > 0 {
+			compgen = fmt.Sprintf("-W \"%s\"", strings.Join(f.Values, " "))
+		}
+		fmt.Fprintf(w, "        %s)\n            COMPREPLY=($(compgen %s -- \"$cur\"))\n            return\n            ;;\n", strings.Join(flagSpellings([]string{f.Name}), "|"), compgen)
+	}
+	fmt.Fprint(w, `    esac
+
+    local words=""
+    case "${COMP_WORDS[1]}" in
+`)
+	for _, c := range commands {
+		names := append([]string{c.Name}, c.Aliases...)
+		words := append(flagSpellings(c.flagNames()), c.ArgValues...)
+		fmt.Fprintf(w, "        %s)\n            words=\"%s\"\n            ;;\n", strings.Join(names, "|"), strings.Join(words, " "))
+	}
+	fmt.Fprint(w, `    esac
+    COMPREPLY=($(compgen -W "$words" -- "$cur"))
+}
+complete -F _kube_deploy kube-deploy
+`)
+}
+
+// Escapes text for a single-quoted zsh '_arguments' spec
+func zshQuote(s string) string {
+	s = strings.Replace(s, "'", `'\''`, -1)
+	s = strings.Replace(s, "[", `\[`, -1)
+	s = strings.Replace(s, "]", `\]`, -1)
+	return strings.Replace(s, ":", `\:`, -1)
+}
+
+func printZshCompletion(w io.Writer) {
+	fmt.Fprint(w, `#compdef kube-deploy
+# zsh completion for kube-deploy - load it with: source <(kube-deploy completion zsh)
+_kube_deploy() {
+    local -a commands
+    commands=(
+`)
+	for _, c := range commands {
+		for _, name := range append([]string{c.Name}, c.Aliases...) {
+			fmt.Fprintf(w, "        '%s:%s'\n", name, strings.Replace(c.Description, "'", `'\''`, -1))
+		}
+	}
+	fmt.Fprint(w, `    )
+    if (( CURRENT == 2 )); then
+        _describe 'command' commands
+        return
+    fi
+
+    shift words
+    (( CURRENT-- ))
+    case "${words[1]}" in
+`)
+	for _, c := range commands {
+		names := append([]string{c.Name}, c.Aliases...)
+		fmt.Fprintf(w, "        %s)\n            _arguments", strings.Join(names, "|"))
+		for _, name := range c.flagNames() {
+			f := findFlag(name)
+			spec := fmt.Sprintf("--%s[%s]", f.Name, zshQuote(f.Usage))
+			if len(f.Values) > 0 {
+				spec += fmt.Sprintf(":%s:(%s)", f.Name, strings.Join(f.Values, " "))
+			} else if !f.IsBool {
+				spec += fmt.Sprintf(":%s:_files", f.Name)
+			}
+			fmt.Fprintf(w, " \\\n                '%s'", spec)
+			if f.Short != "" {
+				fmt.Fprintf(w, " \\\n                '%s'", strings.Replace(spec, "--"+f.Name+"[", "-"+f.Short+"[", 1))
+			}
+		}
+		if c.Arguments != "" {
+			fmt.Fprintf(w, " \\\n                '1:%s:(%s)'", zshQuote(strings.Trim(c.Arguments, "<>[]")), strings.Join(c.ArgValues, " "))
+		}
+		fmt.Fprint(w, "\n            ;;\n")
+	}
+	fmt.Fprint(w, `    esac
+}
+compdef _kube_deploy kube-deploy
+`)
+}
+
+// Escapes text for a single-quoted fish string
+func fishQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
+
+func printFishCompletion(w io.Writer) {
+	fmt.Fprint(w, "# fish completion for kube-deploy - load it with: kube-deploy completion fish | source\ncomplete -c kube-deploy -f\n")
+	for _, c := range commands {
+		for _, name := range append([]string{c.Name}, c.Aliases...) {
+			fmt.Fprintf(w, "complete -c kube-deploy -n __fish_use_subcommand -a %s -d %s\n", name, fishQuote(c.Description))
+		}
+	}
+	for _, c := range commands {
+		condition := fishQuote("__fish_seen_subcommand_from " + strings.Join(append([]string{c.Name}, c.Aliases...), " "))
+		for _, name := range c.flagNames() {
+			f := findFlag(name)
+			line := fmt.Sprintf("complete -c kube-deploy -n %s -l %s", condition, f.Name)
+			if f.Short != "" {
+				line += " -s " + f.Short
+			}
+			if len(f.Values) > 0 {
+				line += " -x -a " + fishQuote(strings.Join(f.Values, " "))
+			} else if !f.IsBool {
+				line += " -r -F"
+			}
+			fmt.Fprintf(w, "%s -d %s\n", line, fishQuote(f.Usage))
+		}
+		if len(c.ArgValues) > 0 {
+			fmt.Fprintf(w, "complete -c kube-deploy -n %s -a %s\n", condition, fishQuote(strings.Join(c.ArgValues, " ")))
+		}
+	}
+}
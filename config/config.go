@@ -1,48 +1,117 @@
 package config
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 
+	"github.com/distribution/reference"
 	"gopkg.in/yaml.v2"
 	"k8s.io/client-go/kubernetes"
 
 	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/failure"
 	"github.com/mycujoo/kube-deploy/kube/api"
 )
 
 // RepoConfigMap : hash of the YAML data from project's deploy.yaml
 type RepoConfigMap struct {
+	APIVersion       string `yaml:"apiVersion"` // The version the deploy.yaml is written in - it's converted to the current one as it's read
+	Extends          string `yaml:"extends"`    // A shared deploy.yaml this one is merged over - it's resolved as it's read
 	DockerRepository struct {
 		DevelopmentRepositoryName string `yaml:"developmentRepositoryName"`
 		ProductionRepositoryName  string `yaml:"productionRepositoryName"`
 		RegistryRoot              string `yaml:"registryRoot"`
 	} `yaml:"dockerRepository"`
-	Application struct {
-		PackageJSON           bool   `yaml:"packageJSON"`
-		Name                  string `yaml:"name"`
-		Version               string `yaml:"version"`
-		PathToKubernetesFiles string `yaml:"pathToKubernetesFiles"`
-		KubernetesTemplate    struct {
-			GlobalVariables []string            `yaml:"globalVariables"`
-			BranchVariables map[string][]string `yaml:"branchVariables"`
-		} `yaml:"kubernetesTemplate"`
-	} `yaml:"application"`
-	DockerRepositoryName string
-	ClusterName          string // 'production' or 'development' - 'staging' should use the production cluster
-	Namespace            string
-	GitBranch            string
-	GitSHA               string
-	ImageTag             string
-	ImageFullPath        string `yaml:"imageFullPath"`
-	PWD                  string
-	ReleaseName          string
-	KubeAPIClientSet     *kubernetes.Clientset
-	Tests                []testConfigMap `yaml:"tests"`
+	Application          applicationConfigMap   `yaml:"application"`
+	Applications         []applicationConfigMap `yaml:"applications"` // For monorepos - the one being worked on is copied into Application
+	DockerRepositoryName string                 `yaml:"-"`
+	ClusterName          string                 `yaml:"cluster"` // 'production' or 'development' - 'staging' should use the production cluster
+	Namespace            string                 `yaml:"namespace"`
+	GitBranch            string                 `yaml:"-"`
+	GitSHA               string                 `yaml:"-"`
+	SourceRepoURL        string                 `yaml:"-"`
+	ConfigHash           string                 `yaml:"-"` // sha256 of the deploy.yaml, so it's clear which config a release was made with
+	ImageTag             string                 `yaml:"-"`
+	ImageFullPath        string                 `yaml:"imageFullPath"`
+	PWD                  string                 `yaml:"-"`
+	ReleaseName          string                 `yaml:"-"`
+	KubeAPIClientSet     *kubernetes.Clientset  `json:"-" yaml:"-"`
+	Tests                []testConfigMap        `yaml:"tests"`
+	SmokeTests           []smokeTestConfigMap   `yaml:"smokeTests"`
+	Rollout              struct {
+		ScaleDownStep           int32  `yaml:"scaleDownStep"`
+		MinAvailablePercent     int    `yaml:"minAvailablePercent"`
+		ScaleDownTimeoutSeconds int    `yaml:"scaleDownTimeoutSeconds"`
+		ApprovalMode            string `yaml:"approvalMode"`
+		Approval                struct {
+			ListenAddress  string   `yaml:"listenAddress"`
+			PublicURL      string   `yaml:"publicURL"`
+			WebhookURL     string   `yaml:"webhookURL"`
+			Approvers      []string `yaml:"approvers"`
+			TimeoutSeconds int      `yaml:"timeoutSeconds"` // How long to wait for a decision before bailing out - an hour by default
+		} `yaml:"approval"`
+	} `yaml:"rollout"`
+	Lint struct {
+		SkipSchema bool              `yaml:"skipSchema"`
+		Policies   map[string]string `yaml:"policies"` // Policy name to 'error' (the default), 'warning' or 'off'
+	} `yaml:"lint"`
+	Policy struct {
+		Paths []string `yaml:"paths"` // Rego files, or directories of them, relative to the app directory
+	} `yaml:"policy"`
+	Freezes          []freezeConfigMap       `yaml:"freezes"`
+	Notifications    []notificationConfigMap `yaml:"notifications"`
+	DeploymentStatus struct {
+		Provider       string `yaml:"provider"`
+		APIURL         string `yaml:"apiURL"`
+		Repository     string `yaml:"repository"`
+		TokenEnvVar    string `yaml:"tokenEnvVar"`
+		EnvironmentURL string `yaml:"environmentURL"`
+	} `yaml:"deploymentStatus"`
+	Hooks struct {
+		PreRollout  []hookConfigMap `yaml:"preRollout"`
+		PostRollout []hookConfigMap `yaml:"postRollout"`
+	} `yaml:"hooks"`
+}
+
+// applicationConfigMap : layout of an application, with its own image, Kubernetes files and tests
+type applicationConfigMap struct {
+	PackageJSON           bool   `yaml:"packageJSON"`
+	Name                  string `yaml:"name"`
+	Version               string `yaml:"version"`
+	BuildContext          string `yaml:"buildContext"` // The directory the image is built from, relative to the app directory
+	Dockerfile            string `yaml:"dockerfile"`   // Relative to the app directory - Docker's default is 'Dockerfile' in the build context
+	PathToKubernetesFiles string `yaml:"pathToKubernetesFiles"`
+	KubernetesTemplate    struct {
+		GlobalVariables []string                  `yaml:"globalVariables"`
+		BranchVariables map[string][]string       `yaml:"branchVariables"`
+		VariableSources []variableSourceConfigMap `yaml:"variableSources"` // Read before the inline variables, which take precedence
+	} `yaml:"kubernetesTemplate"`
+	Tests      []testConfigMap      `yaml:"tests"`
+	SmokeTests []smokeTestConfigMap `yaml:"smokeTests"`
+}
+
+// Paths lists the files and directories which go into the application's image and Kubernetes objects
+func (a applicationConfigMap) Paths() []string {
+	paths := []string{a.BuildContext, a.PathToKubernetesFiles}
+	if a.Dockerfile != "" {
+		paths = append(paths, a.Dockerfile)
+	}
+	return paths
+}
+
+// variableSourceConfigMap : a file or command that template variables are read from
+type variableSourceConfigMap struct {
+	File     string `yaml:"file"` // '{environment}' is replaced with the environment, for per-environment files
+	Command  string `yaml:"command"`
+	Format   string `yaml:"format"`   // 'env', 'yaml' or 'json' - from a file's extension by default, or 'env' for a command
+	Optional bool   `yaml:"optional"` // Skip the file if it doesn't exist
 }
 
 // testConfigMap : layout of the details for running a single test step (during build)
@@ -54,61 +123,158 @@ type testConfigMap struct {
 	Commands      []string `yaml:"commands"`
 }
 
-func InitRepoConfig(configFilePath string) RepoConfigMap {
+// smokeTestConfigMap : layout of a check which is run inside the cluster against the new release at each canary point
+type smokeTestConfigMap struct {
+	Name           string `yaml:"name"`
+	Type           string `yaml:"type"`
+	Port           int    `yaml:"port"`
+	Path           string `yaml:"path"`
+	ExpectBody     string `yaml:"expectBody"`
+	Template       string `yaml:"template"`
+	TimeoutSeconds int    `yaml:"timeoutSeconds"`
+}
 
-	configFile, err := ioutil.ReadFile(configFilePath)
+// notificationConfigMap : layout of a sink which is sent rollout lifecycle events (eg. a Slack incoming webhook)
+type notificationConfigMap struct {
+	Type         string   `yaml:"type"`
+	URL          string   `yaml:"url"`
+	Template     string   `yaml:"template"`
+	Environments []string `yaml:"environments"`
+	Events       []string `yaml:"events"`
+}
+
+// hookConfigMap : layout of a Kubernetes Job which is run before or after the rollout (eg. database migrations)
+type hookConfigMap struct {
+	Name           string `yaml:"name"`
+	Template       string `yaml:"template"`
+	TimeoutSeconds int    `yaml:"timeoutSeconds"`
+}
+
+// freezeConfigMap : layout of a window when rollouts are frozen - between two dates, or on a cron-like schedule
+type freezeConfigMap struct {
+	Name         string   `yaml:"name"`
+	Reason       string   `yaml:"reason"`
+	Environments []string `yaml:"environments"` // Every environment, if it's empty
+	From         string   `yaml:"from"`         // Like '2006-01-02', '2006-01-02 15:04' or RFC 3339
+	Until        string   `yaml:"until"`        // A date on its own means until the end of that day
+	Schedule     string   `yaml:"schedule"`     // When each window starts: 'minute hour day-of-month month day-of-week'
+	Duration     string   `yaml:"duration"`     // How long each scheduled window lasts, like '64h'
+	Timezone     string   `yaml:"timezone"`     // Like 'Europe/Amsterdam' - the local one by default
+}
+
+// Overrides : settings which take priority over the deploy.yaml (and what kube-deploy would work out for itself)
+type Overrides struct {
+	Application string // Which of the Applications to use, for monorepos
+	Namespace   string
+	ClusterName string
+	ImageTag    string
+}
+
+// Swaps the tag of an image path for another one
+func retagImage(imageFullPath string, tag string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageFullPath)
+	if err != nil {
+		return "", err
+	}
+	if _, digested := named.(reference.Digested); digested {
+		return "", fmt.Errorf("'%s' is pinned to a digest, which a tag can't change", imageFullPath)
+	}
+	tagged, err := reference.WithTag(reference.TrimNamed(named), tag)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Failed reading repo config file:", err)
-		os.Exit(1)
+		return "", err
 	}
+	return reference.FamiliarString(tagged), nil
+}
+
+func InitRepoConfig(configFilePath string, overrides Overrides) (RepoConfigMap, error) {
 
 	repoConfig := RepoConfigMap{}
-	err = yaml.Unmarshal(configFile, &repoConfig)
+	configFile, fileVersion, err := loadConfigFile(configFilePath)
+	if err != nil {
+		return repoConfig, err
+	}
+	err = yaml.UnmarshalStrict(configFile, &repoConfig)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Failed parsing YAML repo config file:", err)
-		os.Exit(1)
+		return repoConfig, failure.Wrap(failure.Config, err, "Failed parsing YAML repo config file (run 'kube-deploy validate' for the details)")
+	}
+	repoConfig.APIVersion = fileVersion
+
+	if err := chooseApplication(&repoConfig, overrides.Application); err != nil {
+		return repoConfig, err
+	}
+	if repoConfig.Application.BuildContext == "" {
+		repoConfig.Application.BuildContext = "."
+	}
+
+	if overrides.Namespace != "" {
+		repoConfig.Namespace = overrides.Namespace
+	}
+	if overrides.ClusterName != "" {
+		repoConfig.ClusterName = overrides.ClusterName
 	}
 
 	repoConfig.GitBranch = strings.TrimSuffix(cli.GetCommandOutput("git", "rev-parse --abbrev-ref HEAD"), "\n")
 	invalidDockertagCharRegex := regexp.MustCompile(`([^a-z|A-Z|0-9|\-|_|\.])`)
 	repoConfig.GitBranch = invalidDockertagCharRegex.ReplaceAllString(repoConfig.GitBranch, "-")
 	repoConfig.GitSHA = strings.TrimSuffix(cli.GetCommandOutput("git", "rev-parse --verify --short HEAD"), "\n")
+	if cli.GetCommandExitCode("git", "config --get remote.origin.url") == 0 {
+		repoConfig.SourceRepoURL = strings.TrimSuffix(cli.GetCommandOutput("git", "config --get remote.origin.url"), "\n")
+		// Don't leak any credentials embedded in the remote URL
+		if remoteURL, err := url.Parse(repoConfig.SourceRepoURL); err == nil && remoteURL.User != nil {
+			remoteURL.User = nil
+			repoConfig.SourceRepoURL = remoteURL.String()
+		}
+	}
+	repoConfig.ConfigHash = fmt.Sprintf("%x", sha256.Sum256(configFile))
 
 	if repoConfig.Application.PackageJSON {
-		repoConfig.Application.Name, repoConfig.Application.Version = readFromPackageJSON()
+		if repoConfig.Application.Name, repoConfig.Application.Version, err = readFromPackageJSON(repoConfig.Application.BuildContext); err != nil {
+			return repoConfig, err
+		}
 	}
 
 	switch branch := repoConfig.GitBranch; branch {
 	case "production":
 		repoConfig.DockerRepositoryName = repoConfig.DockerRepository.ProductionRepositoryName
-		repoConfig.ClusterName = "production"
+		if repoConfig.ClusterName == "" {
+			repoConfig.ClusterName = "production"
+		}
 		if repoConfig.Namespace == "" {
 			repoConfig.Namespace = "production"
 		}
 	case "master":
 		repoConfig.DockerRepositoryName = repoConfig.DockerRepository.ProductionRepositoryName
-		repoConfig.ClusterName = "production" // deploy to production cluster
+		if repoConfig.ClusterName == "" {
+			repoConfig.ClusterName = "production" // deploy to production cluster
+		}
 		if repoConfig.Namespace == "" {
 			repoConfig.Namespace = "staging"
 		}
 	case "acceptance":
 		repoConfig.DockerRepositoryName = repoConfig.DockerRepository.ProductionRepositoryName
-		repoConfig.ClusterName = "production"
+		if repoConfig.ClusterName == "" {
+			repoConfig.ClusterName = "production"
+		}
 		if repoConfig.Namespace == "" {
 			repoConfig.Namespace = "acceptance"
 		}
 	default:
 		repoConfig.DockerRepositoryName = repoConfig.DockerRepository.DevelopmentRepositoryName
-		repoConfig.ClusterName = "development"
+		if repoConfig.ClusterName == "" {
+			repoConfig.ClusterName = "development"
+		}
 		if repoConfig.Namespace == "" {
 			repoConfig.Namespace = "development"
 		}
 	}
 
-	repoConfig.ImageTag = fmt.Sprintf("%s-%s-%s",
-		repoConfig.Application.Version,
-		fmt.Sprintf("%.25s", repoConfig.GitBranch),
-		repoConfig.GitSHA)
+	repoConfig.ImageTag = overrides.ImageTag
+	if repoConfig.ImageTag == "" {
+		repoConfig.ImageTag = fmt.Sprintf("%s-%s-%s",
+			repoConfig.Application.Version,
+			fmt.Sprintf("%.25s", repoConfig.GitBranch),
+			repoConfig.GitSHA)
+	}
 
 	if repoConfig.ImageFullPath == "" { // if the path was not already provided in the deploy.yaml
 		if repoConfig.DockerRepository.RegistryRoot != "" {
@@ -116,33 +282,90 @@ func InitRepoConfig(configFilePath string) RepoConfigMap {
 		} else { // For DockerHub images, no RegistryRoot is needed
 			repoConfig.ImageFullPath = fmt.Sprintf("%s/%s:%s", repoConfig.DockerRepositoryName, repoConfig.Application.Name, repoConfig.ImageTag)
 		}
+	} else if overrides.ImageTag != "" {
+		// The tag asked for replaces whatever tag the deploy.yaml's image path has
+		if repoConfig.ImageFullPath, err = retagImage(repoConfig.ImageFullPath, overrides.ImageTag); err != nil {
+			return repoConfig, failure.Wrap(failure.Config, err, "Uh oh, I can't use the image tag '%s' with the imageFullPath in the deploy.yaml", overrides.ImageTag)
+		}
+	}
+	// Better to find a broken image name now than when the engine is asked for it
+	if _, err := reference.ParseNormalizedNamed(repoConfig.ImageFullPath); err != nil {
+		return repoConfig, failure.Wrap(failure.Config, err, "Uh oh, the image name '%s' isn't valid - check the imageFullPath, dockerRepository and application name in the deploy.yaml", repoConfig.ImageFullPath)
 	}
 
 	repoConfig.ReleaseName = fmt.Sprintf("%.25s-%s", repoConfig.Application.Name, repoConfig.ImageTag)
 	repoConfig.PWD, err = os.Getwd()
 
-	repoConfig.KubeAPIClientSet = kubeapi.Setup(repoConfig.Namespace)
+	if repoConfig.KubeAPIClientSet, err = kubeapi.Setup(repoConfig.Namespace); err != nil {
+		return repoConfig, failure.Wrap(failure.Config, err, "Couldn't set up the Kubernetes client")
+	}
 
-	return repoConfig
+	return repoConfig, nil
+}
+
+// ApplicationNames lists the applications in a monorepo's deploy.yaml - or nothing, when it only has the one application
+func ApplicationNames(configFilePath string) ([]string, error) {
+	repoConfig := RepoConfigMap{}
+	configFile, _, err := loadConfigFile(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(configFile, &repoConfig); err != nil {
+		return nil, failure.Wrap(failure.Config, err, "Failed parsing YAML repo config file (run 'kube-deploy validate' for the details)")
+	}
+
+	var names []string
+	for _, a := range repoConfig.Applications {
+		names = append(names, a.Name)
+	}
+	return names, nil
+}
+
+// Copies the chosen one of the Applications into Application, along with its tests
+func chooseApplication(repoConfig *RepoConfigMap, name string) error {
+	if len(repoConfig.Applications) == 0 {
+		if name != "" && name != repoConfig.Application.Name {
+			return failure.New(failure.Config, "There's no application called '%s' in the deploy.yaml", name)
+		}
+		return nil
+	}
+	if repoConfig.Application.Name != "" {
+		return failure.New(failure.Config, "The deploy.yaml can have 'application' or 'applications', but not both")
+	}
+
+	var names []string
+	for _, a := range repoConfig.Applications {
+		if a.Name != name {
+			names = append(names, a.Name)
+			continue
+		}
+		repoConfig.Application = a
+		if len(a.Tests) > 0 {
+			repoConfig.Tests = a.Tests
+		}
+		if len(a.SmokeTests) > 0 {
+			repoConfig.SmokeTests = a.SmokeTests
+		}
+		return nil
+	}
+	return failure.New(failure.Config, "There's no application called '%s' in the deploy.yaml - it has: %s", name, strings.Join(names, ", "))
 }
 
-func readFromPackageJSON() (string, string) {
+func readFromPackageJSON(buildContext string) (string, string, error) {
 
 	type packageJSONTemplate struct {
 		Name    string `json:"name"`
 		Version string `json:"version"`
 	}
 
-	packageJSONFile, err := ioutil.ReadFile("package.json")
+	packageJSONFile, err := ioutil.ReadFile(filepath.Join(buildContext, "package.json"))
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "=> Config specifies to read from package.json, but reading a package.json file failed: ", err)
-		os.Exit(1)
+		return "", "", failure.Wrap(failure.Config, err, "Config specifies to read from package.json, but reading a package.json file failed")
 	}
 	packageJSONConfig := packageJSONTemplate{}
 	err = json.Unmarshal(packageJSONFile, &packageJSONConfig)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "=> Config specifies to read from package.json, but parsing the package.json file failed: ", err)
-		os.Exit(1)
+		return "", "", failure.Wrap(failure.Config, err, "Config specifies to read from package.json, but parsing the package.json file failed")
 	}
-	return packageJSONConfig.Name, packageJSONConfig.Version
+	return packageJSONConfig.Name, packageJSONConfig.Version, nil
 }
@@ -0,0 +1,31 @@
+package config
+
+import "testing"
+
+func TestRetagImage(t *testing.T) {
+	tests := []struct {
+		imageFullPath string
+		tag           string
+		want          string
+		wantErr       bool
+	}{
+		{"eu.gcr.io/company/api:master-a1b2c3d", "1.4.0", "eu.gcr.io/company/api:1.4.0", false},
+		{"eu.gcr.io/company/api", "1.4.0", "eu.gcr.io/company/api:1.4.0", false},
+		{"registry.example.com:5000/team/api:latest", "hotfix", "registry.example.com:5000/team/api:hotfix", false},
+		{"company/api:old", "new", "company/api:new", false},
+		{"api:old", "new", "api:new", false},
+		{"eu.gcr.io/company/api@sha256:0123456789012345678901234567890123456789012345678901234567890123", "1.4.0", "", true},
+		{"eu.gcr.io/company/api:old", "not a tag", "", true},
+		{"Not/An/Image", "1.4.0", "", true},
+	}
+	for _, test := range tests {
+		got, err := retagImage(test.imageFullPath, test.tag)
+		if (err != nil) != test.wantErr {
+			t.Errorf("retagImage(%q, %q) error = %v, want an error: %v", test.imageFullPath, test.tag, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("retagImage(%q, %q) = %q, want %q", test.imageFullPath, test.tag, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	yamlnodes "gopkg.in/yaml.v3"
+
+	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/logger"
+)
+
+// How long shared files fetched for 'extends' are cached before they're fetched again
+const extendsCacheTTL = 15 * time.Minute
+
+// Git sources look like 'git::https://github.com/org/repo.git//path/to/defaults.yaml?ref=v1'
+const gitSourcePrefix = "git::"
+
+// loadConfigFile reads a deploy.yaml, converts it to the current APIVersion, and merges in anything it extends.
+// It also returns the version the file is written in.
+func loadConfigFile(configFilePath string) ([]byte, string, error) {
+	configFile, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		return nil, "", failure.Wrap(failure.Config, err, "Failed reading repo config file")
+	}
+	convertedConfigFile, fileVersion, err := convertConfig(configFile)
+	if err != nil {
+		return nil, fileVersion, failure.Wrap(failure.Config, err, "Couldn't read %s", configFilePath)
+	}
+	resolvedConfigFile, err := resolveExtends(convertedConfigFile, configFilePath, nil)
+	if err != nil {
+		return nil, fileVersion, failure.Wrap(failure.Config, err, "Couldn't read what %s extends", configFilePath)
+	}
+	return resolvedConfigFile, fileVersion, nil
+}
+
+// Merges a (converted) config file over the file it extends, and that over the file it extends, and so on.
+// location is where the config file came from, so relative sources can be found.
+func resolveExtends(configFile []byte, location string, seen []string) ([]byte, error) {
+	var root yamlnodes.Node
+	if err := yamlnodes.Unmarshal(configFile, &root); err != nil {
+		return nil, err
+	}
+	document := documentMapping(&root)
+	if document == nil {
+		return configFile, nil
+	}
+	_, extendsNode := mappingEntry(document, "extends")
+	if extendsNode == nil {
+		return configFile, nil
+	}
+	if extendsNode.Kind != yamlnodes.ScalarNode || extendsNode.Value == "" {
+		return nil, fmt.Errorf("line %d: 'extends' should be the path or URL of a single file", extendsNode.Line)
+	}
+	removeMappingEntry(document, "extends")
+
+	source := resolveSource(extendsNode.Value, location)
+	seen = append(seen, location)
+	if contains(seen, source) {
+		return nil, fmt.Errorf("'%s' ends up extending itself", source)
+	}
+
+	baseFile, baseLocation, err := fetchSource(source)
+	if err != nil {
+		return nil, err
+	}
+	if baseLocation != source && contains(seen, baseLocation) {
+		return nil, fmt.Errorf("'%s' ends up extending itself", source)
+	}
+	baseFile, _, err = convertConfig(baseFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", source, err)
+	}
+	baseFile, err = resolveExtends(baseFile, baseLocation, seen)
+	if err != nil {
+		return nil, err
+	}
+	var baseRoot yamlnodes.Node
+	if err := yamlnodes.Unmarshal(baseFile, &baseRoot); err != nil {
+		return nil, fmt.Errorf("%s: %s", source, err)
+	}
+	baseDocument := documentMapping(&baseRoot)
+	if baseDocument == nil {
+		return nil, fmt.Errorf("%s isn't a deploy.yaml", source)
+	}
+
+	root.Content[0] = mergeNodes(baseDocument, document, "")
+	var merged bytes.Buffer
+	encoder := yamlnodes.NewEncoder(&merged)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&root); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return merged.Bytes(), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// A relative source is relative to the file which extends it
+func resolveSource(source string, location string) string {
+	if strings.HasPrefix(source, gitSourcePrefix) || isURL(source) || filepath.IsAbs(source) {
+		return source
+	}
+	if isURL(location) {
+		base, err := url.Parse(location)
+		if err == nil {
+			if relative, err := url.Parse(source); err == nil {
+				return base.ResolveReference(relative).String()
+			}
+		}
+	}
+	return filepath.Join(filepath.Dir(location), source)
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://")
+}
+
+// Reads a local file, or fetches a remote one (using the cache while it's fresh). Also returns where the file
+// can be found, for anything it extends in turn - for git sources, that's inside the cached clone.
+func fetchSource(source string) ([]byte, string, error) {
+	switch {
+	case strings.HasPrefix(source, gitSourcePrefix):
+		return fetchGitSource(source)
+	case isURL(source):
+		file, err := fetchHTTPSource(source)
+		return file, source, err
+	default:
+		file, err := ioutil.ReadFile(source)
+		return file, source, err
+	}
+}
+
+// Where the fetched files are cached - in the user's own cache directory (like ~/.cache), only they can read and write
+// it, since what's in there is merged into the deploy.yaml
+func extendsCacheDir() (string, error) {
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	cacheDir := filepath.Join(userCacheDir, "kube-deploy", "extends")
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return "", err
+	}
+	return cacheDir, os.Chmod(cacheDir, 0700)
+}
+
+// The cache path for a source, named by its hash
+func extendsCacheFile(cacheDir string, source string) string {
+	return filepath.Join(cacheDir, fmt.Sprintf("%x", sha256.Sum256([]byte(source))))
+}
+
+func isFresh(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && time.Since(info.ModTime()) < extendsCacheTTL
+}
+
+func fetchHTTPSource(source string) ([]byte, error) {
+	cacheDir, err := extendsCacheDir()
+	if err != nil {
+		logger.Debug("=> Couldn't cache %s: %s", source, err)
+		return fetchHTTP(source)
+	}
+	cacheFile := extendsCacheFile(cacheDir, source) + ".yaml"
+	if isFresh(cacheFile) {
+		return ioutil.ReadFile(cacheFile)
+	}
+
+	file, err := fetchHTTP(source)
+	if err != nil {
+		return useStaleCache(source, cacheFile, err)
+	}
+	if err := ioutil.WriteFile(cacheFile, file, 0600); err != nil {
+		logger.Debug("=> Couldn't cache %s: %s", source, err)
+	}
+	return file, nil
+}
+
+func fetchHTTP(source string) ([]byte, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s returned %s", source, response.Status)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// Clones the repository (shallowly) into the cache, and reads the file from the clone
+func fetchGitSource(source string) ([]byte, string, error) {
+	repository := strings.TrimPrefix(source, gitSourcePrefix)
+	ref := ""
+	if i := strings.LastIndex(repository, "?ref="); i >= 0 {
+		repository, ref = repository[:i], repository[i+len("?ref="):]
+	}
+	// The path in the repository comes after a '//' which isn't part of the scheme
+	schemeEnd := 0
+	if i := strings.Index(repository, "://"); i >= 0 {
+		schemeEnd = i + len("://")
+	}
+	i := strings.Index(repository[schemeEnd:], "//")
+	if i < 0 {
+		return nil, "", fmt.Errorf("'%s' should look like 'git::<repository>//<path to file>?ref=<branch or tag>'", source)
+	}
+	repository, path := repository[:schemeEnd+i], repository[schemeEnd+i+2:]
+
+	cacheDir, err := extendsCacheDir()
+	if err != nil {
+		return nil, "", fmt.Errorf("there's nowhere to clone %s into: %s", repository, err)
+	}
+	cloneDir := extendsCacheFile(cacheDir, gitSourcePrefix+repository+"?ref="+ref)
+	cachedFile := filepath.Join(cloneDir, path)
+	if !isFresh(cloneDir) {
+		fetchDir := cloneDir + ".fetching"
+		os.RemoveAll(fetchDir)
+		args := "clone --quiet --depth 1"
+		if ref != "" {
+			args += " --branch " + ref
+		}
+		output, exitCode := cli.GetCommandOutputAndExitCode("git", fmt.Sprintf("%s %s %s", args, repository, fetchDir))
+		if exitCode != 0 {
+			os.RemoveAll(fetchDir)
+			file, err := useStaleCache(source, cachedFile, fmt.Errorf("cloning %s failed: %s", repository, strings.TrimSpace(output)))
+			return file, cachedFile, err
+		}
+		os.RemoveAll(cloneDir)
+		if err := os.Rename(fetchDir, cloneDir); err != nil {
+			return nil, "", err
+		}
+		// Start the clock from the fetch, rather than the last commit
+		now := time.Now()
+		os.Chtimes(cloneDir, now, now)
+	}
+
+	file, err := ioutil.ReadFile(cachedFile)
+	if err != nil {
+		return nil, "", fmt.Errorf("there's no '%s' in %s", path, repository)
+	}
+	return file, cachedFile, nil
+}
+
+// Falls back to an out-of-date copy of a remote file, if there is one, when it can't be fetched again
+func useStaleCache(source string, cacheFile string, fetchErr error) ([]byte, error) {
+	file, err := ioutil.ReadFile(cacheFile)
+	if err != nil {
+		return nil, fetchErr
+	}
+	logger.Warn("=> Couldn't fetch %s (%s), so I'm using the copy I fetched earlier.", source, fetchErr)
+	return file, nil
+}
+
+// Deep-merges override over base: mappings are merged key by key, lists of named things (like tests and hooks) are
+// merged by name, template variables are merged by variable name, and anything else in override replaces what's in base
+func mergeNodes(base *yamlnodes.Node, override *yamlnodes.Node, path string) *yamlnodes.Node {
+	switch {
+	case base.Kind == yamlnodes.MappingNode && override.Kind == yamlnodes.MappingNode:
+		merged := *base
+		merged.Content = append([]*yamlnodes.Node{}, base.Content...)
+		for i := 0; i+1 < len(override.Content); i += 2 {
+			key, value := override.Content[i], override.Content[i+1]
+			childPath := strings.TrimPrefix(path+"."+key.Value, ".")
+			if j := mappingIndex(&merged, key.Value); j >= 0 {
+				merged.Content[j+1] = mergeNodes(merged.Content[j+1], value, childPath)
+			} else {
+				merged.Content = append(merged.Content, key, value)
+			}
+		}
+		return &merged
+	case base.Kind == yamlnodes.SequenceNode && override.Kind == yamlnodes.SequenceNode:
+		isVariables := strings.HasSuffix(path, "globalVariables") || strings.Contains(path, "branchVariables.")
+		itemKey := func(item *yamlnodes.Node) string {
+			if item.Kind == yamlnodes.MappingNode {
+				if _, name := mappingEntry(item, "name"); name != nil && name.Kind == yamlnodes.ScalarNode {
+					return name.Value
+				}
+			}
+			if isVariables && item.Kind == yamlnodes.ScalarNode {
+				if name, _, err := ParseVariable(item.Value); err == nil {
+					return name
+				}
+			}
+			return ""
+		}
+		// An empty list clears what's in base
+		if len(override.Content) == 0 || itemKey(override.Content[0]) == "" {
+			return override
+		}
+
+		merged := *base
+		merged.Content = append([]*yamlnodes.Node{}, base.Content...)
+		for _, item := range override.Content {
+			found := false
+			if key := itemKey(item); key != "" {
+				for j, baseItem := range merged.Content {
+					if itemKey(baseItem) == key {
+						merged.Content[j] = mergeNodes(baseItem, item, path)
+						found = true
+						break
+					}
+				}
+			}
+			if !found {
+				merged.Content = append(merged.Content, item)
+			}
+		}
+		return &merged
+	default:
+		return override
+	}
+}
+
+// The index of a key in a mapping's content, or -1
+func mappingIndex(mapping *yamlnodes.Node, key string) int {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func removeMappingEntry(mapping *yamlnodes.Node, key string) {
+	if i := mappingIndex(mapping, key); i >= 0 {
+		mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+	}
+}
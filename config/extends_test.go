@@ -0,0 +1,229 @@
+package config
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	yamlnodes "gopkg.in/yaml.v3"
+)
+
+func TestMergeNodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     string
+		override string
+		want     string
+	}{
+		{
+			name:     "mappings merge key by key",
+			base:     "application:\n  name: api\n  replicas: 2\n",
+			override: "application:\n  replicas: 3\n  pathToKubernetesFiles: kubernetes\n",
+			want:     "application:\n  name: api\n  replicas: 3\n  pathToKubernetesFiles: kubernetes\n",
+		},
+		{
+			name:     "scalars replace",
+			base:     "namespace: staging\n",
+			override: "namespace: production\n",
+			want:     "namespace: production\n",
+		},
+		{
+			name:     "a scalar replaces a mapping",
+			base:     "rollout:\n  canary: true\n",
+			override: "rollout: null\n",
+			want:     "rollout: null\n",
+		},
+		{
+			name:     "named lists merge by name",
+			base:     "tests:\n- name: unit\n  command: make test\n- name: lint\n  command: make lint\n",
+			override: "tests:\n- name: lint\n  command: golangci-lint run\n- name: e2e\n  command: make e2e\n",
+			want:     "tests:\n- name: unit\n  command: make test\n- name: lint\n  command: golangci-lint run\n- name: e2e\n  command: make e2e\n",
+		},
+		{
+			name:     "named list items merge deeply",
+			base:     "hooks:\n  preRollout:\n  - name: migrate\n    template: migrate.yaml\n    timeoutSeconds: 60\n",
+			override: "hooks:\n  preRollout:\n  - name: migrate\n    timeoutSeconds: 600\n",
+			want:     "hooks:\n  preRollout:\n  - name: migrate\n    template: migrate.yaml\n    timeoutSeconds: 600\n",
+		},
+		{
+			name:     "global variables merge by variable name",
+			base:     "application:\n  kubernetesTemplate:\n    globalVariables:\n    - DOMAIN=example.com\n    - REPLICAS=2\n",
+			override: "application:\n  kubernetesTemplate:\n    globalVariables:\n    - REPLICAS=5\n    - DEBUG=false\n",
+			want:     "application:\n  kubernetesTemplate:\n    globalVariables:\n    - DOMAIN=example.com\n    - REPLICAS=5\n    - DEBUG=false\n",
+		},
+		{
+			name:     "branch variables merge by variable name",
+			base:     "application:\n  kubernetesTemplate:\n    branchVariables:\n      production:\n      - REPLICAS=5\n",
+			override: "application:\n  kubernetesTemplate:\n    branchVariables:\n      production:\n      - REPLICAS=10\n      dev:\n      - REPLICAS=1\n",
+			want:     "application:\n  kubernetesTemplate:\n    branchVariables:\n      production:\n      - REPLICAS=10\n      dev:\n      - REPLICAS=1\n",
+		},
+		{
+			name:     "other lists replace",
+			base:     "rollout:\n  approvers:\n  - alice\n  - bob\n",
+			override: "rollout:\n  approvers:\n  - carol\n",
+			want:     "rollout:\n  approvers:\n  - carol\n",
+		},
+		{
+			name:     "an empty list clears",
+			base:     "tests:\n- name: unit\n  command: make test\n",
+			override: "tests: []\n",
+			want:     "tests: []\n",
+		},
+	}
+	for _, test := range tests {
+		base, override := parseNode(t, test.base), parseNode(t, test.override)
+		merged := mergeNodes(base, override, "")
+
+		var got, want interface{}
+		if err := merged.Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if err := yamlnodes.Unmarshal([]byte(test.want), &want); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: merged into %v, want %v", test.name, got, want)
+		}
+		// Merging doesn't change what it merges
+		if !reflect.DeepEqual(base, parseNode(t, test.base)) {
+			t.Errorf("%s: merging changed the base", test.name)
+		}
+	}
+}
+
+func parseNode(t *testing.T, document string) *yamlnodes.Node {
+	t.Helper()
+	var root yamlnodes.Node
+	if err := yamlnodes.Unmarshal([]byte(document), &root); err != nil {
+		t.Fatal(err)
+	}
+	return documentMapping(&root)
+}
+
+func TestResolveExtends(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("apiVersion: "+APIVersion+"\n"+content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("org.yaml", "namespace: staging\napplication:\n  replicas: 2\n")
+	write("team.yaml", "extends: org.yaml\napplication:\n  name: team-default\n")
+	write("loop-a.yaml", "extends: loop-b.yaml\n")
+	write("loop-b.yaml", "extends: loop-a.yaml\n")
+
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]interface{}
+		wantErr string
+	}{
+		{
+			name:    "nothing to extend",
+			content: "namespace: production\n",
+			want:    map[string]interface{}{"namespace": "production"},
+		},
+		{
+			name:    "a chain of relative files",
+			content: "extends: team.yaml\napplication:\n  name: api\n",
+			want:    map[string]interface{}{"namespace": "staging", "application": map[string]interface{}{"name": "api", "replicas": 2}},
+		},
+		{
+			name:    "an absolute path",
+			content: "extends: " + filepath.Join(dir, "org.yaml") + "\nnamespace: production\n",
+			want:    map[string]interface{}{"namespace": "production", "application": map[string]interface{}{"replicas": 2}},
+		},
+		{
+			name:    "extending itself",
+			content: "extends: deploy.yaml\n",
+			wantErr: "ends up extending itself",
+		},
+		{
+			name:    "a loop",
+			content: "extends: loop-a.yaml\n",
+			wantErr: "ends up extending itself",
+		},
+		{
+			name:    "a list",
+			content: "extends:\n- org.yaml\n",
+			wantErr: "should be the path or URL of a single file",
+		},
+		{
+			name:    "a missing file",
+			content: "extends: missing.yaml\n",
+			wantErr: "missing.yaml",
+		},
+	}
+	for _, test := range tests {
+		path := write("deploy.yaml", test.content)
+		configFile, _ := ioutil.ReadFile(path)
+
+		resolved, err := resolveExtends(configFile, path, nil)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: resolveExtends() = %v, want an error containing %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: resolveExtends() = %v", test.name, err)
+			continue
+		}
+
+		var got map[string]interface{}
+		if err := yamlnodes.Unmarshal(resolved, &got); err != nil {
+			t.Fatal(err)
+		}
+		delete(got, "apiVersion")
+		if _, ok := got["extends"]; ok {
+			t.Errorf("%s: 'extends' was left in", test.name)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: resolved into %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFetchHTTPSourceCachesPrivately(t *testing.T) {
+	cacheHome := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheHome)
+	t.Setenv("HOME", cacheHome)
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write([]byte("namespace: staging\n"))
+	}))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		if file, err := fetchHTTPSource(server.URL + "/org.yaml"); err != nil || string(file) != "namespace: staging\n" {
+			t.Fatalf("fetchHTTPSource() = %q, %v", file, err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("it was fetched %d times, want once and then read from the cache", fetches)
+	}
+
+	cacheDir, err := extendsCacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(cacheDir, cacheHome) {
+		t.Errorf("the cache is in %s, want it in the user's cache directory", cacheDir)
+	}
+	cacheFile := extendsCacheFile(cacheDir, server.URL+"/org.yaml") + ".yaml"
+	for path, want := range map[string]os.FileMode{cacheDir: 0700, cacheFile: 0600} {
+		if info, err := os.Stat(path); err != nil {
+			t.Error(err)
+		} else if info.Mode().Perm() != want {
+			t.Errorf("%s is %v, want %v", path, info.Mode().Perm(), want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/cli"
+)
+
+// The layouts a freeze's 'from' and 'until' can be written in - all but RFC 3339 are in the freeze's timezone
+var freezeTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"}
+
+// ActiveFreeze finds the freeze window the environment is in at the given time, or returns nil if there isn't one
+func (r RepoConfigMap) ActiveFreeze(now time.Time) (*cli.Freeze, error) {
+	for _, f := range r.Freezes {
+		if len(f.Environments) > 0 && !contains(f.Environments, r.Namespace) {
+			continue
+		}
+		_, end, active, err := f.activeWindow(now)
+		if err != nil {
+			return nil, fmt.Errorf("the freeze '%s' is broken: %s", f.Name, err)
+		}
+		if active {
+			return &cli.Freeze{Name: f.Name, Reason: f.Reason, Until: end}, nil
+		}
+	}
+	return nil, nil
+}
+
+// The window of the freeze that the given time is in, if it's in one
+func (f freezeConfigMap) activeWindow(now time.Time) (time.Time, time.Time, bool, error) {
+	location := time.Local
+	if f.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(f.Timezone); err != nil {
+			return time.Time{}, time.Time{}, false, fmt.Errorf("'%s' isn't a timezone I know", f.Timezone)
+		}
+	}
+	isRange := f.From != "" || f.Until != ""
+	isScheduled := f.Schedule != "" || f.Duration != ""
+	switch {
+	case isRange && isScheduled:
+		return time.Time{}, time.Time{}, false, fmt.Errorf("it needs either 'from' and 'until', or a 'schedule' and a 'duration' - not both")
+	case isRange:
+		start, err := parseFreezeTime(f.From, location, false)
+		if err != nil {
+			return time.Time{}, time.Time{}, false, fmt.Errorf("'from': %s", err)
+		}
+		end, err := parseFreezeTime(f.Until, location, true)
+		if err != nil {
+			return time.Time{}, time.Time{}, false, fmt.Errorf("'until': %s", err)
+		}
+		if !end.After(start) {
+			return time.Time{}, time.Time{}, false, fmt.Errorf("'until' should be after 'from'")
+		}
+		return start, end, !now.Before(start) && now.Before(end), nil
+	case isScheduled:
+		s, err := parseSchedule(f.Schedule)
+		if err != nil {
+			return time.Time{}, time.Time{}, false, fmt.Errorf("'schedule': %s", err)
+		}
+		duration, err := time.ParseDuration(f.Duration)
+		if err != nil || duration < time.Minute {
+			return time.Time{}, time.Time{}, false, fmt.Errorf("'duration' should be at least a minute, like '90m' or '64h'")
+		}
+		// Looks back over the duration for a minute the schedule starts a window at
+		for start := now.Truncate(time.Minute); start.Add(duration).After(now); start = start.Add(-time.Minute) {
+			if s.matches(start.In(location)) {
+				return start, start.Add(duration), true, nil
+			}
+		}
+		return time.Time{}, time.Time{}, false, nil
+	}
+	return time.Time{}, time.Time{}, false, fmt.Errorf("it needs 'from' and 'until', or a 'schedule' and a 'duration'")
+}
+
+// A date on its own means the start of that day for 'from', and the end of it for 'until'
+func parseFreezeTime(value string, location *time.Location, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("it's needed")
+	}
+	for _, layout := range freezeTimeLayouts {
+		t, err := time.ParseInLocation(layout, value, location)
+		if err != nil {
+			continue
+		}
+		if endOfDay && layout == "2006-01-02" {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("'%s' should look like '2006-01-02', '2006-01-02 15:04' or '2006-01-02T15:04:05+01:00'", value)
+}
+
+// schedule : a cron expression ('minute hour day-of-month month day-of-week'), as the minutes, hours, etc. it matches
+type schedule struct {
+	fields     [5]map[int]bool
+	restricted [5]bool // Whether the field was something other than '*'
+}
+
+var scheduleFieldRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func parseSchedule(expression string) (schedule, error) {
+	var s schedule
+	parts := strings.Fields(expression)
+	if len(parts) != 5 {
+		return s, fmt.Errorf("'%s' should have 5 fields: minute, hour, day of month, month and day of week", expression)
+	}
+	for i, part := range parts {
+		s.fields[i] = make(map[int]bool)
+		s.restricted[i] = part != "*"
+		for _, item := range strings.Split(part, ",") {
+			if err := s.addItem(i, item); err != nil {
+				return s, fmt.Errorf("'%s' in '%s': %s", item, expression, err)
+			}
+		}
+	}
+	// Both 0 and 7 are Sunday
+	if s.fields[4][7] {
+		s.fields[4][0] = true
+	}
+	return s, nil
+}
+
+// Adds one item of a field: '*', '5', '1-5', or any of those with a step, like '*/15' or '0-30/10'
+func (s *schedule) addItem(field int, item string) error {
+	low, high := scheduleFieldRanges[field][0], scheduleFieldRanges[field][1]
+	step := 1
+	if i := strings.Index(item, "/"); i >= 0 {
+		var err error
+		if step, err = strconv.Atoi(item[i+1:]); err != nil || step < 1 {
+			return fmt.Errorf("the step should be a positive number")
+		}
+		item = item[:i]
+	}
+	from, to := low, high
+	if item != "*" {
+		bounds := strings.SplitN(item, "-", 2)
+		var err error
+		if from, err = strconv.Atoi(bounds[0]); err != nil {
+			return fmt.Errorf("it should be a number, a range or '*'")
+		}
+		to = from
+		if len(bounds) == 2 {
+			if to, err = strconv.Atoi(bounds[1]); err != nil {
+				return fmt.Errorf("it should be a number, a range or '*'")
+			}
+		} else if step > 1 {
+			// Like '5/15', which counts from 5 to the end
+			to = high
+		}
+	}
+	if from < low || to > high || from > to {
+		return fmt.Errorf("it should be between %d and %d", low, high)
+	}
+	for n := from; n <= to; n += step {
+		s.fields[field][n] = true
+	}
+	return nil
+}
+
+// Whether the schedule starts a window at the given minute. Like cron, when both the day of the month and the day
+// of the week are restricted, either of them matching is enough.
+func (s schedule) matches(t time.Time) bool {
+	if !s.fields[0][t.Minute()] || !s.fields[1][t.Hour()] || !s.fields[3][int(t.Month())] {
+		return false
+	}
+	dayOfMonth, dayOfWeek := s.fields[2][t.Day()], s.fields[4][int(t.Weekday())]
+	if s.restricted[2] && s.restricted[4] {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
@@ -0,0 +1,198 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleMatches(t *testing.T) {
+	utc := func(value string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	// 2024-01-05 is a Friday, and 2024-01-07 a Sunday
+	tests := []struct {
+		schedule string
+		at       string
+		want     bool
+	}{
+		{"* * * * *", "2024-01-05 13:37", true},
+		{"0 18 * * 5", "2024-01-05 18:00", true},
+		{"0 18 * * 5", "2024-01-05 18:01", false},
+		{"0 18 * * 5", "2024-01-06 18:00", false},
+		{"0 18 * * 1-5", "2024-01-03 18:00", true},
+		{"0 18 * * 1-5", "2024-01-07 18:00", false},
+		{"*/15 * * * *", "2024-01-05 10:45", true},
+		{"*/15 * * * *", "2024-01-05 10:50", false},
+		{"5/20 * * * *", "2024-01-05 10:45", true},
+		{"5/20 * * * *", "2024-01-05 10:05", true},
+		{"5/20 * * * *", "2024-01-05 10:20", false},
+		{"0-30/10 9 * * *", "2024-01-05 09:30", true},
+		{"0-30/10 9 * * *", "2024-01-05 09:40", false},
+		{"0 9,17 * * *", "2024-01-05 17:00", true},
+		{"0 9,17 * * *", "2024-01-05 12:00", false},
+		{"0 0 * 12 *", "2024-12-25 00:00", true},
+		{"0 0 * 12 *", "2024-01-05 00:00", false},
+		// Both 0 and 7 are Sunday
+		{"0 0 * * 7", "2024-01-07 00:00", true},
+		{"0 0 * * 0", "2024-01-07 00:00", true},
+		// When both days are restricted, either one matching is enough
+		{"0 0 1 * 5", "2024-01-05 00:00", true},
+		{"0 0 1 * 5", "2024-02-01 00:00", true},
+		{"0 0 1 * 5", "2024-01-06 00:00", false},
+		// Otherwise, both have to match
+		{"0 0 1 * *", "2024-01-05 00:00", false},
+		{"0 0 1 * *", "2024-02-01 00:00", true},
+	}
+	for _, test := range tests {
+		s, err := parseSchedule(test.schedule)
+		if err != nil {
+			t.Errorf("parseSchedule(%q) = %s", test.schedule, err)
+			continue
+		}
+		if got := s.matches(utc(test.at)); got != test.want {
+			t.Errorf("%q matches %s = %v, want %v", test.schedule, test.at, got, test.want)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, expression := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"30-10 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-b * * * *",
+	} {
+		if _, err := parseSchedule(expression); err == nil {
+			t.Errorf("parseSchedule(%q) didn't return an error", expression)
+		}
+	}
+}
+
+func TestActiveFreeze(t *testing.T) {
+	friday := time.Date(2024, 1, 5, 19, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		freeze    freezeConfigMap
+		now       time.Time
+		wantName  string
+		wantUntil time.Time
+		wantErr   bool
+	}{
+		{
+			name:      "in a range",
+			freeze:    freezeConfigMap{Name: "holidays", From: "2024-01-01", Until: "2024-01-05", Timezone: "UTC"},
+			now:       friday,
+			wantName:  "holidays",
+			wantUntil: time.Date(2024, 1, 6, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "after a range",
+			freeze: freezeConfigMap{Name: "holidays", From: "2024-01-01", Until: "2024-01-04", Timezone: "UTC"},
+			now:    friday,
+		},
+		{
+			name:   "before a range",
+			freeze: freezeConfigMap{Name: "launch", From: "2024-01-05 20:00", Until: "2024-01-06 08:00", Timezone: "UTC"},
+			now:    friday,
+		},
+		{
+			name:      "a range in another timezone",
+			freeze:    freezeConfigMap{Name: "launch", From: "2024-01-05 19:00", Until: "2024-01-05 21:00", Timezone: "Europe/Amsterdam"},
+			now:       friday,
+			wantName:  "launch",
+			wantUntil: time.Date(2024, 1, 5, 20, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "in a scheduled window",
+			freeze:    freezeConfigMap{Name: "weekend", Schedule: "0 18 * * 5", Duration: "62h", Timezone: "UTC"},
+			now:       friday,
+			wantName:  "weekend",
+			wantUntil: time.Date(2024, 1, 8, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "at the end of a scheduled window's weekend",
+			freeze:    freezeConfigMap{Name: "weekend", Schedule: "0 18 * * 5", Duration: "62h", Timezone: "UTC"},
+			now:       time.Date(2024, 1, 8, 7, 59, 0, 0, time.UTC),
+			wantName:  "weekend",
+			wantUntil: time.Date(2024, 1, 8, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "after a scheduled window",
+			freeze: freezeConfigMap{Name: "weekend", Schedule: "0 18 * * 5", Duration: "62h", Timezone: "UTC"},
+			now:    time.Date(2024, 1, 8, 8, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "a schedule in another timezone",
+			freeze:    freezeConfigMap{Name: "evening", Schedule: "0 20 * * *", Duration: "1h", Timezone: "Europe/Amsterdam"},
+			now:       friday,
+			wantName:  "evening",
+			wantUntil: time.Date(2024, 1, 5, 20, 0, 0, 0, time.UTC),
+		},
+		{
+			name:   "another environment",
+			freeze: freezeConfigMap{Name: "holidays", Environments: []string{"production"}, From: "2024-01-01", Until: "2024-01-06"},
+			now:    friday,
+		},
+		{
+			name:    "both a range and a schedule",
+			freeze:  freezeConfigMap{Name: "broken", From: "2024-01-01", Until: "2024-01-06", Schedule: "* * * * *", Duration: "1h"},
+			now:     friday,
+			wantErr: true,
+		},
+		{
+			name:    "until before from",
+			freeze:  freezeConfigMap{Name: "broken", From: "2024-01-06", Until: "2024-01-01"},
+			now:     friday,
+			wantErr: true,
+		},
+		{
+			name:    "a short duration",
+			freeze:  freezeConfigMap{Name: "broken", Schedule: "* * * * *", Duration: "30s"},
+			now:     friday,
+			wantErr: true,
+		},
+		{
+			name:    "an unknown timezone",
+			freeze:  freezeConfigMap{Name: "broken", From: "2024-01-01", Until: "2024-01-06", Timezone: "Mars/Olympus_Mons"},
+			now:     friday,
+			wantErr: true,
+		},
+		{
+			name:    "nothing",
+			freeze:  freezeConfigMap{Name: "broken"},
+			now:     friday,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		repoConfig := RepoConfigMap{Namespace: "staging", Freezes: []freezeConfigMap{test.freeze}}
+		freeze, err := repoConfig.ActiveFreeze(test.now)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: ActiveFreeze() error = %v, want an error: %v", test.name, err, test.wantErr)
+			continue
+		}
+		switch {
+		case test.wantName == "" && freeze != nil:
+			t.Errorf("%s: ActiveFreeze() = %+v, want no freeze", test.name, freeze)
+		case test.wantName != "" && freeze == nil:
+			t.Errorf("%s: ActiveFreeze() = nil, want %s", test.name, test.wantName)
+		case test.wantName != "" && (freeze.Name != test.wantName || !freeze.Until.Equal(test.wantUntil)):
+			t.Errorf("%s: ActiveFreeze() = %s until %s, want %s until %s", test.name, freeze.Name, freeze.Until, test.wantName, test.wantUntil)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	yamlnodes "gopkg.in/yaml.v3"
+
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/logger"
+)
+
+// APIVersion : the deploy.yaml format this kube-deploy reads - older ones are converted as they're loaded
+const APIVersion = "kube-deploy/v1"
+
+// A deploy.yaml without an apiVersion is from before there were versions
+const unversioned = ""
+
+// converter : upgrades a deploy.yaml by one version, working on the YAML nodes so comments are kept
+type converter struct {
+	From    string
+	To      string
+	Convert func(root *yamlnodes.Node) error
+}
+
+// The converters, oldest first - each version after the first has to have one
+var converters = []converter{
+	{From: unversioned, To: "kube-deploy/v1", Convert: convertUnversioned},
+}
+
+// Before the cluster had a YAML name, 'clustername' was read but always overwritten by the branch's cluster,
+// so it never did anything - it's dropped rather than turned into a 'cluster' which would suddenly take effect
+func convertUnversioned(root *yamlnodes.Node) error {
+	if key, _ := mappingEntry(root, "clustername"); key != nil {
+		logger.Warn("=> The deploy.yaml has a 'clustername', which never had any effect, so I'm ignoring it. Set 'cluster' if you want to choose the cluster.")
+		removeMappingEntry(root, "clustername")
+	}
+	return nil
+}
+
+// Migrate rewrites a deploy.yaml in the current APIVersion, keeping its comments, and returns the version it was in.
+// A file which is already current is left alone.
+func Migrate(configFilePath string) (string, error) {
+	configFile, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		return "", failure.Wrap(failure.Config, err, "Failed reading repo config file")
+	}
+	converted, fileVersion, err := convertConfig(configFile)
+	if err != nil {
+		return fileVersion, failure.Wrap(failure.Config, err, "Couldn't migrate %s", configFilePath)
+	}
+	if fileVersion == APIVersion {
+		return fileVersion, nil
+	}
+
+	info, err := os.Stat(configFilePath)
+	if err != nil {
+		return fileVersion, failure.Wrap(failure.Config, err, "Failed reading repo config file")
+	}
+	if err := ioutil.WriteFile(configFilePath, converted, info.Mode()); err != nil {
+		return fileVersion, failure.Wrap(failure.Config, err, "Couldn't write the migrated %s", configFilePath)
+	}
+	return fileVersion, nil
+}
+
+// Runs the converters from the file's version up to the current one - a current file is returned untouched
+func convertConfig(configFile []byte) ([]byte, string, error) {
+	var root yamlnodes.Node
+	if err := yamlnodes.Unmarshal(configFile, &root); err != nil {
+		return nil, unversioned, err
+	}
+	document := documentMapping(&root)
+	if document == nil {
+		// Empty, or not a mapping - leave it for the YAML decoding to complain about
+		return configFile, APIVersion, nil
+	}
+
+	fileVersion := unversioned
+	if _, value := mappingEntry(document, "apiVersion"); value != nil {
+		fileVersion = value.Value
+	}
+	if fileVersion == APIVersion {
+		return configFile, fileVersion, nil
+	}
+
+	version := fileVersion
+	for _, c := range converters {
+		if c.From != version {
+			continue
+		}
+		if err := c.Convert(document); err != nil {
+			return nil, fileVersion, fmt.Errorf("converting it from '%s' to '%s': %s", displayVersion(c.From), c.To, err)
+		}
+		version = c.To
+	}
+	if version != APIVersion {
+		return nil, fileVersion, fmt.Errorf("its apiVersion '%s' isn't one I know - I read '%s' and older, so you might need a newer kube-deploy", fileVersion, APIVersion)
+	}
+	setAPIVersion(document, APIVersion)
+
+	var converted bytes.Buffer
+	encoder := yamlnodes.NewEncoder(&converted)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&root); err != nil {
+		return nil, fileVersion, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fileVersion, err
+	}
+	return converted.Bytes(), fileVersion, nil
+}
+
+func displayVersion(version string) string {
+	if version == unversioned {
+		return "no apiVersion"
+	}
+	return version
+}
+
+// The top-level mapping of a YAML document, or nil
+func documentMapping(root *yamlnodes.Node) *yamlnodes.Node {
+	if root.Kind == yamlnodes.DocumentNode && len(root.Content) == 1 && root.Content[0].Kind == yamlnodes.MappingNode {
+		return root.Content[0]
+	}
+	return nil
+}
+
+// Finds the key and value nodes for a key in a mapping
+func mappingEntry(mapping *yamlnodes.Node, key string) (*yamlnodes.Node, *yamlnodes.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i], mapping.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// Sets the apiVersion, adding it at the top if it isn't there
+func setAPIVersion(mapping *yamlnodes.Node, version string) {
+	if _, value := mappingEntry(mapping, "apiVersion"); value != nil {
+		value.Value = version
+		return
+	}
+	key := &yamlnodes.Node{Kind: yamlnodes.ScalarNode, Tag: "!!str", Value: "apiVersion"}
+	value := &yamlnodes.Node{Kind: yamlnodes.ScalarNode, Tag: "!!str", Value: version}
+	if len(mapping.Content) > 0 {
+		// Keep a comment at the top of the file at the top
+		key.HeadComment, mapping.Content[0].HeadComment = mapping.Content[0].HeadComment, ""
+	}
+	mapping.Content = append([]*yamlnodes.Node{key, value}, mapping.Content...)
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConvertConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		contents    string
+		want        string
+		wantVersion string
+		wantErr     bool
+	}{
+		{
+			name:        "an unversioned file gets an apiVersion",
+			contents:    "application:\n  name: api\n",
+			want:        "apiVersion: kube-deploy/v1\napplication:\n  name: api\n",
+			wantVersion: unversioned,
+		},
+		{
+			name:        "clustername is dropped",
+			contents:    "clustername: production\napplication:\n  name: api\n",
+			want:        "apiVersion: kube-deploy/v1\napplication:\n  name: api\n",
+			wantVersion: unversioned,
+		},
+		{
+			name:        "clustername is dropped without touching cluster",
+			contents:    "cluster: staging\nclustername: production\n",
+			want:        "apiVersion: kube-deploy/v1\ncluster: staging\n",
+			wantVersion: unversioned,
+		},
+		{
+			name:        "a current file is untouched",
+			contents:    "apiVersion: kube-deploy/v1\napplication:   {name: api}\n",
+			want:        "apiVersion: kube-deploy/v1\napplication:   {name: api}\n",
+			wantVersion: APIVersion,
+		},
+		{
+			name:        "a newer version is an error",
+			contents:    "apiVersion: kube-deploy/v9\n",
+			wantVersion: "kube-deploy/v9",
+			wantErr:     true,
+		},
+	}
+	for _, test := range tests {
+		converted, version, err := convertConfig([]byte(test.contents))
+		if version != test.wantVersion {
+			t.Errorf("%s: convertConfig() version = %q, want %q", test.name, version, test.wantVersion)
+		}
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: convertConfig() = %q, want an error", test.name, converted)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: convertConfig() = %v", test.name, err)
+			continue
+		}
+		if string(converted) != test.want {
+			t.Errorf("%s: convertConfig() = %q, want %q", test.name, converted, test.want)
+		}
+	}
+}
+
+func TestMigrateKeepsComments(t *testing.T) {
+	const contents = `# The API's deploy config
+application:
+  name: api # what it's called in the cluster
+  # More during the day
+  replicas: 3
+`
+	configFilePath := filepath.Join(t.TempDir(), "deploy.yaml")
+	if err := ioutil.WriteFile(configFilePath, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := Migrate(configFilePath)
+	if err != nil || version != unversioned {
+		t.Fatalf("Migrate() = %q, %v, want it migrated from no apiVersion", version, err)
+	}
+	migrated, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(migrated), "# The API's deploy config\napiVersion: kube-deploy/v1\n") {
+		t.Errorf("the apiVersion isn't under the top comment:\n%s", migrated)
+	}
+	for _, comment := range []string{"# what it's called in the cluster", "# More during the day"} {
+		if !strings.Contains(string(migrated), comment) {
+			t.Errorf("the comment %q was lost:\n%s", comment, migrated)
+		}
+	}
+
+	// Migrating it again leaves it alone
+	if version, err := Migrate(configFilePath); err != nil || version != APIVersion {
+		t.Errorf("Migrate() of a migrated file = %q, %v, want %q", version, err, APIVersion)
+	}
+	if again, _ := ioutil.ReadFile(configFilePath); string(again) != string(migrated) {
+		t.Errorf("migrating again changed it to:\n%s", again)
+	}
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The values validate accepts for each enum in the schema, by the end of its path
+var schemaEnums = map[string][]string{
+	"apiVersion":                {APIVersion},
+	"rollout.approvalMode":      approvalModes,
+	"tests[].type":              testTypes,
+	"smokeTests[].type":         smokeTestTypes,
+	"notifications[].type":      notificationTypes,
+	"notifications[].events[]":  notificationEvents,
+	"deploymentStatus.provider": forgeProviders,
+	"variableSources[].format":  variableFormats,
+	"lint.policies{}":           lintLevels,
+	"lint.policies{names}":      lintPolicies,
+}
+
+// deploy.schema.json is written by hand, so this checks it describes every setting of RepoConfigMap - and nothing
+// else - with the same types and the same values as validate accepts
+func TestSchemaMatchesRepoConfigMap(t *testing.T) {
+	schemaFile, err := ioutil.ReadFile("../deploy.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(schemaFile, &schema); err != nil {
+		t.Fatalf("deploy.schema.json isn't valid JSON: %s", err)
+	}
+
+	s := schemaChecker{t: t, definitions: object(schema["definitions"]), enumsSeen: make(map[string]bool)}
+	s.check(schema, reflect.TypeOf(RepoConfigMap{}), "")
+	for key := range schemaEnums {
+		if !s.enumsSeen[key] {
+			t.Errorf("the schema has no enum for %s", key)
+		}
+	}
+}
+
+type schemaChecker struct {
+	t           *testing.T
+	definitions map[string]interface{}
+	enumsSeen   map[string]bool
+}
+
+func (s schemaChecker) check(node map[string]interface{}, typ reflect.Type, path string) {
+	if ref, ok := node["$ref"].(string); ok {
+		node = object(s.definitions[strings.TrimPrefix(ref, "#/definitions/")])
+		if node == nil {
+			s.t.Errorf("%s: there's no definition for %s", path, ref)
+			return
+		}
+	}
+	s.checkEnum(node["enum"], path)
+
+	wantType := map[reflect.Kind]string{
+		reflect.Struct: "object",
+		reflect.Map:    "object",
+		reflect.Slice:  "array",
+		reflect.String: "string",
+		reflect.Bool:   "boolean",
+		reflect.Int:    "integer",
+		reflect.Int32:  "integer",
+	}[typ.Kind()]
+	if node["type"] != wantType {
+		s.t.Errorf("%s: the schema's type is %v, but it's a %s (%s)", path, node["type"], wantType, typ)
+		return
+	}
+
+	switch typ.Kind() {
+	case reflect.Struct:
+		if node["additionalProperties"] != false {
+			s.t.Errorf("%s: the schema allows settings which aren't in the config", path)
+		}
+		properties := object(node["properties"])
+		fields := make(map[string]bool)
+		for i := 0; i < typ.NumField(); i++ {
+			name := strings.Split(typ.Field(i).Tag.Get("yaml"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			fields[name] = true
+			fieldPath := strings.TrimPrefix(path+"."+name, ".")
+			property := object(properties[name])
+			if property == nil {
+				s.t.Errorf("%s: it's missing from the schema", fieldPath)
+				continue
+			}
+			s.check(property, typ.Field(i).Type, fieldPath)
+		}
+		for _, name := range sortedNames(properties) {
+			if !fields[name] {
+				s.t.Errorf("%s: it's in the schema, but not in the config", strings.TrimPrefix(path+"."+name, "."))
+			}
+		}
+	case reflect.Slice:
+		s.check(object(node["items"]), typ.Elem(), path+"[]")
+	case reflect.Map:
+		values := object(node["additionalProperties"])
+		if values == nil {
+			s.t.Errorf("%s: the schema doesn't describe the values", path)
+			return
+		}
+		s.check(values, typ.Elem(), path+"{}")
+		if names := object(node["propertyNames"]); names != nil {
+			s.checkEnum(names["enum"], path+"{names}")
+		}
+	}
+}
+
+// An empty value means the default, which the schema can leave out
+func (s schemaChecker) checkEnum(enum interface{}, path string) {
+	if enum == nil {
+		return
+	}
+	var key string
+	for k := range schemaEnums {
+		if path == k || strings.HasSuffix(path, "."+k) {
+			key = k
+		}
+	}
+	if key == "" {
+		s.t.Errorf("%s: the schema has an enum, but validate doesn't check it", path)
+		return
+	}
+	s.enumsSeen[key] = true
+
+	var got []string
+	for _, value := range enum.([]interface{}) {
+		if value != "" {
+			got = append(got, value.(string))
+		}
+	}
+	var want []string
+	for _, value := range schemaEnums[key] {
+		if value != "" {
+			want = append(want, value)
+		}
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		s.t.Errorf("%s: the schema allows %v, but validate allows %v", path, got, want)
+	}
+}
+
+func object(node interface{}) map[string]interface{} {
+	o, _ := node.(map[string]interface{})
+	return o
+}
+
+func sortedNames(properties map[string]interface{}) []string {
+	var names []string
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
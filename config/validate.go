@@ -0,0 +1,351 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	yamlnodes "gopkg.in/yaml.v3"
+)
+
+// Problem : something wrong with the deploy.yaml, and the line it's on
+type Problem struct {
+	Line    int
+	Message string
+}
+
+// Docker's naming rules, for the parts of the image path which come from the deploy.yaml
+var (
+	dockerNameComponentRegex = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	dockerRepositoryRegex    = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	dockerRegistryRegex      = regexp.MustCompile(`^[a-zA-Z0-9](?:[a-zA-Z0-9.-]*[a-zA-Z0-9])?(?::[0-9]+)?(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	dockerTagPartRegex       = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+	variableNameRegex        = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	yamlErrorRegex           = regexp.MustCompile(`^line (\d+): (.*?)(?: in type .*)?$`)
+)
+
+// The values the string settings can take - an empty value means the default
+var (
+	testTypes          = []string{"", "on-host", "host-only", "in-test-container", "in-external-container"}
+	smokeTestTypes     = []string{"", "http", "job"}
+	approvalModes      = []string{"", "interactive", "auto-after-hold", "automated-analysis-only", "external-approval"}
+	notificationTypes  = []string{"", "webhook", "slack", "teams"}
+	notificationEvents = []string{"rollout-started", "rollout-completed", "rollout-bailed-out", "rollback-started", "rollback-completed", "scaled", "locked", "unlocked", "freeze-broken"}
+	forgeProviders     = []string{"", "github", "gitlab"}
+	variableFormats    = []string{"", VariableFormatEnv, VariableFormatYAML, VariableFormatJSON}
+	lintPolicies       = []string{"", "resources", "no-latest-tag", "release-image", "probes", "kd-labels"}
+	lintLevels         = []string{"", "error", "warning", "off"}
+)
+
+// ParseVariable splits a template variable like 'NAME=value' - the value can contain '=' too
+func ParseVariable(variable string) (string, string, error) {
+	split := strings.SplitN(variable, "=", 2)
+	if len(split) != 2 {
+		return "", "", fmt.Errorf("the template variable '%s' should look like NAME=value", variable)
+	}
+	if !variableNameRegex.MatchString(split[0]) {
+		return "", "", fmt.Errorf("'%s' isn't a valid template variable name - it can only have letters, numbers and underscores", split[0])
+	}
+	return split[0], split[1], nil
+}
+
+// Validate checks everything it can about the deploy.yaml without talking to anything else - relative paths are
+// checked from the current directory. The problems are sorted by line. It also returns the apiVersion the file is in.
+func Validate(configFilePath string) ([]Problem, string, error) {
+	configFile, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	v := validator{lines: lineIndex(configFile)}
+	convertedConfigFile, fileVersion, err := convertConfig(configFile)
+	if err != nil {
+		v.add("apiVersion", "%s", err)
+		return v.problems, fileVersion, nil
+	}
+	repoConfig := RepoConfigMap{}
+	if err := yaml.UnmarshalStrict(convertedConfigFile, &repoConfig); err != nil {
+		typeError, ok := err.(*yaml.TypeError)
+		if !ok {
+			// The YAML itself is broken, so there's nothing more to check
+			v.addYAMLError(err.Error())
+			return v.problems, fileVersion, nil
+		}
+		// Everything else was still decoded, so carry on checking
+		for _, e := range typeError.Errors {
+			v.addYAMLError(e)
+		}
+		if fileVersion != APIVersion {
+			// The lines are the converted file's, not this one's
+			for i := range v.problems {
+				v.problems[i].Line = 0
+			}
+		}
+	}
+
+	// The rest is checked with whatever the file extends merged in
+	if repoConfig.Extends != "" {
+		resolvedConfigFile, err := resolveExtends(convertedConfigFile, configFilePath, nil)
+		if err != nil {
+			v.add("extends", "%s", err)
+			return v.problems, fileVersion, nil
+		}
+		ownProblems := len(v.problems)
+		repoConfig = RepoConfigMap{}
+		if err := yaml.UnmarshalStrict(resolvedConfigFile, &repoConfig); err != nil && ownProblems == 0 {
+			v.add("extends", "what this extends is broken: %s", err)
+		}
+	}
+
+	v.checkDockerRepository(repoConfig)
+	switch {
+	case repoConfig.Application.Name != "" && len(repoConfig.Applications) > 0:
+		v.add("applications", "the deploy.yaml can have 'application' or 'applications', but not both")
+	case len(repoConfig.Applications) > 0:
+		for i, a := range repoConfig.Applications {
+			v.checkApplication(fmt.Sprintf("applications[%d]", i), a)
+		}
+	default:
+		v.checkApplication("application", repoConfig.Application)
+	}
+	v.checkTests("tests", repoConfig.Tests)
+	v.checkSmokeTests("smokeTests", repoConfig.SmokeTests)
+	for i, hook := range append(repoConfig.Hooks.PreRollout, repoConfig.Hooks.PostRollout...) {
+		path := fmt.Sprintf("hooks.preRollout[%d]", i)
+		if i >= len(repoConfig.Hooks.PreRollout) {
+			path = fmt.Sprintf("hooks.postRollout[%d]", i-len(repoConfig.Hooks.PreRollout))
+		}
+		v.checkFile(path+".template", hook.Template, true)
+	}
+	v.checkOneOf("rollout.approvalMode", repoConfig.Rollout.ApprovalMode, approvalModes)
+	if approval := repoConfig.Rollout.Approval; approval.ListenAddress != "" && approval.PublicURL == "" {
+		v.add("rollout.approval", "the approval endpoint needs a 'publicURL', so the links it posts can be followed")
+	}
+	for i, n := range repoConfig.Notifications {
+		path := fmt.Sprintf("notifications[%d]", i)
+		v.checkOneOf(path+".type", n.Type, notificationTypes)
+		if n.URL == "" {
+			v.add(path, "the notification needs a 'url'")
+		}
+		for j, event := range n.Events {
+			v.checkOneOf(fmt.Sprintf("%s.events[%d]", path, j), event, notificationEvents)
+		}
+	}
+	for policy, level := range repoConfig.Lint.Policies {
+		v.checkOneOf("lint.policies."+policy, policy, lintPolicies)
+		v.checkOneOf("lint.policies."+policy, level, lintLevels)
+	}
+	for i, policyPath := range repoConfig.Policy.Paths {
+		if _, err := os.Stat(policyPath); err != nil {
+			v.add(fmt.Sprintf("policy.paths[%d]", i), "'%s' doesn't exist", policyPath)
+		}
+	}
+	for i, f := range repoConfig.Freezes {
+		if _, _, _, err := f.activeWindow(time.Now()); err != nil {
+			v.add(fmt.Sprintf("freezes[%d]", i), "the freeze '%s' is broken: %s", f.Name, err)
+		}
+	}
+	v.checkOneOf("deploymentStatus.provider", repoConfig.DeploymentStatus.Provider, forgeProviders)
+
+	sort.SliceStable(v.problems, func(i, j int) bool { return v.problems[i].Line < v.problems[j].Line })
+	return v.problems, fileVersion, nil
+}
+
+type validator struct {
+	lines    map[string]int // The line of each setting, by its path (eg. 'tests[0].type')
+	problems []Problem
+}
+
+// Adds a problem on the line of the setting at path - or of the nearest setting above it, if it isn't in the deploy.yaml
+func (v *validator) add(path string, format string, a ...interface{}) {
+	line, ok := v.lines[path]
+	for !ok && path != "" {
+		if i := strings.LastIndexAny(path, ".["); i >= 0 {
+			path = path[:i]
+		} else {
+			path = ""
+		}
+		line, ok = v.lines[path]
+	}
+	v.problems = append(v.problems, Problem{Line: line, Message: fmt.Sprintf(format, a...)})
+}
+
+// Turns a YAML decoding error like 'line 12: field brnachVariables not found' into a problem
+func (v *validator) addYAMLError(message string) {
+	message = strings.TrimPrefix(message, "yaml: ")
+	if match := yamlErrorRegex.FindStringSubmatch(message); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		v.problems = append(v.problems, Problem{Line: line, Message: match[2]})
+		return
+	}
+	v.problems = append(v.problems, Problem{Message: message})
+}
+
+func (v *validator) checkOneOf(path string, value string, allowed []string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	var choices []string
+	for _, a := range allowed {
+		if a != "" {
+			choices = append(choices, a)
+		}
+	}
+	v.add(path, "'%s' should be one of: %s", value, strings.Join(choices, ", "))
+}
+
+// Makes sure a path (relative to the current directory) exists, and is a file or a directory as expected
+func (v *validator) checkFile(path string, file string, wantFile bool) {
+	if file == "" {
+		v.add(path, "'%s' is needed", path[strings.LastIndex(path, ".")+1:])
+		return
+	}
+	info, err := os.Stat(file)
+	switch {
+	case err != nil:
+		v.add(path, "'%s' doesn't exist", file)
+	case wantFile && info.IsDir():
+		v.add(path, "'%s' should be a file, but it's a directory", file)
+	case !wantFile && !info.IsDir():
+		v.add(path, "'%s' should be a directory, but it's a file", file)
+	}
+}
+
+func (v *validator) checkDockerRepository(repoConfig RepoConfigMap) {
+	if repoConfig.ImageFullPath != "" {
+		return
+	}
+	for key, name := range map[string]string{
+		"developmentRepositoryName": repoConfig.DockerRepository.DevelopmentRepositoryName,
+		"productionRepositoryName":  repoConfig.DockerRepository.ProductionRepositoryName,
+	} {
+		if !dockerRepositoryRegex.MatchString(name) {
+			v.add("dockerRepository."+key, "'%s' isn't a valid Docker repository name - it can only have lowercase letters, numbers, '.', '_', '-' and '/'", name)
+		}
+	}
+	if root := repoConfig.DockerRepository.RegistryRoot; root != "" && !dockerRegistryRegex.MatchString(root) {
+		v.add("dockerRepository.registryRoot", "'%s' isn't a valid Docker registry, like 'eu.gcr.io' or 'registry.example.com:5000/team'", root)
+	}
+}
+
+func (v *validator) checkApplication(path string, a applicationConfigMap) {
+	// With packageJSON, the name can come from the package.json instead
+	if (a.Name != "" || !a.PackageJSON) && !dockerNameComponentRegex.MatchString(a.Name) {
+		v.add(path+".name", "'%s' isn't a valid application name - it's used in the Docker image name, so it can only have lowercase letters, numbers, '.', '_' and '-'", a.Name)
+	}
+	buildContext := a.BuildContext
+	if buildContext == "" {
+		buildContext = "."
+	}
+	v.checkFile(path+".buildContext", buildContext, false)
+
+	if a.PackageJSON {
+		if _, err := os.Stat(filepath.Join(buildContext, "package.json")); err != nil {
+			v.add(path+".packageJSON", "there's no package.json in '%s' to read the name and version from", buildContext)
+		}
+	} else if !dockerTagPartRegex.MatchString(a.Version) {
+		v.add(path+".version", "'%s' isn't a valid version - it's used in the Docker image tag, so it can only have letters, numbers, '.', '_' and '-'", a.Version)
+	}
+	if a.Dockerfile != "" {
+		v.checkFile(path+".dockerfile", a.Dockerfile, true)
+	}
+	// Projects which only build images don't need Kubernetes files
+	if a.PathToKubernetesFiles != "" {
+		v.checkFile(path+".pathToKubernetesFiles", a.PathToKubernetesFiles, false)
+	}
+
+	for i, variable := range a.KubernetesTemplate.GlobalVariables {
+		if _, _, err := ParseVariable(variable); err != nil {
+			v.add(fmt.Sprintf("%s.kubernetesTemplate.globalVariables[%d]", path, i), "%s", err)
+		}
+	}
+	for heading, variables := range a.KubernetesTemplate.BranchVariables {
+		for i, variable := range variables {
+			if _, _, err := ParseVariable(variable); err != nil {
+				v.add(fmt.Sprintf("%s.kubernetesTemplate.branchVariables.%s[%d]", path, heading, i), "%s", err)
+			}
+		}
+	}
+	for i, source := range a.KubernetesTemplate.VariableSources {
+		sourcePath := fmt.Sprintf("%s.kubernetesTemplate.variableSources[%d]", path, i)
+		switch {
+		case (source.File == "") == (source.Command == ""):
+			v.add(sourcePath, "a variable source needs either a 'file' or a 'command'")
+		case source.File != "" && !source.Optional && !strings.Contains(source.File, "{environment}"):
+			v.checkFile(sourcePath+".file", source.File, true)
+		}
+		v.checkOneOf(sourcePath+".format", source.Format, variableFormats)
+	}
+	v.checkTests(path+".tests", a.Tests)
+	v.checkSmokeTests(path+".smokeTests", a.SmokeTests)
+}
+
+func (v *validator) checkTests(path string, tests []testConfigMap) {
+	for i, t := range tests {
+		testPath := fmt.Sprintf("%s[%d]", path, i)
+		v.checkOneOf(testPath+".type", t.Type, testTypes)
+		if len(t.Commands) == 0 {
+			v.add(testPath, "the test '%s' has no 'commands' to run", t.Name)
+		}
+	}
+}
+
+func (v *validator) checkSmokeTests(path string, smokeTests []smokeTestConfigMap) {
+	for i, t := range smokeTests {
+		testPath := fmt.Sprintf("%s[%d]", path, i)
+		v.checkOneOf(testPath+".type", t.Type, smokeTestTypes)
+		switch t.Type {
+		case "job":
+			v.checkFile(testPath+".template", t.Template, true)
+		case "http", "":
+			if t.Port <= 0 || t.Port > 65535 {
+				v.add(testPath+".port", "the smoke test '%s' needs a 'port' between 1 and 65535", t.Name)
+			}
+		}
+	}
+}
+
+// Finds the line of every setting in the deploy.yaml, by its path
+func lineIndex(configFile []byte) map[string]int {
+	lines := make(map[string]int)
+	var root yamlnodes.Node
+	if err := yamlnodes.Unmarshal(configFile, &root); err != nil {
+		return lines
+	}
+
+	var walk func(node *yamlnodes.Node, path string)
+	walk = func(node *yamlnodes.Node, path string) {
+		lines[path] = node.Line
+		switch node.Kind {
+		case yamlnodes.DocumentNode:
+			for _, child := range node.Content {
+				walk(child, path)
+			}
+		case yamlnodes.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				childPath := node.Content[i].Value
+				if path != "" {
+					childPath = path + "." + childPath
+				}
+				walk(node.Content[i+1], childPath)
+				// The key's line is more useful than the value's, for nested settings
+				lines[childPath] = node.Content[i].Line
+			}
+		case yamlnodes.SequenceNode:
+			for i, child := range node.Content {
+				walk(child, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	}
+	walk(&root, "")
+	return lines
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	const valid = `apiVersion: kube-deploy/v1
+dockerRepository:
+  developmentRepositoryName: team/development
+  productionRepositoryName: team/production
+application:
+  name: api
+  version: "1.0"
+`
+
+	tests := []struct {
+		name         string
+		contents     string
+		wantProblems []Problem
+		wantVersion  string
+	}{
+		{
+			name:        "a valid file",
+			contents:    valid,
+			wantVersion: APIVersion,
+		},
+		{
+			name:        "a valid file from before there were versions",
+			contents:    valid[len("apiVersion: kube-deploy/v1\n"):],
+			wantVersion: unversioned,
+		},
+		{
+			name:         "a setting which kube-deploy works out for itself",
+			contents:     valid + "releasename: api-master-abc1234\n",
+			wantProblems: []Problem{{Line: 8, Message: "field releasename not found"}},
+			wantVersion:  APIVersion,
+		},
+		{
+			name:         "a misspelt setting",
+			contents:     valid + "rollout:\n  aprovalMode: interactive\n",
+			wantProblems: []Problem{{Line: 9, Message: "field aprovalMode not found"}},
+			wantVersion:  APIVersion,
+		},
+		{
+			name:     "bad values are on their own lines, in order",
+			contents: strings.Replace(valid, "name: api", "name: API", 1) + "rollout:\n  approvalMode: whenever\n" + "smokeTests:\n- type: carrier-pigeon\n",
+			wantProblems: []Problem{
+				{Line: 6, Message: "'API' isn't a valid application name - it's used in the Docker image name, so it can only have lowercase letters, numbers, '.', '_' and '-'"},
+				{Line: 9, Message: "'whenever' should be one of: interactive, auto-after-hold, automated-analysis-only, external-approval"},
+				{Line: 11, Message: "'carrier-pigeon' should be one of: http, job"},
+			},
+			wantVersion: APIVersion,
+		},
+		{
+			name:         "a newer version",
+			contents:     "apiVersion: kube-deploy/v9\n",
+			wantProblems: []Problem{{Line: 1, Message: "its apiVersion 'kube-deploy/v9' isn't one I know - I read 'kube-deploy/v1' and older, so you might need a newer kube-deploy"}},
+			wantVersion:  "kube-deploy/v9",
+		},
+	}
+	for _, test := range tests {
+		configFilePath := filepath.Join(t.TempDir(), "deploy.yaml")
+		if err := ioutil.WriteFile(configFilePath, []byte(test.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		problems, version, err := Validate(configFilePath)
+		if err != nil {
+			t.Errorf("%s: Validate() = %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(problems, test.wantProblems) {
+			t.Errorf("%s: Validate() = %+v, want %+v", test.name, problems, test.wantProblems)
+		}
+		if version != test.wantVersion {
+			t.Errorf("%s: Validate() version = %q, want %q", test.name, version, test.wantVersion)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The formats variable sources can be in
+const (
+	VariableFormatEnv  = "env"
+	VariableFormatYAML = "yaml"
+	VariableFormatJSON = "json"
+)
+
+// Variable : a template variable as it's written, before any substitutions
+type Variable struct {
+	Name  string
+	Value string
+}
+
+// VariableFormat is the format of the source - the one it sets, or else the one its file extension suggests
+func (s variableSourceConfigMap) VariableFormat() string {
+	if s.Format != "" {
+		return s.Format
+	}
+	switch filepath.Ext(s.File) {
+	case ".yaml", ".yml":
+		return VariableFormatYAML
+	case ".json":
+		return VariableFormatJSON
+	}
+	return VariableFormatEnv
+}
+
+// ReadVariables reads variables in one of the variable formats, keeping their order
+func ReadVariables(data []byte, format string) ([]Variable, error) {
+	switch format {
+	case VariableFormatEnv:
+		return readEnvVariables(data)
+	case VariableFormatYAML, VariableFormatJSON:
+		// JSON is YAML too
+		return readMapVariables(data)
+	}
+	return nil, fmt.Errorf("'%s' isn't a variable format - it should be one of: %s, %s, %s", format, VariableFormatEnv, VariableFormatYAML, VariableFormatJSON)
+}
+
+// Reads a .env file: 'NAME=value' lines, which can start with 'export', with optional quotes around the value
+func readEnvVariables(data []byte) ([]Variable, error) {
+	var variables []Variable
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, err := ParseVariable(strings.TrimPrefix(line, "export "))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && value[0] == value[len(value)-1] && (value[0] == '"' || value[0] == '\'') {
+			if unquoted, err := strconv.Unquote(value); value[0] == '"' && err == nil {
+				value = unquoted
+			} else {
+				value = value[1 : len(value)-1]
+			}
+		}
+		variables = append(variables, Variable{Name: strings.TrimSpace(name), Value: value})
+	}
+	return variables, scanner.Err()
+}
+
+// Reads a flat YAML or JSON map of names to values
+func readMapVariables(data []byte) ([]Variable, error) {
+	var items yaml.MapSlice
+	if err := yaml.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	var variables []Variable
+	for _, item := range items {
+		name := fmt.Sprint(item.Key)
+		var value string
+		switch v := item.Value.(type) {
+		case nil:
+		case string, bool, int, int64, uint64, float64:
+			value = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("the value of '%s' should be a string, number or boolean, not a list or map", name)
+		}
+		if _, _, err := ParseVariable(name + "=" + value); err != nil {
+			return nil, err
+		}
+		variables = append(variables, Variable{Name: name, Value: value})
+	}
+	return variables, nil
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadVariables(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		data    string
+		want    []Variable
+		wantErr string
+	}{
+		{
+			name:   "a .env file",
+			format: VariableFormatEnv,
+			data:   "# The database\nDB_HOST=db.local\n\nexport DB_PORT=5432\n  URL=https://example.com/?a=b  \n",
+			want:   []Variable{{Name: "DB_HOST", Value: "db.local"}, {Name: "DB_PORT", Value: "5432"}, {Name: "URL", Value: "https://example.com/?a=b"}},
+		},
+		{
+			name:   "quoted values in a .env file",
+			format: VariableFormatEnv,
+			data:   `A="two words"` + "\n" + `B='single $quoted'` + "\n" + `C="line\nbreak"` + "\n" + `D='it''s'` + "\n" + `E="` + "\n" + `F=""` + "\n",
+			want: []Variable{
+				{Name: "A", Value: "two words"},
+				{Name: "B", Value: "single $quoted"},
+				{Name: "C", Value: "line\nbreak"},
+				{Name: "D", Value: "it''s"},
+				{Name: "E", Value: `"`},
+				{Name: "F", Value: ""},
+			},
+		},
+		{
+			name:    "a line without a value in a .env file",
+			format:  VariableFormatEnv,
+			data:    "A=1\nB\n",
+			wantErr: "line 2:",
+		},
+		{
+			name:    "a bad name in a .env file",
+			format:  VariableFormatEnv,
+			data:    "MY-VAR=1\n",
+			wantErr: "isn't a valid template variable name",
+		},
+		{
+			name:   "a YAML map, in order",
+			format: VariableFormatYAML,
+			data:   "ZONE: eu\nREPLICAS: 3\nDEBUG: true\nRATIO: 0.5\nEMPTY:\n",
+			want:   []Variable{{Name: "ZONE", Value: "eu"}, {Name: "REPLICAS", Value: "3"}, {Name: "DEBUG", Value: "true"}, {Name: "RATIO", Value: "0.5"}, {Name: "EMPTY", Value: ""}},
+		},
+		{
+			name:   "a JSON map",
+			format: VariableFormatJSON,
+			data:   `{"HOST": "db.local", "PORT": 5432}`,
+			want:   []Variable{{Name: "HOST", Value: "db.local"}, {Name: "PORT", Value: "5432"}},
+		},
+		{
+			name:    "a list in a YAML map",
+			format:  VariableFormatYAML,
+			data:    "HOSTS:\n- a\n- b\n",
+			wantErr: "the value of 'HOSTS' should be a string, number or boolean",
+		},
+		{
+			name:    "a map in a JSON map",
+			format:  VariableFormatJSON,
+			data:    `{"DB": {"HOST": "db.local"}}`,
+			wantErr: "the value of 'DB' should be a string, number or boolean",
+		},
+		{
+			name:    "a bad name in a YAML map",
+			format:  VariableFormatYAML,
+			data:    "my var: 1\n",
+			wantErr: "isn't a valid template variable name",
+		},
+		{
+			name:    "an unknown format",
+			format:  "toml",
+			wantErr: "isn't a variable format",
+		},
+	}
+	for _, test := range tests {
+		variables, err := ReadVariables([]byte(test.data), test.format)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: ReadVariables() = %v, want an error containing %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ReadVariables() = %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(variables, test.want) {
+			t.Errorf("%s: ReadVariables() = %+v, want %+v", test.name, variables, test.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package failure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kind : what went wrong, which decides the exit code of kube-deploy
+type Kind int
+
+// The kinds of failure, each with its own exit code
+const (
+	Unknown        Kind = iota // Anything else, eg. an error from the Kubernetes API
+	Config                     // The deploy.yaml, flags or environment are wrong
+	Build                      // Building or pushing the Docker image failed
+	Test                       // The build tests failed
+	LockHeld                   // Someone else is rolling out (or rollouts are blocked)
+	RolloutAborted             // The rollout stopped without making the previous release live again
+	RolledBack                 // The rollout stopped, and the previous release was made live again
+	PolicyDenied               // A policy doesn't allow what was asked for
+	Cancelled                  // You said no when asked to go on, which isn't really a failure
+	Interrupted                // Stopped by SIGINT or SIGTERM, with nothing to bail out of
+)
+
+var exitCodes = map[Kind]int{
+	Unknown:        1,
+	Config:         2,
+	Build:          3,
+	Test:           4,
+	LockHeld:       5,
+	RolloutAborted: 6,
+	RolledBack:     7,
+	PolicyDenied:   8,
+	Cancelled:      0,
+	Interrupted:    130,
+}
+
+// Error : a failure of a known kind, with the friendly message to show for it
+type Error struct {
+	Kind    Kind
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New creates an Error of the given kind
+func New(kind Kind, format string, a ...interface{}) error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, a...)}
+}
+
+// Wrap creates an Error of the given kind caused by err, or returns nil if err is nil
+func Wrap(kind Kind, err error, format string, a ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, a...), Err: err}
+}
+
+// KindOf finds the kind of the outermost Error in err's chain, or Unknown if there isn't one
+func KindOf(err error) Kind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return Unknown
+}
+
+// Is reports whether err is an Error of the given kind
+func Is(err error, kind Kind) bool {
+	return err != nil && KindOf(err) == kind
+}
+
+// ExitCode is the exit code kube-deploy should finish with after err (0 if there's no error)
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	return exitCodes[KindOf(err)]
+}
@@ -0,0 +1,55 @@
+package failure
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"no error", nil, 0},
+		{"a plain error", errors.New("boom"), 1},
+		{"unknown", New(Unknown, "boom"), 1},
+		{"config", New(Config, "bad deploy.yaml"), 2},
+		{"build", New(Build, "docker build failed"), 3},
+		{"test", New(Test, "tests failed"), 4},
+		{"lock held", New(LockHeld, "someone else is rolling out"), 5},
+		{"rollout aborted", New(RolloutAborted, "hook failed"), 6},
+		{"rolled back", New(RolledBack, "canary failed"), 7},
+		{"policy denied", New(PolicyDenied, "not allowed"), 8},
+		{"cancelled", New(Cancelled, "you said no"), 0},
+		{"interrupted", New(Interrupted, "Ctrl-C"), 130},
+		{"wrapping a plain error", Wrap(Build, errors.New("exit status 1"), "docker build failed"), 3},
+		{"the outermost kind wins", Wrap(RolledBack, New(Test, "smoke test failed"), "bailed out"), 7},
+		{"wrapped by fmt", fmt.Errorf("app api: %w", New(LockHeld, "locked")), 5},
+		{"wrapped by fmt without %w", fmt.Errorf("app api: %v", New(LockHeld, "locked")), 1},
+	}
+	for _, test := range tests {
+		if got := ExitCode(test.err); got != test.want {
+			t.Errorf("%s: ExitCode(%v) = %d, want %d", test.name, test.err, got, test.want)
+		}
+	}
+}
+
+func TestWrap(t *testing.T) {
+	if err := Wrap(Config, nil, "nothing went wrong"); err != nil {
+		t.Errorf("Wrap(nil) = %v, want nil", err)
+	}
+
+	cause := errors.New("no such file")
+	err := Wrap(Config, cause, "Couldn't read %s", "deploy.yaml")
+	if got, want := err.Error(), "Couldn't read deploy.yaml: no such file"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	if !errors.Is(err, cause) {
+		t.Error("the cause can't be unwrapped")
+	}
+	if !Is(err, Config) || Is(err, Build) || Is(nil, Unknown) {
+		t.Error("Is() doesn't match the kind")
+	}
+}
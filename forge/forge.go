@@ -0,0 +1,184 @@
+package forge
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/config"
+	"github.com/mycujoo/kube-deploy/logger"
+)
+
+// The deployment states, named as GitHub names them (and mapped onto the GitLab equivalents)
+const (
+	StateInProgress = "in_progress"
+	StateSuccess    = "success"
+	StateFailure    = "failure"
+	StateInactive   = "inactive"
+)
+
+var gitlabStates = map[string]string{
+	StateInProgress: "running",
+	StateSuccess:    "success",
+	StateFailure:    "failed",
+	StateInactive:   "canceled",
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// StartDeployment creates a deployment record for the current commit in the configured forge, and marks it as in progress.
+// Returns the ID of the record, or "" if no forge is configured or it couldn't be created.
+func StartDeployment(repoConfig config.RepoConfigMap) string {
+	settings := repoConfig.DeploymentStatus
+	if settings.Provider == "" {
+		return ""
+	}
+	fullSHA := strings.TrimSpace(cli.GetCommandOutput("git", "rev-parse HEAD"))
+
+	var id string
+	var err error
+	switch settings.Provider {
+	case "github":
+		var response struct {
+			ID int64 `json:"id"`
+		}
+		err = request(repoConfig, "POST", fmt.Sprintf("/repos/%s/deployments", settings.Repository), map[string]interface{}{
+			"ref":               fullSHA,
+			"environment":       repoConfig.Namespace,
+			"description":       "Rollout of " + repoConfig.ReleaseName,
+			"auto_merge":        false,
+			"required_contexts": []string{},
+		}, &response)
+		id = strconv.FormatInt(response.ID, 10)
+	case "gitlab":
+		var response struct {
+			ID int64 `json:"id"`
+		}
+		err = request(repoConfig, "POST", fmt.Sprintf("/projects/%s/deployments", url.PathEscape(settings.Repository)), map[string]interface{}{
+			"environment": repoConfig.Namespace,
+			"sha":         fullSHA,
+			"ref":         strings.TrimSpace(cli.GetCommandOutput("git", "rev-parse --abbrev-ref HEAD")),
+			"tag":         false,
+			"status":      gitlabStates[StateInProgress],
+		}, &response)
+		id = strconv.FormatInt(response.ID, 10)
+	default:
+		err = fmt.Errorf("unknown provider '%s'", settings.Provider)
+	}
+
+	if err != nil {
+		logger.Warn("=> I couldn't create a deployment record in the forge: %s", err)
+		return ""
+	}
+	logger.Info("=> Created deployment %s in %s.\n", id, settings.Provider)
+
+	if settings.Provider == "github" {
+		UpdateDeploymentStatus(repoConfig, id, StateInProgress)
+	}
+	return id
+}
+
+// UpdateDeploymentStatus sets the state of a deployment record created by StartDeployment
+func UpdateDeploymentStatus(repoConfig config.RepoConfigMap, id string, state string) {
+	settings := repoConfig.DeploymentStatus
+	if settings.Provider == "" || id == "" {
+		return
+	}
+
+	var err error
+	switch settings.Provider {
+	case "github":
+		err = request(repoConfig, "POST", fmt.Sprintf("/repos/%s/deployments/%s/statuses", settings.Repository, id), map[string]interface{}{
+			"state":           state,
+			"environment":     repoConfig.Namespace,
+			"environment_url": environmentURL(repoConfig),
+			"description":     fmt.Sprintf("%s: %s", repoConfig.ReleaseName, strings.Replace(state, "_", " ", -1)),
+		}, nil)
+	case "gitlab":
+		err = request(repoConfig, "PUT", fmt.Sprintf("/projects/%s/deployments/%s", url.PathEscape(settings.Repository), id), map[string]interface{}{
+			"status": gitlabStates[state],
+		}, nil)
+	}
+
+	if err != nil {
+		logger.Warn("=> I couldn't set deployment %s to '%s' in the forge: %s\n", id, state, err)
+		return
+	}
+	logger.Info("=> Set deployment %s to '%s' in %s.\n", id, state, settings.Provider)
+}
+
+// The environment URL can use the RepoConfigMap fields, eg. 'https://{{.GitBranch}}.dev.company.com'
+func environmentURL(repoConfig config.RepoConfigMap) string {
+	tmpl, err := template.New("environmentURL").Parse(repoConfig.DeploymentStatus.EnvironmentURL)
+	if err != nil {
+		return ""
+	}
+	var urlBuf bytes.Buffer
+	if err := tmpl.Execute(&urlBuf, repoConfig); err != nil {
+		return ""
+	}
+	return urlBuf.String()
+}
+
+func request(repoConfig config.RepoConfigMap, method string, path string, body interface{}, response interface{}) error {
+	settings := repoConfig.DeploymentStatus
+
+	apiURL := settings.APIURL
+	tokenEnvVar := settings.TokenEnvVar
+	switch settings.Provider {
+	case "github":
+		if apiURL == "" {
+			apiURL = "https://api.github.com"
+		}
+		if tokenEnvVar == "" {
+			tokenEnvVar = "GITHUB_TOKEN"
+		}
+	case "gitlab":
+		if apiURL == "" {
+			apiURL = "https://gitlab.com/api/v4"
+		}
+		if tokenEnvVar == "" {
+			tokenEnvVar = "GITLAB_TOKEN"
+		}
+	}
+
+	token := os.Getenv(tokenEnvVar)
+	logger.AddSecret(token)
+
+	jsonBytes, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(apiURL, "/")+path, bytes.NewReader(jsonBytes))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if settings.Provider == "github" {
+		req.Header.Set("Accept", "application/vnd.github+json")
+		req.Header.Set("Authorization", "token "+token)
+	} else {
+		req.Header.Set("PRIVATE-TOKEN", token)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("the API responded with status %s", resp.Status)
+	}
+	if response != nil {
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+	return nil
+}
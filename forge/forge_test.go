@@ -0,0 +1,158 @@
+package forge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/mycujoo/kube-deploy/config"
+)
+
+type forgeRequest struct {
+	method  string
+	path    string
+	headers http.Header
+	body    map[string]interface{}
+}
+
+// A fake forge API, recording each request it gets and answering with the given status and body
+type fakeForge struct {
+	*httptest.Server
+	status   int
+	response string
+
+	mutex    sync.Mutex
+	requests []forgeRequest
+}
+
+func newFakeForge(t *testing.T, status int, response string) *fakeForge {
+	f := &fakeForge{status: status, response: response}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.mutex.Lock()
+		f.requests = append(f.requests, forgeRequest{r.Method, r.URL.EscapedPath(), r.Header, body})
+		f.mutex.Unlock()
+		w.WriteHeader(f.status)
+		w.Write([]byte(f.response))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func forgeRepoConfig(provider string, apiURL string, repository string) config.RepoConfigMap {
+	var repoConfig config.RepoConfigMap
+	repoConfig.Namespace = "production"
+	repoConfig.ReleaseName = "api-master-abc1234"
+	repoConfig.GitBranch = "master"
+	repoConfig.DeploymentStatus.Provider = provider
+	repoConfig.DeploymentStatus.APIURL = apiURL
+	repoConfig.DeploymentStatus.Repository = repository
+	repoConfig.DeploymentStatus.EnvironmentURL = "https://{{.GitBranch}}.example.com"
+	return repoConfig
+}
+
+func TestStartDeploymentGitHub(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "gh-token")
+	forge := newFakeForge(t, http.StatusCreated, `{"id": 42}`)
+	repoConfig := forgeRepoConfig("github", forge.URL+"/", "mycujoo/api")
+
+	if id := StartDeployment(repoConfig); id != "42" {
+		t.Fatalf("StartDeployment() = %q, want \"42\"", id)
+	}
+	if len(forge.requests) != 2 {
+		t.Fatalf("got %d requests, want the deployment and its in_progress status", len(forge.requests))
+	}
+
+	create := forge.requests[0]
+	if create.method != "POST" || create.path != "/repos/mycujoo/api/deployments" {
+		t.Errorf("created the deployment with %s %s", create.method, create.path)
+	}
+	if got := create.headers.Get("Authorization"); got != "token gh-token" {
+		t.Errorf("Authorization = %q, want \"token gh-token\"", got)
+	}
+	if create.body["environment"] != "production" || create.body["auto_merge"] != false {
+		t.Errorf("deployment body = %v", create.body)
+	}
+
+	status := forge.requests[1]
+	if status.method != "POST" || status.path != "/repos/mycujoo/api/deployments/42/statuses" {
+		t.Errorf("set the status with %s %s", status.method, status.path)
+	}
+	if status.body["state"] != StateInProgress || status.body["environment_url"] != "https://master.example.com" {
+		t.Errorf("status body = %v", status.body)
+	}
+}
+
+func TestStartDeploymentGitLab(t *testing.T) {
+	t.Setenv("DEPLOY_TOKEN", "gl-token")
+	forge := newFakeForge(t, http.StatusCreated, `{"id": 7}`)
+	repoConfig := forgeRepoConfig("gitlab", forge.URL, "mycujoo/backend/api")
+	repoConfig.DeploymentStatus.TokenEnvVar = "DEPLOY_TOKEN"
+
+	if id := StartDeployment(repoConfig); id != "7" {
+		t.Fatalf("StartDeployment() = %q, want \"7\"", id)
+	}
+	// GitLab creates the deployment as running, so there's no separate status update
+	if len(forge.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(forge.requests))
+	}
+	create := forge.requests[0]
+	if create.path != "/projects/mycujoo%2Fbackend%2Fapi/deployments" {
+		t.Errorf("created the deployment at %s, want the project path escaped", create.path)
+	}
+	if got := create.headers.Get("PRIVATE-TOKEN"); got != "gl-token" {
+		t.Errorf("PRIVATE-TOKEN = %q, want \"gl-token\"", got)
+	}
+	if create.body["status"] != "running" {
+		t.Errorf("deployment body = %v", create.body)
+	}
+}
+
+func TestUpdateDeploymentStatusGitLab(t *testing.T) {
+	tests := []struct {
+		state      string
+		wantStatus string
+	}{
+		{StateSuccess, "success"},
+		{StateFailure, "failed"},
+		{StateInactive, "canceled"},
+	}
+	for _, test := range tests {
+		forge := newFakeForge(t, http.StatusOK, `{}`)
+		UpdateDeploymentStatus(forgeRepoConfig("gitlab", forge.URL, "mycujoo/api"), "7", test.state)
+		if len(forge.requests) != 1 {
+			t.Fatalf("%s: got %d requests, want 1", test.state, len(forge.requests))
+		}
+		request := forge.requests[0]
+		if request.method != "PUT" || request.path != "/projects/mycujoo%2Fapi/deployments/7" {
+			t.Errorf("%s: updated the deployment with %s %s", test.state, request.method, request.path)
+		}
+		if request.body["status"] != test.wantStatus {
+			t.Errorf("%s: status = %v, want %q", test.state, request.body["status"], test.wantStatus)
+		}
+	}
+}
+
+func TestForgeErrors(t *testing.T) {
+	forge := newFakeForge(t, http.StatusUnauthorized, `{"message": "Bad credentials"}`)
+	if id := StartDeployment(forgeRepoConfig("github", forge.URL, "mycujoo/api")); id != "" {
+		t.Errorf("StartDeployment() with a failing API = %q, want \"\"", id)
+	}
+	if len(forge.requests) != 1 {
+		t.Errorf("got %d requests, want only the failed deployment", len(forge.requests))
+	}
+
+	if id := StartDeployment(forgeRepoConfig("bitbucket", forge.URL, "mycujoo/api")); id != "" {
+		t.Errorf("StartDeployment() with an unknown provider = %q, want \"\"", id)
+	}
+	if id := StartDeployment(forgeRepoConfig("", forge.URL, "mycujoo/api")); id != "" {
+		t.Errorf("StartDeployment() without a provider = %q, want \"\"", id)
+	}
+	UpdateDeploymentStatus(forgeRepoConfig("github", forge.URL, "mycujoo/api"), "", StateSuccess)
+	if len(forge.requests) != 1 {
+		t.Errorf("got %d requests, want none without a provider or a deployment ID", len(forge.requests))
+	}
+}
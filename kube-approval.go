@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/kube/api"
+	"github.com/mycujoo/kube-deploy/logger"
+
+	"k8s.io/api/extensions/v1beta1"
+)
+
+const approvalHistoryAnnotation = "kubedeploy-approvals"
+
+// How a canary point gets approved
+const (
+	approvalModeInteractive       = "interactive"             // Ask at the terminal (default)
+	approvalModeAutoAfterHold     = "auto-after-hold"         // Proceed automatically once the hold time has passed
+	approvalModeAutomatedAnalysis = "automated-analysis-only" // Proceed once the hold time has passed, if the smoke tests pass again
+	approvalModeExternal          = "external-approval"       // Wait for someone to run 'approve' or 'reject'
+)
+
+// The '--approval-mode' flag takes priority over the deploy.yaml
+func approvalMode() string {
+	if mode := runFlags.String("approval-mode"); mode != "" {
+		return mode
+	}
+	if repoConfig.Rollout.ApprovalMode != "" {
+		return repoConfig.Rollout.ApprovalMode
+	}
+	return approvalModeInteractive
+}
+
+// Makes sure the approval mode can work before anything is changed
+func checkApprovalMode() error {
+	switch mode := approvalMode(); mode {
+	case approvalModeInteractive, approvalModeAutoAfterHold:
+	case approvalModeExternal:
+		settings := repoConfig.Rollout.Approval
+		if settings.ListenAddress == "" {
+			break
+		}
+		if settings.PublicURL == "" {
+			return failure.New(failure.Config, "The approval endpoint needs a 'publicURL' in the deploy.yaml, so the links it posts can be followed.")
+		}
+		if len(settings.Approvers) > 0 && os.Getenv(cli.ApprovalSecretEnvVar) == "" {
+			return failure.New(failure.Config, "With 'approvers', the approval endpoint needs $%s to check who's approving - without it, anyone with the link could.", cli.ApprovalSecretEnvVar)
+		}
+	case approvalModeAutomatedAnalysis:
+		if len(repoConfig.SmokeTests) == 0 {
+			return failure.New(failure.Config, "The approval mode '%s' needs some 'smokeTests' in the deploy.yaml to analyse the canary with.", mode)
+		}
+	default:
+		return failure.New(failure.Config, "Uh oh - the approval mode '%s' isn't recognised. It should be one of: %s, %s, %s, %s.",
+			mode, approvalModeInteractive, approvalModeAutoAfterHold, approvalModeAutomatedAnalysis, approvalModeExternal)
+	}
+	return nil
+}
+
+func holdAtCanaryPoint(waitTimeSeconds int) error {
+	logger.Info("=> Holding at the canary point for %d seconds before proceeding.\n", waitTimeSeconds)
+	return cli.Sleep(time.Duration(waitTimeSeconds) * time.Second)
+}
+
+// Started at the first canary point which needs it, then shared by the rest
+var approvalServer *cli.ApprovalServer
+
+// How long to wait for a decision at a canary point, unless the deploy.yaml says otherwise
+const defaultApprovalTimeoutSeconds = 3600
+
+// Waits until someone has approved or rejected the canary point, and the hold time has passed - bailing out if no
+// one decides in time
+func waitForExternalApproval(waitTimeSeconds int, deployment *v1beta1.Deployment) (bool, error) {
+	holdUntil := time.Now().Add(time.Duration(waitTimeSeconds) * time.Second)
+	timeoutSeconds := repoConfig.Rollout.Approval.TimeoutSeconds
+	if timeoutSeconds == 0 {
+		timeoutSeconds = defaultApprovalTimeoutSeconds
+	}
+	giveUpAt := time.Now().Add(time.Duration(timeoutSeconds) * time.Second)
+	if err := cli.ClearApproval(repoConfig.Application.Name); err != nil {
+		return false, err
+	}
+	logger.Info("=> Waiting for approval. Run 'kube-deploy approve' or 'kube-deploy reject' for %s to continue.\n", deployment.Name)
+	if err := requestRemoteApproval(deployment); err != nil {
+		return false, err
+	}
+
+	for {
+		decided, approved, approver, err := cli.ReadApproval(repoConfig.Application.Name)
+		if err != nil {
+			return false, err
+		}
+		if decided {
+			if err := cli.ClearApproval(repoConfig.Application.Name); err != nil {
+				return false, err
+			}
+			kubeRecordApproval(deployment.Name, approver, approved)
+			if !approved {
+				logger.Info("=> The canary point was rejected by %s.\n", approver)
+				return false, nil
+			}
+			logger.Info("=> The canary point was approved by %s.\n", approver)
+			if wait := time.Until(holdUntil); wait > 0 {
+				logger.Info("=> Waiting another %d seconds until the hold time has passed.\n", int(wait.Seconds()))
+				if err := cli.Sleep(wait); err != nil {
+					return false, err
+				}
+			}
+			return true, nil
+		}
+		if time.Now().After(giveUpAt) {
+			return false, failure.New(failure.RolloutAborted, "No one approved or rejected the canary point within %d seconds, so I'm bailing out", timeoutSeconds)
+		}
+		if err := cli.Sleep(5 * time.Second); err != nil {
+			return false, err
+		}
+	}
+}
+
+// Posts the approve and reject links to the configured webhook, if the approval endpoint is enabled
+func requestRemoteApproval(deployment *v1beta1.Deployment) error {
+	settings := repoConfig.Rollout.Approval
+	if settings.ListenAddress == "" {
+		return nil
+	}
+	if approvalServer == nil {
+		server, err := cli.StartApprovalServer(settings.ListenAddress, repoConfig.Application.Name, settings.Approvers, os.Getenv(cli.ApprovalSecretEnvVar))
+		if err != nil {
+			return err
+		}
+		approvalServer = server
+	}
+
+	token, err := approvalServer.NewToken()
+	if err != nil {
+		return err
+	}
+	approveURL := fmt.Sprintf("%s/approve?token=%s", strings.TrimSuffix(settings.PublicURL, "/"), token)
+	rejectURL := fmt.Sprintf("%s/reject?token=%s", strings.TrimSuffix(settings.PublicURL, "/"), token)
+	logger.Info("=> You can also approve at %s or reject at %s\n", approveURL, rejectURL)
+
+	if settings.WebhookURL != "" {
+		message := fmt.Sprintf("The rollout of %s to %s is waiting at a canary point.\nApprove: %s\nReject: %s",
+			deployment.Name, repoConfig.Namespace, approveURL, rejectURL)
+		if err := cli.PostApprovalRequest(settings.WebhookURL, message); err != nil {
+			logger.Warn("=> I couldn't post the approval request to the webhook: %s", err)
+		}
+	}
+	return nil
+}
+
+// Prints the token an approver gives with their name to approve remotely
+func printApprovalToken(approver string) error {
+	secret := os.Getenv(cli.ApprovalSecretEnvVar)
+	if secret == "" {
+		return failure.New(failure.Config, "Uh oh, $%s isn't set - it needs to be the same secret the deployment server uses.", cli.ApprovalSecretEnvVar)
+	}
+	fmt.Println(cli.ApprovalToken(secret, approver))
+	return nil
+}
+
+// Keeps a history of canary point decisions on the Deployment, so 'kubectl describe' shows who approved the rollout
+func kubeRecordApproval(deploymentName string, approver string, approved bool) {
+	decision := "rejected"
+	if approved {
+		decision = "approved"
+	}
+	entry := fmt.Sprintf("%s: %s by %s", time.Now().Format("Jan _2 15:04:05"), decision, approver)
+
+	if _, err := kubeapi.UpdateDeployment(deploymentName, func(deployment *v1beta1.Deployment) {
+		if deployment.Annotations == nil {
+			deployment.Annotations = make(map[string]string)
+		}
+		history := entry
+		if previous := deployment.Annotations[approvalHistoryAnnotation]; previous != "" {
+			history = previous + "\n" + entry
+		}
+		deployment.Annotations[approvalHistoryAnnotation] = history
+	}); err != nil {
+		// The decision still counts, even if it couldn't be kept on the Deployment
+		logger.Warn("=> I couldn't record the decision on %s: %s\n", deploymentName, err)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/kube/api"
+	"github.com/mycujoo/kube-deploy/logger"
+
+	yamlnodes "gopkg.in/yaml.v3"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+)
+
+// The original HPA limits are kept on the HPA itself, so they survive kube-deploy being interrupted mid-rollout
+const (
+	originalMinReplicasAnnotation = "kubedeploy-original-min-replicas"
+	originalMaxReplicasAnnotation = "kubedeploy-original-max-replicas"
+)
+
+// Returns true if either of the named Deployments is targeted by a HorizontalPodAutoscaler
+func kubeIsAutoscaled(deploymentNames ...string) (bool, error) {
+	for _, name := range deploymentNames {
+		if name == "" {
+			continue
+		}
+		hpa, err := kubeapi.GetHPAForDeployment(name)
+		if err != nil {
+			return false, err
+		}
+		if hpa != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Fixes the HPA targeting the Deployment to exactly the given number of replicas, so it doesn't fight the canary scaling
+func kubePinAutoscaler(deploymentName string, replicas int32) error {
+	hpa, err := kubeapi.GetHPAForDeployment(deploymentName)
+	if err != nil || hpa == nil {
+		return err
+	}
+
+	logger.Info("=> Pinning the HorizontalPodAutoscaler %s to %d replica(s).\n", hpa.Name, replicas)
+	_, err = kubeapi.UpdateHPA(hpa.Name, func(hpa *autoscalingv1.HorizontalPodAutoscaler) {
+		if hpa.Annotations == nil {
+			hpa.Annotations = make(map[string]string)
+		}
+		// Only save the limits the first time, otherwise we'd be saving our own pinned values
+		if _, alreadyPinned := hpa.Annotations[originalMaxReplicasAnnotation]; !alreadyPinned {
+			if hpa.Spec.MinReplicas != nil {
+				hpa.Annotations[originalMinReplicasAnnotation] = strconv.Itoa(int(*hpa.Spec.MinReplicas))
+			}
+			hpa.Annotations[originalMaxReplicasAnnotation] = strconv.Itoa(int(hpa.Spec.MaxReplicas))
+		}
+		hpa.Spec.MinReplicas = &replicas
+		hpa.Spec.MaxReplicas = replicas
+	})
+	return err
+}
+
+// Pins the HPAs in the templated files which target the Deployment before they're applied, so they're created pinned -
+// otherwise they'd already be scaling the new release by the time kubePinAutoscaler got to them
+func kubePinTemplatedAutoscalers(templates []string, deploymentName string, replicas int32) error {
+	for _, file := range templates {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			return failure.Wrap(failure.Unknown, err, "Couldn't read the templated file %s", file)
+		}
+		pinned, changed, err := pinAutoscalerDocuments(contents, deploymentName, replicas)
+		if err != nil {
+			return failure.Wrap(failure.Config, err, "Uh oh, the templated file %s isn't valid YAML", file)
+		}
+		if !changed {
+			continue
+		}
+		if err := ioutil.WriteFile(file, pinned, 0644); err != nil {
+			return failure.Wrap(failure.Unknown, err, "Couldn't write the templated file %s", file)
+		}
+	}
+	return nil
+}
+
+// Pins each HPA document targeting the Deployment in the same way kubePinAutoscaler does, leaving the rest alone
+func pinAutoscalerDocuments(contents []byte, deploymentName string, replicas int32) ([]byte, bool, error) {
+	decoder := yamlnodes.NewDecoder(bytes.NewReader(contents))
+	var documents []*yamlnodes.Node
+	changed := false
+	for {
+		document := &yamlnodes.Node{}
+		err := decoder.Decode(document)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if len(document.Content) == 0 {
+			continue
+		}
+		if pinAutoscalerDocument(document.Content[0], deploymentName, replicas) {
+			logger.Info("=> Pinning the HorizontalPodAutoscaler %s to %d replica(s) before it's created.\n", nodeValue(document.Content[0], "metadata", "name"), replicas)
+			changed = true
+		}
+		documents = append(documents, document)
+	}
+	if !changed {
+		return contents, false, nil
+	}
+
+	var pinned bytes.Buffer
+	encoder := yamlnodes.NewEncoder(&pinned)
+	encoder.SetIndent(2)
+	for _, document := range documents {
+		if err := encoder.Encode(document); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, false, err
+	}
+	return pinned.Bytes(), true, nil
+}
+
+func pinAutoscalerDocument(object *yamlnodes.Node, deploymentName string, replicas int32) bool {
+	if nodeValue(object, "kind") != "HorizontalPodAutoscaler" ||
+		nodeValue(object, "spec", "scaleTargetRef", "kind") != "Deployment" ||
+		nodeValue(object, "spec", "scaleTargetRef", "name") != deploymentName {
+		return false
+	}
+	spec := childMapping(object, "spec")
+	annotations := childMapping(childMapping(object, "metadata"), "annotations")
+	if nodeValue(annotations, originalMaxReplicasAnnotation) == "" {
+		if minReplicas := nodeValue(spec, "minReplicas"); minReplicas != "" {
+			setMappingValue(annotations, originalMinReplicasAnnotation, &yamlnodes.Node{Kind: yamlnodes.ScalarNode, Tag: "!!str", Value: minReplicas})
+		}
+		setMappingValue(annotations, originalMaxReplicasAnnotation, &yamlnodes.Node{Kind: yamlnodes.ScalarNode, Tag: "!!str", Value: nodeValue(spec, "maxReplicas")})
+	}
+	pinnedReplicas := strconv.Itoa(int(replicas))
+	setMappingValue(spec, "minReplicas", &yamlnodes.Node{Kind: yamlnodes.ScalarNode, Tag: "!!int", Value: pinnedReplicas})
+	setMappingValue(spec, "maxReplicas", &yamlnodes.Node{Kind: yamlnodes.ScalarNode, Tag: "!!int", Value: pinnedReplicas})
+	return true
+}
+
+// The value of the scalar at the path of keys through nested mappings, or "" if there isn't one
+func nodeValue(node *yamlnodes.Node, keys ...string) string {
+	for _, key := range keys {
+		node = mappingValue(node, key)
+	}
+	if node == nil || node.Kind != yamlnodes.ScalarNode {
+		return ""
+	}
+	return node.Value
+}
+
+func mappingValue(mapping *yamlnodes.Node, key string) *yamlnodes.Node {
+	if mapping == nil || mapping.Kind != yamlnodes.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// The mapping under the key, which is added (or replaces whatever else was there) if needed
+func childMapping(mapping *yamlnodes.Node, key string) *yamlnodes.Node {
+	if child := mappingValue(mapping, key); child != nil && child.Kind == yamlnodes.MappingNode {
+		return child
+	}
+	child := &yamlnodes.Node{Kind: yamlnodes.MappingNode, Tag: "!!map"}
+	setMappingValue(mapping, key, child)
+	return child
+}
+
+func setMappingValue(mapping *yamlnodes.Node, key string, value *yamlnodes.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content, &yamlnodes.Node{Kind: yamlnodes.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// Puts back the limits the HPA targeting the Deployment had before it was pinned
+func kubeRestoreAutoscaler(deploymentName string) error {
+	hpa, err := kubeapi.GetHPAForDeployment(deploymentName)
+	if err != nil || hpa == nil {
+		return err
+	}
+	if _, pinned := hpa.Annotations[originalMaxReplicasAnnotation]; !pinned {
+		return nil
+	}
+
+	logger.Info("=> Restoring autoscaling for the HorizontalPodAutoscaler %s.\n", hpa.Name)
+	_, err = kubeapi.UpdateHPA(hpa.Name, func(hpa *autoscalingv1.HorizontalPodAutoscaler) {
+		if minReplicas, err := strconv.ParseInt(hpa.Annotations[originalMinReplicasAnnotation], 10, 32); err == nil {
+			min := int32(minReplicas)
+			hpa.Spec.MinReplicas = &min
+		} else {
+			hpa.Spec.MinReplicas = nil
+		}
+		if maxReplicas, err := strconv.ParseInt(hpa.Annotations[originalMaxReplicasAnnotation], 10, 32); err == nil {
+			hpa.Spec.MaxReplicas = int32(maxReplicas)
+		}
+		delete(hpa.Annotations, originalMinReplicasAnnotation)
+		delete(hpa.Annotations, originalMaxReplicasAnnotation)
+	})
+	return err
+}
+
+// Hands autoscaling over to the Deployment which is now live, and restores the limits of any pinned HPAs.
+// An HPA left targeting the retired Deployment is harmless, since autoscaling is disabled for Deployments at zero replicas.
+func kubeReleaseAutoscalers(liveDeploymentName string, retiredDeploymentName string) error {
+	if liveDeploymentName == "" {
+		return kubeRestoreAutoscaler(retiredDeploymentName)
+	}
+
+	liveHPA, err := kubeapi.GetHPAForDeployment(liveDeploymentName)
+	if err != nil {
+		return err
+	}
+	if liveHPA == nil && retiredDeploymentName != "" {
+		hpa, err := kubeapi.GetHPAForDeployment(retiredDeploymentName)
+		if err != nil {
+			return err
+		}
+		if hpa != nil {
+			logger.Info("=> Handing the HorizontalPodAutoscaler %s over to %s.\n", hpa.Name, liveDeploymentName)
+			if _, err := kubeapi.UpdateHPA(hpa.Name, func(hpa *autoscalingv1.HorizontalPodAutoscaler) {
+				hpa.Spec.ScaleTargetRef.Name = liveDeploymentName
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := kubeRestoreAutoscaler(liveDeploymentName); err != nil {
+		return err
+	}
+	if retiredDeploymentName != "" {
+		return kubeRestoreAutoscaler(retiredDeploymentName)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	yamlnodes "gopkg.in/yaml.v3"
+)
+
+func TestPinAutoscalerDocuments(t *testing.T) {
+	const deployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api-master-abc1234
+spec:
+  replicas: 3
+`
+	const hpa = `apiVersion: autoscaling/v2
+kind: HorizontalPodAutoscaler
+metadata:
+  name: api
+spec:
+  scaleTargetRef:
+    apiVersion: apps/v1
+    kind: Deployment
+    name: api-master-abc1234
+  minReplicas: 2
+  maxReplicas: 10
+  metrics:
+  - type: Resource
+    resource:
+      name: cpu
+      target:
+        type: Utilization
+        averageUtilization: 70
+`
+
+	tests := []struct {
+		name        string
+		contents    string
+		wantChanged bool
+		wantHPA     map[string]interface{} // What the HPA's annotations and replica limits end up as
+	}{
+		{
+			name:     "no HPA",
+			contents: deployment,
+		},
+		{
+			name:     "an HPA for another Deployment",
+			contents: strings.Replace(hpa, "name: api-master-abc1234", "name: api-master-0000000", 1),
+		},
+		{
+			name:        "an HPA on its own",
+			contents:    hpa,
+			wantChanged: true,
+			wantHPA: map[string]interface{}{
+				"annotations": map[string]interface{}{originalMinReplicasAnnotation: "2", originalMaxReplicasAnnotation: "10"},
+				"minReplicas": 1,
+				"maxReplicas": 1,
+			},
+		},
+		{
+			name:        "an HPA with a Deployment",
+			contents:    deployment + "---\n" + hpa,
+			wantChanged: true,
+			wantHPA: map[string]interface{}{
+				"annotations": map[string]interface{}{originalMinReplicasAnnotation: "2", originalMaxReplicasAnnotation: "10"},
+				"minReplicas": 1,
+				"maxReplicas": 1,
+			},
+		},
+		{
+			name:        "an HPA without minReplicas",
+			contents:    strings.Replace(hpa, "  minReplicas: 2\n", "", 1),
+			wantChanged: true,
+			wantHPA: map[string]interface{}{
+				"annotations": map[string]interface{}{originalMaxReplicasAnnotation: "10"},
+				"minReplicas": 1,
+				"maxReplicas": 1,
+			},
+		},
+		{
+			name:        "an HPA which is already pinned",
+			contents:    strings.Replace(hpa, "  name: api\n", "  name: api\n  annotations:\n    team: video\n    "+originalMinReplicasAnnotation+": \"4\"\n    "+originalMaxReplicasAnnotation+": \"20\"\n", 1),
+			wantChanged: true,
+			wantHPA: map[string]interface{}{
+				"annotations": map[string]interface{}{"team": "video", originalMinReplicasAnnotation: "4", originalMaxReplicasAnnotation: "20"},
+				"minReplicas": 1,
+				"maxReplicas": 1,
+			},
+		},
+	}
+	for _, test := range tests {
+		pinned, changed, err := pinAutoscalerDocuments([]byte(test.contents), "api-master-abc1234", 1)
+		if err != nil {
+			t.Errorf("%s: pinAutoscalerDocuments() = %v", test.name, err)
+			continue
+		}
+		if changed != test.wantChanged {
+			t.Errorf("%s: changed = %v, want %v", test.name, changed, test.wantChanged)
+		}
+		if !changed {
+			if string(pinned) != test.contents {
+				t.Errorf("%s: the contents changed to %q", test.name, pinned)
+			}
+			continue
+		}
+
+		documents := decodeDocuments(t, pinned)
+		if len(documents) != len(regexp.MustCompile(`(?m)^kind:`).FindAllString(test.contents, -1)) {
+			t.Errorf("%s: got %d documents back", test.name, len(documents))
+		}
+		for _, document := range documents {
+			if document["kind"] != "HorizontalPodAutoscaler" {
+				continue
+			}
+			metadata := document["metadata"].(map[string]interface{})
+			spec := document["spec"].(map[string]interface{})
+			got := map[string]interface{}{"annotations": metadata["annotations"], "minReplicas": spec["minReplicas"], "maxReplicas": spec["maxReplicas"]}
+			if !reflect.DeepEqual(got, test.wantHPA) {
+				t.Errorf("%s: the HPA ended up with %v, want %v", test.name, got, test.wantHPA)
+			}
+			if _, ok := spec["metrics"]; !ok {
+				t.Errorf("%s: the HPA lost its metrics", test.name)
+			}
+		}
+	}
+}
+
+func decodeDocuments(t *testing.T, contents []byte) []map[string]interface{} {
+	t.Helper()
+	var documents []map[string]interface{}
+	for _, document := range strings.Split(string(contents), "\n---\n") {
+		var decoded map[string]interface{}
+		if err := yamlnodes.Unmarshal([]byte(document), &decoded); err != nil {
+			t.Fatal(err)
+		}
+		documents = append(documents, decoded)
+	}
+	return documents
+}
@@ -2,46 +2,107 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"text/tabwriter"
 	"time"
 
 	"github.com/mycujoo/kube-deploy/build"
 	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/forge"
 	"github.com/mycujoo/kube-deploy/kube/api"
+	"github.com/mycujoo/kube-deploy/logger"
+	"github.com/mycujoo/kube-deploy/notify"
 
 	"k8s.io/api/core/v1"
 	"k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
-func kubeStartRollout() {
+func kubeStartRollout() error {
+	// '--force' only bypasses the lockfile - the canary points are skipped with '--no-canary'
+	skipCanary := runFlags.Bool("no-canary")
+	if !skipCanary {
+		if err := checkApprovalMode(); err != nil {
+			return err
+		}
+	}
 
-	fmt.Println("=> Checking to see if the docker image exists on the remote repository (so we know whether we have to build an image or not).\n=> This might take a minute...")
-	if build.DockerImageExistsRemote() {
-		fmt.Println("=> Looks like an image already exists on the remote, so we'll use that.")
+	// Bad Kubernetes files are better found now than halfway through the rollout
+	if !runFlags.Bool("no-lint") {
+		if err := kubeLint(); err != nil {
+			return err
+		}
+	}
+	if err := kubeCheckPolicies("start-rollout", nil); err != nil {
+		return err
+	}
+
+	logger.Info("=> Checking to see if the docker image exists on the remote repository (so we know whether we have to build an image or not).\n=> This might take a minute...")
+	exists, err := build.DockerImageExistsRemote(repoConfig)
+	if err != nil {
+		return err
+	}
+	if exists {
+		logger.Info("=> Looks like an image already exists on the remote, so we'll use that.")
 	} else {
-		fmt.Println("=> No image exists, so we'll build one now.")
-		build.MakeAndPushBuild(
+		logger.Info("=> No image exists, so we'll build one now.")
+		if err := build.MakeAndPushBuild(
 			runFlags.Bool("force-push-image"),
 			runFlags.Bool("override-dirty-workdir"),
 			runFlags.Bool("keep-test-container"),
 			repoConfig,
-		)
+		); err != nil {
+			return err
+		}
 	}
-	fmt.Print("=> Starting rollout.\n\n")
-	cli.LockBeforeRollout(repoConfig.Application.Name, runFlags.Bool("force"))
+	logger.Info("=> Starting rollout.\n\n")
+	if err := lockBeforeRollout(); err != nil {
+		return err
+	}
+	// From here on, the rollout stops and bails out by itself when it's interrupted, and the workdir and lockfile are
+	// cleaned up however it ends
+	defer cli.HandleAborts()()
+	defer cleanUpAfterRollout()
 
-	skipCanary := runFlags.Bool("no-canary") || runFlags.Bool("force")
+	notify.Send(repoConfig, notify.RolloutStarted, fmt.Sprintf("Started rolling out %s", repoConfig.ReleaseName))
+	forgeID := forge.StartDeployment(repoConfig)
 
-	if existingDeployment := kubeapi.GetSingleDeployment(repoConfig.ReleaseName); existingDeployment.Name != "" {
-		fmt.Println("=> Looks like there is an existing deployment by this name, so we'll just update/replace it.\n")
+	if err := kubeRollout(forgeID, skipCanary); err != nil {
+		if failure.KindOf(err) == failure.Unknown {
+			err = failure.Wrap(failure.RolloutAborted, err, "The rollout of %s didn't finish", repoConfig.ReleaseName)
+		}
+		notify.Send(repoConfig, notify.RolloutBailedOut, err.Error())
+		forge.UpdateDeploymentStatus(repoConfig, forgeID, forge.StateFailure)
+		return err
 	}
 
-	previousReleases := kubeapi.ListDeployments(map[string]string{
+	notify.Send(repoConfig, notify.RolloutCompleted, fmt.Sprintf("Finished rolling out %s", repoConfig.ReleaseName))
+	forge.UpdateDeploymentStatus(repoConfig, forgeID, forge.StateSuccess)
+	kubeRecordEvent(repoConfig.ReleaseName, eventRolloutCompleted, "This release is now live.")
+
+	logger.Info("\n=> You're all done, great job!\n\n")
+	return nil
+}
+
+func kubeRollout(forgeID string, skipCanary bool) error {
+	if _, err := kubeapi.GetSingleDeployment(repoConfig.ReleaseName); err == nil {
+		logger.Info("=> Looks like there is an existing deployment by this name, so we'll just update/replace it.\n")
+	} else if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	previousReleases, err := kubeapi.ListDeployments(map[string]string{
 		"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch})
+	if err != nil {
+		return err
+	}
 	sort.Slice(previousReleases.Items, func(i, j int) bool {
 		return previousReleases.Items[i].CreationTimestamp.Time.Sub(previousReleases.Items[j].CreationTimestamp.Time) > 0
 	})
@@ -54,171 +115,322 @@ func kubeStartRollout() {
 		}
 	}
 
+	// Run the pre-rollout hooks (eg. database migrations) before any traffic shifts to the new release
+	if err := kubeRunHooks("preRollout"); err != nil {
+		if failure.Is(err, failure.Interrupted) {
+			return err
+		}
+		return failure.Wrap(failure.RolloutAborted, err, "Since a pre-rollout hook failed, I'm aborting the rollout before touching any deployments")
+	}
+
 	rolloutStartTime := time.Now()
 	// Make the template files, tag deployment with release ID
-	for _, f := range kubeMakeTemplates() {
+	templates, err := kubeMakeTemplates()
+	if err != nil {
+		return err
+	}
+	firstCanaryPods := int32(1) // First canary point is one pod only
+	if err := kubePinTemplatedAutoscalers(templates, repoConfig.ReleaseName, firstCanaryPods); err != nil {
+		return err
+	}
+
+	// Anything going wrong once the files are being applied means the new release has to make way for the previous one
+	// again. Until the new release's scale is known, the previous one goes back to the scale it's at now.
+	var desiredPods int32
+	if mostRecentRelease.Spec.Replicas != nil {
+		desiredPods = *mostRecentRelease.Spec.Replicas
+	}
+	bailOut := func(cause error) error {
+		return safeBailOut(repoConfig.ReleaseName, mostRecentRelease.Name, desiredPods, cause)
+	}
+	// A file which failed to apply might have been applied in part, so there's only nothing to bail out of while the
+	// new release's Deployment doesn't exist
+	applyFailed := func(cause error) error {
+		if _, err := kubeapi.GetSingleDeployment(repoConfig.ReleaseName); apierrors.IsNotFound(err) {
+			return cause
+		}
+		return bailOut(cause)
+	}
+	for _, f := range templates {
 		exitCode := cli.StreamAndGetCommandExitCode("kubectl", fmt.Sprintf("apply -f %s", f))
+		if err := cli.Aborted(); err != nil {
+			return applyFailed(err)
+		}
 		if exitCode != 0 {
-			fmt.Println("=> Uh oh, there was an problem during templating. You should fix this first.")
-			kubeRemoveTemplates()
-			os.Exit(1)
+			return applyFailed(failure.New(failure.RolloutAborted, "Uh oh, there was an problem applying %s. You should fix this first.", filepath.Base(f)))
 		}
 	}
 	kubeRemoveTemplates()
 
 	// Find the just-created deployment
-	thisDeployment := kubeapi.GetSingleDeployment(repoConfig.ReleaseName)
-	desiredPods := *thisDeployment.Spec.Replicas
-	firstCanaryPods := int32(1) // First canary point is one pod only
+	thisDeployment, err := kubeapi.GetSingleDeployment(repoConfig.ReleaseName)
+	if err != nil {
+		return bailOut(err)
+	}
+	desiredPods = *thisDeployment.Spec.Replicas
+	// When an HPA is in charge, the manifest's replica count is meaningless - match the live scale of the previous release instead,
+	// and pin the HPAs so they don't fight the canary scaling
+	autoscaled, err := kubeIsAutoscaled(thisDeployment.Name, mostRecentRelease.Name)
+	if err != nil {
+		return bailOut(err)
+	}
+	if autoscaled {
+		logger.Info("=> Found a HorizontalPodAutoscaler for this app, so I'll pin it while the rollout is in progress.")
+		if mostRecentRelease.Name != "" {
+			if liveReplicas := *mostRecentRelease.Spec.Replicas; liveReplicas > 0 {
+				logger.Info("=> The previous release is currently running %d pod(s), so the new release will be scaled to match.\n", liveReplicas)
+				desiredPods = liveReplicas
+			}
+			if err := kubePinAutoscaler(mostRecentRelease.Name, desiredPods); err != nil {
+				return bailOut(err)
+			}
+		}
+		if err := kubePinAutoscaler(thisDeployment.Name, firstCanaryPods); err != nil {
+			return bailOut(err)
+		}
+	}
 
 	// Update with release time and firstCanaryPods replicas
-	thisDeployment = kubeapi.UpdateDeployment(thisDeployment.Name, func(deployment *v1beta1.Deployment) {
+	thisDeployment, err = kubeapi.UpdateDeployment(thisDeployment.Name, func(deployment *v1beta1.Deployment) {
 		// Add the 'kubedeploy-releasetime' label (which will force the deployment to recreate pods if it already existed)
 		deployment.Spec.Template.Labels["kubedeploy-releasetime"] = strconv.FormatInt(rolloutStartTime.Unix(), 10)
+		setForgeDeploymentID(deployment, forgeID)
+		setProvenanceAnnotations(deployment)
 
 		// Quickly scale to only one pod
-		fmt.Printf("=> Scaling to first canary point: %d pod(s)\n", firstCanaryPods)
+		logger.Info("=> Scaling to first canary point: %d pod(s)\n", firstCanaryPods)
 		deployment.Spec.Replicas = &firstCanaryPods
 	})
+	if err != nil {
+		return bailOut(err)
+	}
+
+	kubeRecordEvent(thisDeployment.Name, eventRolloutStarted, fmt.Sprintf("Rollout of %s started by %s.", repoConfig.GitSHA, os.Getenv("USER")))
+	if brokenFreeze != nil {
+		kubeRecordWarning(thisDeployment.Name, eventFreezeBroken, fmt.Sprintf("%s broke the freeze '%s', because: %s", os.Getenv("USER"), brokenFreeze.Name, runFlags.String("break-freeze")))
+	}
 
 	// Make sure first pod gets started
-	cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf("rollout status --namespace=%s deployment/%s", repoConfig.Namespace, repoConfig.ReleaseName))
+	if err := kubeWaitForRolloutStatus(repoConfig.ReleaseName); err != nil {
+		return bailOut(err)
+	}
+	kubeRecordEvent(thisDeployment.Name, eventCanaryPoint, fmt.Sprintf("Reached the first canary point with %d pod(s).", firstCanaryPods))
+
+	if err := kubeRunSmokeTests(thisDeployment); err != nil {
+		return bailOut(err)
+	}
 
 	if !skipCanary {
 		// Pause to watch monitors and make sure that the 1 pod deploy was successful
-		fmt.Println("\n=> Wait for at least one minute to make sure the new pod(s) started okay, and is getting some traffic.")
-		if y := canaryHoldAndWait(60); y == false {
-			safeBailOut(kubeapi.GetSingleDeployment(repoConfig.ReleaseName), &mostRecentRelease, &desiredPods)
+		logger.Info("\n=> Wait for at least one minute to make sure the new pod(s) started okay, and is getting some traffic.")
+		if err := canaryHoldAndWait(60, thisDeployment); err != nil {
+			return bailOut(err)
 		}
 	}
 
 	if desiredPods > firstCanaryPods { // Skip second canary point if no new pods are needed
 		// Scale up to desired number of pods in new canary release
-		fmt.Printf("=> Scaling to next canary point: %d pod(s)\n=> This should give the new pods roughly 50%% of traffic (if the old deployment was the same size).\n", desiredPods)
+		logger.Info("=> Scaling to next canary point: %d pod(s)\n=> This should give the new pods roughly 50%% of traffic (if the old deployment was the same size).\n", desiredPods)
 
-		thisDeployment = kubeapi.UpdateDeployment(repoConfig.ReleaseName, func(deployment *v1beta1.Deployment) {
+		if autoscaled {
+			if err := kubePinAutoscaler(repoConfig.ReleaseName, desiredPods); err != nil {
+				return bailOut(err)
+			}
+		}
+		thisDeployment, err = kubeapi.UpdateDeployment(repoConfig.ReleaseName, func(deployment *v1beta1.Deployment) {
 			deployment.Spec.Replicas = &desiredPods
 		})
-		cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf("rollout status --namespace=%s deployment/%s", repoConfig.Namespace, repoConfig.ReleaseName))
+		if err != nil {
+			return bailOut(err)
+		}
+		if err := kubeWaitForRolloutStatus(repoConfig.ReleaseName); err != nil {
+			return bailOut(err)
+		}
+		kubeRecordEvent(thisDeployment.Name, eventCanaryPoint, fmt.Sprintf("Reached the second canary point with %d pod(s).", desiredPods))
+
+		if err := kubeRunSmokeTests(thisDeployment); err != nil {
+			return bailOut(err)
+		}
 
 		if !skipCanary {
-			fmt.Println("\n=> Now, let's wait for 5 minutes, watch the monitors, and let everything simmer to make sure it looks good.")
-			if y := canaryHoldAndWait(300); y == false {
-				safeBailOut(kubeapi.GetSingleDeployment(repoConfig.ReleaseName), &mostRecentRelease, &desiredPods)
+			logger.Info("\n=> Now, let's wait for 5 minutes, watch the monitors, and let everything simmer to make sure it looks good.")
+			if err := canaryHoldAndWait(300, thisDeployment); err != nil {
+				return bailOut(err)
 			}
 		}
 	}
 
 	// Scale down pods in old release
 	if mostRecentRelease.Name != "" {
-		fmt.Println("\n=> Scaling down old deployment, leaving only new deployment pods.")
+		logger.Info("\n=> Scaling down old deployment, leaving only new deployment pods.")
 
-		mostRecentRelease = *kubeapi.UpdateDeployment(mostRecentRelease.Name, func(deployment *v1beta1.Deployment) {
-			deployment.Spec.Replicas = new(int32) // new() returns default value, which is 0 for int32
-		})
-		cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf("rollout status --namespace=%s deployment/%s", repoConfig.Namespace, mostRecentRelease.Name))
+		if err := kubeSafeScaleDown(mostRecentRelease.Name, repoConfig.ReleaseName, desiredPods); err != nil {
+			return bailOut(err)
+		}
+		kubeRecordEvent(thisDeployment.Name, eventCanaryPoint, fmt.Sprintf("Reached the last canary point, with %s scaled down.", mostRecentRelease.Name))
+
+		if err := kubeRunSmokeTests(thisDeployment); err != nil {
+			return bailOut(err)
+		}
 
 		if !skipCanary {
-			fmt.Println("=> Now, let's wait for another 5 minutes, watch the monitors again, amd make sure we're confident with the new deployment.")
-			if y := canaryHoldAndWait(300); y == false {
-				safeBailOut(kubeapi.GetSingleDeployment(repoConfig.ReleaseName), kubeapi.GetSingleDeployment(mostRecentRelease.Name), &desiredPods)
+			logger.Info("=> Now, let's wait for another 5 minutes, watch the monitors again, amd make sure we're confident with the new deployment.")
+			if err := canaryHoldAndWait(300, thisDeployment); err != nil {
+				return bailOut(err)
 			}
 		}
 	}
 
-	// Need to retrieve the deployment again after any kube configs
-	thisDeployment = kubeapi.GetSingleDeployment(repoConfig.ReleaseName)
+	// Run the post-rollout hooks now that the new release is receiving all of the traffic
+	if err := kubeRunHooks("postRollout"); err != nil {
+		return bailOut(err)
+	}
+
+	// Let the HPA take over the new release - the release itself is fine, so this isn't worth bailing out for
+	if err := kubeReleaseAutoscalers(repoConfig.ReleaseName, mostRecentRelease.Name); err != nil {
+		logger.Warn("=> I couldn't hand the scaling back to the HorizontalPodAutoscalers (%s), so you'll need to check them yourself.", err)
+	}
+
 	// Tag the new release with 'is-live'
-	fmt.Println("=> Tagging the new release with the tag 'kubedeploy-is-live'.")
-	thisDeployment = kubeapi.UpdateDeployment(thisDeployment.Name, func(deployment *v1beta1.Deployment) {
+	logger.Info("=> Tagging the new release with the tag 'kubedeploy-is-live'.")
+	thisDeployment, err = kubeapi.UpdateDeployment(repoConfig.ReleaseName, func(deployment *v1beta1.Deployment) {
 		deployment.Labels["kubedeploy-is-live"] = "true"
 	})
+	if err != nil {
+		return err
+	}
 
 	// Tag older release with 'instant-rollback-target'
 	if mostRecentRelease.Name != "" {
-		fmt.Printf("=> Tagging release %s with tag 'instant-rollback-target'.\n=> You can rollback to this in one command with `kube-deploy rollback`.\n", mostRecentRelease.Name)
-		kubeapi.UpdateDeployment(mostRecentRelease.Name, func(deployment *v1beta1.Deployment) {
+		logger.Info("=> Tagging release %s with tag 'instant-rollback-target'.\n=> You can rollback to this in one command with `kube-deploy rollback`.\n", mostRecentRelease.Name)
+		if _, err := kubeapi.UpdateDeployment(mostRecentRelease.Name, func(deployment *v1beta1.Deployment) {
 			deployment.Labels["kubedeploy-rollback-target"] = "true"
 			delete(deployment.Labels, "kubedeploy-is-live")
-		})
+		}); err != nil {
+			return err
+		}
 	} else {
-		fmt.Println("=> Since there are no previous deployments, no 'kubedeploy-rollback-target' will be assigned.")
+		logger.Info("=> Since there are no previous deployments, no 'kubedeploy-rollback-target' will be assigned.")
 	}
 
 	// Clean up any older release deployments - leave current new and older
 	for _, r := range previousReleases.Items {
 		if r.Name != thisDeployment.Name && r.Name != mostRecentRelease.Name {
-			fmt.Printf("=> Cleaning up older deployment: %s.\n", r.Name)
-			kubeapi.DeleteDeployment(&r)
+			logger.Info("=> Cleaning up older deployment: %s.\n", r.Name)
+			if err := kubeapi.DeleteDeployment(&r); err != nil {
+				logger.Warn("=> I couldn't clean up %s: %s", r.Name, err)
+			}
 		}
 	}
-
-	// Clean up workdir and remove lockfile
-	kubeRemoveTemplates()
-	cli.UnlockAfterRollout(repoConfig.Application.Name)
-
-	fmt.Print("\n=> You're all done, great job!\n\n")
+	return nil
 }
 
-func safeBailOut(thisDeployment *v1beta1.Deployment, mostRecentRelease *v1beta1.Deployment, pods *int32) {
-	fmt.Println("=> Okay, let's try and bail out safely.")
-
-	if mostRecentRelease.Name != "" {
-		fmt.Printf("=> Scaling the previous release %s back up to %d pods.\n", mostRecentRelease.Name, pods)
-		kubeapi.UpdateDeployment(mostRecentRelease.Name, func(deployment *v1beta1.Deployment) {
-			deployment.Spec.Replicas = pods
-			deployment.Labels["kubedeploy-is-live"] = "true"
-			delete(deployment.Labels, "kubedeploy-rollback-target")
-		})
-		cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf("rollout status --namespace=%s deployment/%s", repoConfig.Namespace, mostRecentRelease.Name))
+// Makes the previous release live again after cause stopped the rollout of this one
+func safeBailOut(thisDeploymentName string, mostRecentReleaseName string, pods int32, cause error) error {
+	// Even when the rollout was interrupted, the bail out has to finish
+	cli.StartBailingOut()
+	logger.Error("=> %s", cause)
+	logger.Info("=> Okay, let's try and bail out safely.")
+	kubeRecordWarning(thisDeploymentName, eventBailedOut, "Bailing out of the rollout of this release.")
 
-		fmt.Println("=> Deleting the deployment we created...")
-		kubeapi.DeleteDeployment(thisDeployment)
-	} else {
+	if mostRecentReleaseName == "" {
 		// There was no 'most recent' release
-		fmt.Println("=> Oh no, I don't have anywhere to roll back to! I'll leave things as they are now, but you'll need to clean up yourself, or do another rollout forward.")
+		logger.Error("=> Oh no, I don't have anywhere to roll back to! I'll leave things as they are now, but you'll need to clean up yourself, or do another rollout forward.")
+		if err := kubeReleaseAutoscalers(thisDeploymentName, ""); err != nil {
+			logger.Warn("=> I couldn't hand the scaling back to the HorizontalPodAutoscalers either: %s", err)
+		}
+		return failure.New(failure.RolloutAborted, "Aborted the rollout of %s, with nothing to roll back to", thisDeploymentName)
 	}
 
+	logger.Info("=> Scaling the previous release %s back up to %d pods.\n", mostRecentReleaseName, pods)
+	if _, err := kubeapi.UpdateDeployment(mostRecentReleaseName, func(deployment *v1beta1.Deployment) {
+		deployment.Spec.Replicas = &pods
+		deployment.Labels["kubedeploy-is-live"] = "true"
+		delete(deployment.Labels, "kubedeploy-rollback-target")
+	}); err != nil {
+		return failure.Wrap(failure.RolloutAborted, err, "Oh no, I couldn't scale %s back up, so you'll need to clean up yourself", mostRecentReleaseName)
+	}
+	kubeWaitForRolloutStatus(mostRecentReleaseName)
+	if err := kubeReleaseAutoscalers(mostRecentReleaseName, thisDeploymentName); err != nil {
+		logger.Warn("=> I couldn't hand the scaling back to the HorizontalPodAutoscalers: %s", err)
+	}
+	kubeRecordEvent(mostRecentReleaseName, eventBailedOut, fmt.Sprintf("Made live again after bailing out of the rollout of %s.", thisDeploymentName))
+
+	logger.Info("=> Deleting the deployment we created...")
+	if thisDeployment, err := kubeapi.GetSingleDeployment(thisDeploymentName); err == nil {
+		err = kubeapi.DeleteDeployment(thisDeployment)
+		if err != nil {
+			logger.Warn("=> I couldn't delete %s: %s", thisDeploymentName, err)
+		}
+	}
+
+	logger.Warn("=> Sorry it didn't work out - better luck next time!\n\n")
+	return failure.New(failure.RolledBack, "Bailed out of the rollout of %s, back to %s", thisDeploymentName, mostRecentReleaseName)
+}
+
+// Waits for the Deployment's pods with 'kubectl rollout status' - stopping early if kube-deploy is told to
+func kubeWaitForRolloutStatus(deploymentName string) error {
+	cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf("rollout status --namespace=%s deployment/%s", repoConfig.Namespace, deploymentName))
+	return cli.Aborted()
+}
+
+// Removes the templated files and the lockfile at the end of a rollout - by then there's nothing better to do with an error than warn about it
+func cleanUpAfterRollout() {
 	kubeRemoveTemplates()
-	cli.UnlockAfterRollout(repoConfig.Application.Name)
-	fmt.Print("=> Sorry it didn't work out - better luck next time!\n\n")
-	os.Exit(0)
+	if err := cli.UnlockAfterRollout(repoConfig.Application.Name); err != nil {
+		logger.Warn("=> I couldn't remove the lockfile, so you'll need to run 'kube-deploy unlock': %s", err)
+	}
 }
 
-func kubeRollingRestart() {
-	isLiveDeployments := kubeapi.ListDeployments(map[string]string{"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch, "kubedeploy-is-live": "true"})
+// Lists the names of the deployments, for the error about there being too many or too few of them
+func deploymentNames(deploymentLists ...*v1beta1.DeploymentList) string {
+	var names []string
+	for _, l := range deploymentLists {
+		for _, d := range l.Items {
+			names = append(names, d.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "none found"
+	}
+	return strings.Join(names, ", ")
+}
+
+func kubeRollingRestart() error {
+	isLiveDeployments, err := kubeapi.ListDeployments(map[string]string{"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch, "kubedeploy-is-live": "true"})
+	if err != nil {
+		return err
+	}
 
 	if len(isLiveDeployments.Items) != 1 {
-		fmt.Println("=> Whoah, there's either more or less than one 'is_live' deployment. You should fix that first.")
-		for _, i := range isLiveDeployments.Items {
-			fmt.Printf("\t%s\n", i.Name)
-		}
-		os.Exit(1)
+		return failure.New(failure.Unknown, "Whoah, there's either more or less than one 'is_live' deployment. You should fix that first (%s)", deploymentNames(isLiveDeployments))
 	}
 
 	isLive := isLiveDeployments.Items[0]
-	kubeapi.UpdateDeployment(isLive.Name, func(deployment *v1beta1.Deployment) {
+	if _, err := kubeapi.UpdateDeployment(isLive.Name, func(deployment *v1beta1.Deployment) {
 		deployment.Spec.Template.Labels["kubedeploy-last-rolling-restart"] = strconv.FormatInt(time.Now().Unix(), 10)
-	})
-	cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf("rollout status --namespace=%s deployment/%s", repoConfig.Namespace, isLive.Name))
+	}); err != nil {
+		return err
+	}
+	kubeWaitForRolloutStatus(isLive.Name)
 
-	fmt.Printf("\n=> All pods have been recreated.\n\n")
+	logger.Info("\n=> All pods have been recreated.\n\n")
+	return nil
 }
 
-func kubeInstantRollback() {
+func kubeInstantRollback() error {
 	// Find deployment with label 'instant-rollback-target'
-	rollbackTargets := kubeapi.ListDeployments(map[string]string{"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch, "kubedeploy-rollback-target": "true"})
-	isLiveDeployments := kubeapi.ListDeployments(map[string]string{"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch, "kubedeploy-is-live": "true"})
+	rollbackTargets, err := kubeapi.ListDeployments(map[string]string{"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch, "kubedeploy-rollback-target": "true"})
+	if err != nil {
+		return err
+	}
+	isLiveDeployments, err := kubeapi.ListDeployments(map[string]string{"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch, "kubedeploy-is-live": "true"})
+	if err != nil {
+		return err
+	}
 
 	if len(rollbackTargets.Items) != 1 || len(isLiveDeployments.Items) != 1 {
-		fmt.Println("=> Whoah, there's either more or less than one 'is_live' deployment or 'rollback-target' deployment. You should fix that first.")
-		for _, i := range isLiveDeployments.Items {
-			fmt.Printf("\t%s\n", i.Name)
-		}
-		for _, i := range rollbackTargets.Items {
-			fmt.Printf("\t%s\n", i.Name)
-		}
-		os.Exit(1)
+		return failure.New(failure.Unknown, "Whoah, there's either more or less than one 'is_live' deployment or 'rollback-target' deployment. You should fix that first (%s)", deploymentNames(isLiveDeployments, rollbackTargets))
 	}
 
 	isLive := isLiveDeployments.Items[0]
@@ -228,110 +440,218 @@ func kubeInstantRollback() {
 		replicas = &oneReplica
 	}
 
+	if !runFlags.Bool("no-canary") {
+		if err := checkApprovalMode(); err != nil {
+			return err
+		}
+	}
+
 	rollbackTarget := rollbackTargets.Items[0]
+	targetReplicas := rollbackTarget.Spec.Replicas
 	rollbackTarget.Spec.Replicas = replicas
-	fmt.Printf("=> Rolling back to %s, pod count %d.\n", rollbackTarget.Name, *replicas)
+	logger.Info("=> Rolling back to %s, pod count %d.\n", rollbackTarget.Name, *replicas)
+	notify.Send(repoConfig, notify.RollbackStarted, fmt.Sprintf("Started rolling back from %s to %s", isLive.Name, rollbackTarget.Name))
 
-	kubeapi.UpdateDeployment(rollbackTarget.Name, func(deployment *v1beta1.Deployment) {
+	rollbackDeployment, err := kubeapi.UpdateDeployment(rollbackTarget.Name, func(deployment *v1beta1.Deployment) {
+		deployment.Spec.Replicas = replicas
 		deployment.Labels["kubedeploy-is-live"] = "true"
 		delete(deployment.Labels, "kubedeploy-rollback-target")
 	})
-	cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf("rollout status --namespace=%s deployment/%s", repoConfig.Namespace, rollbackTarget.Name))
+	if err != nil {
+		return err
+	}
+	kubeWaitForRolloutStatus(rollbackTarget.Name)
+
+	if !runFlags.Bool("no-canary") {
+		logger.Info("\n=> Wait for one minute to make sure that the old pods came up correctly.")
+		if err := canaryHoldAndWait(60, rollbackDeployment); err != nil {
+			if !failure.Is(err, failure.Cancelled) {
+				return err
+			}
+			// Rejected - put the rollback target back the way it was, and leave the live release alone
+			logger.Info("=> The rollback was rejected, so I'm scaling %s back down and leaving %s live.", rollbackTarget.Name, isLive.Name)
+			if _, revertErr := kubeapi.UpdateDeployment(rollbackTarget.Name, func(deployment *v1beta1.Deployment) {
+				deployment.Spec.Replicas = targetReplicas
+				deployment.Labels["kubedeploy-rollback-target"] = "true"
+				delete(deployment.Labels, "kubedeploy-is-live")
+			}); revertErr != nil {
+				return failure.Wrap(failure.Unknown, revertErr, "The rollback was rejected, but I couldn't put %s back - both %s and %s are running and marked live", rollbackTarget.Name, isLive.Name, rollbackTarget.Name)
+			}
+			return err
+		}
+	}
 
-	if !runFlags.Bool("force") && !runFlags.Bool("no-canary") {
-		fmt.Println("\n=> Wait for one minute to make sure that the old pods came up correctly.")
-		canaryHoldAndWait(60)
+	// Scale old pods down to zero, as long as the rollback target can take over
+	logger.Info("=> Wait for the old pods to scale down to 0.")
+	if err := kubeSafeScaleDown(isLive.Name, rollbackTarget.Name, *replicas); err != nil {
+		return failure.Wrap(failure.KindOf(err), err, "I've left both %s and %s running - you'll need to check what's wrong with %s before scaling down", isLive.Name, rollbackTarget.Name, rollbackTarget.Name)
+	}
+	if err := kubeReleaseAutoscalers(rollbackTarget.Name, isLive.Name); err != nil {
+		logger.Warn("=> I couldn't hand the scaling back to the HorizontalPodAutoscalers (%s), so you'll need to check them yourself.", err)
 	}
 
-	// Scale old pods down to zero
-	kubeapi.UpdateDeployment(isLive.Name, func(deployment *v1beta1.Deployment) {
-		deployment.Spec.Replicas = new(int32)
+	if _, err := kubeapi.UpdateDeployment(isLive.Name, func(deployment *v1beta1.Deployment) {
 		deployment.Labels["kubedeploy-rollback-target"] = "true"
 		delete(deployment.Labels, "kubedeploy-is-live")
-	})
-
-	fmt.Println("=> Wait for the old pods to scale down to 0.")
-	cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf("rollout status --namespace=%s deployment/%s", repoConfig.Namespace, rollbackTarget.Name))
+	}); err != nil {
+		return err
+	}
 
-	fmt.Printf("=> The deployment has been successfully rolled back to: %s.\n", rollbackTarget.Name)
+	kubeRecordEvent(rollbackTarget.Name, eventRolledBack, fmt.Sprintf("Rolled back to this release from %s by %s.", isLive.Name, os.Getenv("USER")))
+	kubeRecordEvent(isLive.Name, eventRolledBack, fmt.Sprintf("Rolled back from this release to %s by %s.", rollbackTarget.Name, os.Getenv("USER")))
+	notify.Send(repoConfig, notify.RollbackCompleted, fmt.Sprintf("Rolled back from %s to %s", isLive.Name, rollbackTarget.Name))
+	forge.UpdateDeploymentStatus(repoConfig, forgeDeploymentID(&isLive), forge.StateInactive)
+	forge.UpdateDeploymentStatus(repoConfig, forgeDeploymentID(&rollbackTarget), forge.StateSuccess)
+	logger.Info("=> The deployment has been successfully rolled back to: %s.\n", rollbackTarget.Name)
+	return nil
 }
 
-func kubeScaleDeployment(replicas int32) {
-	deployments := kubeapi.ListDeployments(map[string]string{"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch, "kubedeploy-is-live": "true"})
-	if len(deployments.Items) == 1 {
-		fmt.Printf("=> Starting to scale to %d replica(s).\n", replicas)
-		liveDeployment := deployments.Items[0]
+func kubeScaleDeployment(replicas int32) error {
+	if err := kubeCheckPolicies("scale", &replicas); err != nil {
+		return err
+	}
+	deployments, err := kubeapi.ListDeployments(map[string]string{"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch, "kubedeploy-is-live": "true"})
+	if err != nil {
+		return err
+	}
+	if len(deployments.Items) != 1 {
+		return failure.New(failure.Unknown, "Whoah, there's either more or less than one 'is_live' deployment. You should fix that first (%s)", deploymentNames(deployments))
+	}
 
-		kubeapi.UpdateDeployment(liveDeployment.Name, func(deployment *v1beta1.Deployment) {
-			deployment.Spec.Replicas = &replicas
-		})
-		cli.StreamAndGetCommandOutputAndExitCode("kubectl", fmt.Sprintf("rollout status --namespace=%s deployment/%s", repoConfig.Namespace, repoConfig.ReleaseName))
-		fmt.Printf("=> Finished scaling to %d replica(s).\n", replicas)
-	} else {
-		fmt.Println("=> Whoah, there's more than one 'is_live' deployment. You should fix that first.")
-		for _, i := range deployments.Items {
-			fmt.Printf("\t%s\n", i.Name)
-		}
-		os.Exit(1)
+	logger.Info("=> Starting to scale to %d replica(s).\n", replicas)
+	liveDeployment := deployments.Items[0]
+
+	if _, err := kubeapi.UpdateDeployment(liveDeployment.Name, func(deployment *v1beta1.Deployment) {
+		deployment.Spec.Replicas = &replicas
+	}); err != nil {
+		return err
 	}
+	kubeWaitForRolloutStatus(repoConfig.ReleaseName)
+	notify.Send(repoConfig, notify.Scaled, fmt.Sprintf("Scaled %s to %d replica(s)", liveDeployment.Name, replicas))
+	logger.Info("=> Finished scaling to %d replica(s).\n", replicas)
+	return nil
 }
 
-func kubeRemove() {
-	cli.LockBeforeRollout(repoConfig.Application.Name, runFlags.Bool("force"))
+func kubeRemove() error {
+	if err := kubeCheckPolicies("remove", nil); err != nil {
+		return err
+	}
+	if err := lockBeforeRollout(); err != nil {
+		return err
+	}
+	// Removing stops when it's interrupted, and cleans up however it ends
+	defer cli.HandleAborts()()
+	defer cleanUpAfterRollout()
 
-	for _, f := range kubeMakeTemplates() {
+	templates, err := kubeMakeTemplates()
+	if err != nil {
+		return err
+	}
+	for _, f := range templates {
+		if err := cli.Aborted(); err != nil {
+			return err
+		}
 		fileData, err := ioutil.ReadFile(f)
 		if err != nil {
-			fmt.Println("Coud not read template file to remove.")
+			return failure.Wrap(failure.Unknown, err, "Coud not read template file to remove")
 		}
 		kubeObject := kubeapi.ParseKubeFile(fileData)
 
 		switch o := kubeObject.(type) {
 		case *v1beta1.Deployment:
-			deployment := kubeObject.(*v1beta1.Deployment)
-			kubeapi.DeleteDeployment(deployment)
+			err = kubeapi.DeleteDeployment(o)
 		case *v1.Service:
-			service := kubeObject.(*v1.Service)
-			kubeapi.DeleteService(service)
+			err = kubeapi.DeleteService(o)
 		case *v1.Secret:
-			secret := kubeObject.(*v1.Secret)
-			kubeapi.DeleteSecret(secret)
+			err = kubeapi.DeleteSecret(o)
 		case *v1beta1.Ingress:
-			ingress := kubeObject.(*v1beta1.Ingress)
-			kubeapi.DeleteIngress(ingress)
+			err = kubeapi.DeleteIngress(o)
 		default:
-			fmt.Println("=> Unable to delete Kubernetes object of type: ", o)
-			os.Exit(1)
+			return failure.New(failure.Unknown, "Unable to delete Kubernetes object of type: %T", o)
+		}
+		if err != nil {
+			return err
 		}
 	}
-
-	kubeRemoveTemplates()
-	cli.UnlockAfterRollout(repoConfig.Application.Name)
+	return nil
 }
 
-func kubeListDeployments() {
-	deployments := kubeapi.ListDeployments(map[string]string{"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch})
+func kubeListDeployments() error {
+	deployments, err := kubeapi.ListDeployments(map[string]string{"app": repoConfig.Application.Name + "-" + repoConfig.GitBranch})
+	if err != nil {
+		return err
+	}
 
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.AlignRight)
-	fmt.Fprintln(w, fmt.Sprintf("%s \t %s \t %s", "Active Deployments", "Replicas", "Date Created"))
-	fmt.Fprintln(w, fmt.Sprintf("%s \t %s \t %s", "----------", "----------", "----------"))
-	for _, d := range deployments.Items {
-		fmt.Fprintln(w, fmt.Sprintf("%s \t %d \t %s", d.Name, int(*d.Spec.Replicas), d.CreationTimestamp))
+	output := make([]deploymentOutput, len(deployments.Items))
+	for i, d := range deployments.Items {
+		output[i] = deploymentOutput{
+			Name:           d.Name,
+			Replicas:       *d.Spec.Replicas,
+			ReadyReplicas:  d.Status.ReadyReplicas,
+			Created:        d.CreationTimestamp.UTC().Format("2006-01-02T15:04:05Z"),
+			Live:           d.Labels["kubedeploy-is-live"] == "true",
+			RollbackTarget: d.Labels["kubedeploy-rollback-target"] == "true",
+			GitSHA:         d.Annotations[gitSHAAnnotation],
+		}
 	}
-	w.Flush()
+
+	return printOutput(output, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, fmt.Sprintf("%s \t %s \t %s", "Active Deployments", "Replicas", "Date Created"))
+		fmt.Fprintln(tw, fmt.Sprintf("%s \t %s \t %s", "----------", "----------", "----------"))
+		for _, d := range deployments.Items {
+			fmt.Fprintln(tw, fmt.Sprintf("%s \t %d \t %s", d.Name, int(*d.Spec.Replicas), d.CreationTimestamp))
+		}
+		tw.Flush()
+	})
 }
 
-func canaryHoldAndWait(waitTimeSeconds int) bool {
+// Waits at a canary point - a nil error means the rollout can go on
+func canaryHoldAndWait(waitTimeSeconds int, deployment *v1beta1.Deployment) error {
+	proceed, err := canaryDecision(waitTimeSeconds, deployment)
+	if err != nil {
+		return err
+	}
+	if !proceed {
+		kubeRecordWarning(deployment.Name, eventCanaryRejected, "The canary point was rejected.")
+		return failure.New(failure.Cancelled, "The canary point was rejected")
+	}
+	kubeRecordEvent(deployment.Name, eventCanaryApproved, "The canary point was approved.")
+	return nil
+}
+
+func canaryDecision(waitTimeSeconds int, deployment *v1beta1.Deployment) (bool, error) {
+	switch approvalMode() {
+	case approvalModeAutoAfterHold:
+		if err := holdAtCanaryPoint(waitTimeSeconds); err != nil {
+			return false, err
+		}
+		return true, nil
+	case approvalModeAutomatedAnalysis:
+		if err := holdAtCanaryPoint(waitTimeSeconds); err != nil {
+			return false, err
+		}
+		if err := kubeRunSmokeTests(deployment); err != nil {
+			if aborted := cli.Aborted(); aborted != nil {
+				return false, aborted
+			}
+			logger.Warn("=> %s", err)
+			return false, nil
+		}
+		return true, nil
+	case approvalModeExternal:
+		return waitForExternalApproval(waitTimeSeconds, deployment)
+	}
+
 	firstPromptTime := time.Now()
 	printablePromptTime := firstPromptTime.Format("Jan _2 15:04:05")
-	proceed := askToProceed(fmt.Sprintf("%s: You are at a canary point.", printablePromptTime))
-	if proceed == false {
-		return false
+	proceed, err := askToProceed(fmt.Sprintf("%s: You are at a canary point.", printablePromptTime))
+	if err != nil || proceed == false {
+		return false, err
 	}
 	elasped := int(time.Since(firstPromptTime).Seconds())
 	if elasped < waitTimeSeconds {
-		proceed := askToProceed("=> Bad behaviour - you're back too quickly. Honestly, are you really sure?")
-		return proceed
+		return askToProceed("=> Bad behaviour - you're back too quickly. Honestly, are you really sure?")
 	}
-	return true
+	return true, nil
 }
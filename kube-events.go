@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mycujoo/kube-deploy/kube/api"
+	"github.com/mycujoo/kube-deploy/logger"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/api/extensions/v1beta1"
+)
+
+// Reasons for the Events recorded on Deployments during rollouts
+const (
+	eventRolloutStarted   = "RolloutStarted"
+	eventCanaryPoint      = "CanaryPointReached"
+	eventCanaryApproved   = "CanaryPointApproved"
+	eventCanaryRejected   = "CanaryPointRejected"
+	eventScaledDown       = "ScaledDown"
+	eventBailedOut        = "BailedOut"
+	eventRolloutCompleted = "RolloutCompleted"
+	eventRolledBack       = "RolledBack"
+	eventFreezeBroken     = "FreezeBroken"
+)
+
+// Annotations recording where a release came from
+const (
+	deployerAnnotation   = "kubedeploy-deployer"
+	gitSHAAnnotation     = "kubedeploy-git-sha"
+	sourceRepoAnnotation = "kubedeploy-source-repo"
+	configHashAnnotation = "kubedeploy-config-hash"
+	freezeAnnotation     = "kubedeploy-freeze-broken"
+)
+
+func kubeRecordEvent(deploymentName string, reason string, message string) {
+	kubeRecordDeploymentEvent(deploymentName, v1.EventTypeNormal, reason, message)
+}
+
+func kubeRecordWarning(deploymentName string, reason string, message string) {
+	kubeRecordDeploymentEvent(deploymentName, v1.EventTypeWarning, reason, message)
+}
+
+// Events are only informational, so failing to record one doesn't stop anything
+func kubeRecordDeploymentEvent(deploymentName string, eventType string, reason string, message string) {
+	if deploymentName == "" {
+		return
+	}
+	deployment, err := kubeapi.GetSingleDeployment(deploymentName)
+	if err != nil {
+		logger.Warn("=> I couldn't record the event '%s' on %s: %s\n", reason, deploymentName, err)
+		return
+	}
+	kubeapi.RecordDeploymentEvent(deployment, eventType, reason, message)
+}
+
+func setProvenanceAnnotations(deployment *v1beta1.Deployment) {
+	if deployment.Annotations == nil {
+		deployment.Annotations = make(map[string]string)
+	}
+	deployment.Annotations[deployerAnnotation] = os.Getenv("USER")
+	deployment.Annotations[gitSHAAnnotation] = repoConfig.GitSHA
+	deployment.Annotations[sourceRepoAnnotation] = repoConfig.SourceRepoURL
+	deployment.Annotations[configHashAnnotation] = repoConfig.ConfigHash
+	if brokenFreeze != nil {
+		deployment.Annotations[freezeAnnotation] = fmt.Sprintf("%s: %s", brokenFreeze.Name, runFlags.String("break-freeze"))
+	} else {
+		delete(deployment.Annotations, freezeAnnotation)
+	}
+}
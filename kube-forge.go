@@ -0,0 +1,22 @@
+package main
+
+import (
+	"k8s.io/api/extensions/v1beta1"
+)
+
+// The ID of the forge's deployment record is kept on the Deployment, so rollbacks and bail-outs can update the right record
+const forgeDeploymentAnnotation = "kubedeploy-forge-deployment-id"
+
+func forgeDeploymentID(deployment *v1beta1.Deployment) string {
+	return deployment.Annotations[forgeDeploymentAnnotation]
+}
+
+func setForgeDeploymentID(deployment *v1beta1.Deployment, id string) {
+	if id == "" {
+		return
+	}
+	if deployment.Annotations == nil {
+		deployment.Annotations = make(map[string]string)
+	}
+	deployment.Annotations[forgeDeploymentAnnotation] = id
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/kube/api"
+	"github.com/mycujoo/kube-deploy/logger"
+
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const defaultHookTimeoutSeconds = 600
+
+// Runs the hook Jobs for the given phase ('preRollout' or 'postRollout') in order, stopping at the first failure
+func kubeRunHooks(phase string) error {
+	hooks := repoConfig.Hooks.PreRollout
+	if phase == "postRollout" {
+		hooks = repoConfig.Hooks.PostRollout
+	}
+
+	for _, hook := range hooks {
+		timeoutSeconds := hook.TimeoutSeconds
+		if timeoutSeconds <= 0 {
+			timeoutSeconds = defaultHookTimeoutSeconds
+		}
+		if err := kubeRunHook(hook.Name, hook.Template, time.Duration(timeoutSeconds)*time.Second); err != nil {
+			if aborted := cli.Aborted(); aborted != nil {
+				return aborted
+			}
+			return failure.Wrap(failure.KindOf(err), err, "Uh oh, the %s hook '%s' failed", phase, hook.Name)
+		}
+	}
+	return nil
+}
+
+func kubeRunHook(name string, templatePath string, timeout time.Duration) error {
+	logger.Info("\n=> Running hook '%s' from template %s\n", name, templatePath)
+
+	templated, err := runConsulTemplate(templatePath)
+	if err != nil {
+		return failure.Wrap(failure.Config, err, "I couldn't render the template for hook '%s'", name)
+	}
+	job, ok := kubeapi.ParseKubeFile([]byte(templated)).(*batchv1.Job)
+	if !ok {
+		return failure.New(failure.Config, "the template for hook '%s' needs to contain exactly one Kubernetes Job", name)
+	}
+	if job.Labels == nil {
+		job.Labels = make(map[string]string)
+	}
+	job.Labels["app"] = repoConfig.Application.Name + "-" + repoConfig.GitBranch
+	job.Labels["kubedeploy-hook"] = name
+
+	// Jobs can't be updated, so remove any left over from a previous rollout before creating it again
+	if _, err := kubeapi.GetSingleJob(job.Name); err == nil {
+		logger.Info("=> Removing the Job %s left over from a previous rollout.\n", job.Name)
+		if err := kubeapi.DeleteJob(job.Name); err != nil {
+			return failure.Wrap(failure.Unknown, err, "I couldn't remove the Job %s", job.Name)
+		}
+		for {
+			if _, err := kubeapi.GetSingleJob(job.Name); apierrors.IsNotFound(err) {
+				break
+			} else if err != nil {
+				return failure.Wrap(failure.Unknown, err, "I couldn't check whether the Job %s is gone", job.Name)
+			}
+			if err := cli.Sleep(2 * time.Second); err != nil {
+				return err
+			}
+		}
+	} else if !apierrors.IsNotFound(err) {
+		return failure.Wrap(failure.Unknown, err, "I couldn't look for a Job %s left over from a previous rollout", job.Name)
+	}
+
+	createdJob, err := kubeapi.CreateJob(job)
+	if err != nil {
+		return failure.Wrap(failure.Unknown, err, "Oh no, I couldn't create the hook Job")
+	}
+	return kubeWaitForJob(createdJob.Name, timeout)
+}
+
+// Follows a pod's logs, but only until the deadline - so a hung Job can't hang the rollout - or until kube-deploy is told to stop
+func streamPodLogsUntil(podName string, deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(cli.AbortContext(), deadline)
+	defer cancel()
+	return kubeapi.StreamPodLogs(ctx, podName)
+}
+
+// Streams the logs of each pod the Job starts, and waits for the Job to either complete or fail
+func kubeWaitForJob(jobName string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	streamedPods := make(map[string]bool)
+
+	for time.Now().Before(deadline) {
+		pods, err := kubeapi.ListPods(map[string]string{"job-name": jobName})
+		if err != nil {
+			return failure.Wrap(failure.Unknown, err, "I couldn't list the pods of the Job %s", jobName)
+		}
+		for _, pod := range pods.Items {
+			if streamedPods[pod.Name] || pod.Status.Phase == v1.PodPending {
+				continue
+			}
+			streamedPods[pod.Name] = true
+			logger.Info("=> Here are the logs from pod %s:\n", pod.Name)
+			if err := streamPodLogsUntil(pod.Name, deadline); err != nil {
+				if aborted := cli.Aborted(); aborted != nil {
+					return aborted
+				}
+				logger.Warn("=> I stopped reading the logs for that pod: %s", err)
+			}
+		}
+
+		job, err := kubeapi.GetSingleJob(jobName)
+		if err != nil {
+			return failure.Wrap(failure.Unknown, err, "I couldn't check on the Job %s", jobName)
+		}
+		for _, condition := range job.Status.Conditions {
+			if condition.Status != v1.ConditionTrue {
+				continue
+			}
+			switch condition.Type {
+			case batchv1.JobComplete:
+				logger.Info("=> The Job %s completed successfully.\n", jobName)
+				return nil
+			case batchv1.JobFailed:
+				return failure.New(failure.RolloutAborted, "the Job %s failed: %s", jobName, condition.Message)
+			}
+		}
+		if err := cli.Sleep(5 * time.Second); err != nil {
+			return err
+		}
+	}
+
+	return failure.New(failure.RolloutAborted, "the Job %s didn't finish within %s. I'll leave it in place so you can take a look", jobName, timeout)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/kube/api"
+	"github.com/mycujoo/kube-deploy/logger"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The policies the rendered Kubernetes objects are checked against
+const (
+	lintPolicyResources    = "resources"     // Every container has resource requests and limits
+	lintPolicyNoLatestTag  = "no-latest-tag" // No image is 'latest', or has no tag at all
+	lintPolicyReleaseImage = "release-image" // The release's Deployment runs KD_IMAGE_FULL_PATH
+	lintPolicyProbes       = "probes"        // Every container of a Deployment has readiness and liveness probes
+	lintPolicyLabels       = "kd-labels"     // The labels and selectors kube-deploy relies on are there, and left to it
+)
+
+// How seriously a policy is taken
+const (
+	lintLevelError   = "error" // Fails the lint
+	lintLevelWarning = "warning"
+	lintLevelOff     = "off"
+)
+
+// The level of each policy unless the deploy.yaml says otherwise - only what kube-deploy itself relies on is an error,
+// so existing Kubernetes files aren't suddenly refused over good practice
+var lintDefaultLevels = map[string]string{
+	lintPolicyResources:    lintLevelWarning,
+	lintPolicyNoLatestTag:  lintLevelWarning,
+	lintPolicyProbes:       lintLevelWarning,
+	lintPolicyReleaseImage: lintLevelError,
+	lintPolicyLabels:       lintLevelError,
+}
+
+// lintObject : the parts of a rendered Kubernetes object the policies look at, whichever API version it uses
+type lintObject struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name   string            `yaml:"name"`
+		Labels map[string]string `yaml:"labels"`
+	} `yaml:"metadata"`
+	Spec struct {
+		lintPodSpec `yaml:",inline"`       // For Pods
+		Selector    map[string]interface{} `yaml:"selector"` // 'matchLabels' and 'matchExpressions', or a Service's labels
+		Template    struct {
+			Metadata struct {
+				Labels map[string]string `yaml:"labels"`
+			} `yaml:"metadata"`
+			Spec lintPodSpec `yaml:"spec"`
+		} `yaml:"template"`
+	} `yaml:"spec"`
+}
+
+type lintPodSpec struct {
+	Containers     []lintContainer `yaml:"containers"`
+	InitContainers []lintContainer `yaml:"initContainers"`
+}
+
+type lintContainer struct {
+	Name      string `yaml:"name"`
+	Image     string `yaml:"image"`
+	Resources struct {
+		Requests map[string]interface{} `yaml:"requests"`
+		Limits   map[string]interface{} `yaml:"limits"`
+	} `yaml:"resources"`
+	ReadinessProbe interface{} `yaml:"readinessProbe"`
+	LivenessProbe  interface{} `yaml:"livenessProbe"`
+}
+
+// lintProblem : something wrong with a rendered object
+type lintProblem struct {
+	File    string
+	Object  string // Like 'Deployment/api-1.0.0-master-abc1234'
+	Policy  string // Empty for schema problems, which are always errors
+	Level   string
+	Message string
+}
+
+// The kinds of object which run pods from a template
+var podTemplateKinds = map[string]bool{"Deployment": true, "StatefulSet": true, "DaemonSet": true, "ReplicaSet": true, "Job": true}
+
+// The level of each policy, from the deploy.yaml
+func lintLevel(policy string) string {
+	if level := repoConfig.Lint.Policies[policy]; level != "" {
+		return level
+	}
+	return lintDefaultLevels[policy]
+}
+
+// Renders the Kubernetes files and checks them against the Kubernetes schema and the lint policies
+func kubeLint() error {
+	templates, err := kubeMakeTemplates()
+	defer kubeRemoveTemplates()
+	if err != nil {
+		return err
+	}
+
+	logger.Info("=> Linting the Kubernetes files...")
+	var problems []lintProblem
+	var objects []lintObject
+	for _, f := range templates {
+		fileProblems, fileObjects, err := lintFile(f)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, fileProblems...)
+		objects = append(objects, fileObjects...)
+	}
+	problems = append(problems, lintRelease(objects)...)
+
+	errors := 0
+	for _, p := range problems {
+		where := filepath.Base(p.File)
+		if p.Object != "" {
+			where += " " + p.Object
+		}
+		policy := ""
+		if p.Policy != "" {
+			policy = fmt.Sprintf(" [%s]", p.Policy)
+		}
+		if p.Level == lintLevelError {
+			errors++
+			logger.Error("\t%s: %s%s", where, p.Message, policy)
+		} else {
+			logger.Warn("\t%s: %s%s", where, p.Message, policy)
+		}
+	}
+	if errors > 0 {
+		return failure.New(failure.Config, "Uh oh, the Kubernetes files have %d problem(s) to fix first", errors)
+	}
+	logger.Info("=> The Kubernetes files look good to me!")
+	return nil
+}
+
+// Checks each object in one rendered file against the schema and the policies
+func lintFile(file string) ([]lintProblem, []lintObject, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	var problems []lintProblem
+	var objects []lintObject
+	for _, document := range regexp.MustCompile(`(?m)^---\s*$`).Split(string(contents), -1) {
+		if strings.TrimSpace(document) == "" {
+			continue
+		}
+		var object lintObject
+		if err := yaml.Unmarshal([]byte(document), &object); err != nil {
+			problems = append(problems, lintProblem{File: file, Level: lintLevelError, Message: err.Error()})
+			continue
+		}
+		if !repoConfig.Lint.SkipSchema {
+			// The schema is the one built into kube-deploy, so this works without a cluster - but it isn't the cluster's
+			checked, err := kubeapi.ValidateAgainstBuiltInSchema([]byte(document))
+			if err != nil {
+				problems = append(problems, lintProblem{File: file, Object: object.Kind + "/" + object.Metadata.Name, Level: lintLevelError,
+					Message: fmt.Sprintf("%s (checked against the Kubernetes API types built into kube-deploy, k8s.io/api %s - if the cluster knows better, set 'lint.skipSchema')", err, kubeapi.BuiltInSchemaVersion())})
+			} else if !checked {
+				logger.Warn("\t%s %s/%s: I don't know the API group of '%s', so I only checked it against the policies", filepath.Base(file), object.Kind, object.Metadata.Name, object.APIVersion)
+			}
+		}
+		problems = append(problems, lintObjectPolicies(file, object)...)
+		objects = append(objects, object)
+	}
+	return problems, objects, nil
+}
+
+func lintObjectPolicies(file string, object lintObject) []lintProblem {
+	var problems []lintProblem
+	add := func(policy string, format string, a ...interface{}) {
+		if level := lintLevel(policy); level != lintLevelOff {
+			problems = append(problems, lintProblem{File: file, Object: object.Kind + "/" + object.Metadata.Name, Policy: policy, Level: level, Message: fmt.Sprintf(format, a...)})
+		}
+	}
+
+	// kube-deploy sets its own labels as it goes - a selector on them would stop matching, and a file setting them
+	// would confuse which release is live
+	selector := labelMap(object.Spec.Selector["matchLabels"])
+	if object.Kind == "Service" {
+		selector = labelMap(object.Spec.Selector)
+	}
+	for i, labels := range []map[string]string{object.Metadata.Labels, object.Spec.Template.Metadata.Labels, selector} {
+		for _, label := range sortedKeys(labels) {
+			if strings.HasPrefix(label, "kubedeploy-") {
+				where := []string{"its labels", "its pod template's labels", "its selector"}[i]
+				add(lintPolicyLabels, "%s can't use '%s' - kube-deploy manages the 'kubedeploy-' labels itself", where, label)
+			}
+		}
+	}
+
+	podSpec := object.Spec.Template.Spec
+	switch {
+	case object.Kind == "Pod":
+		podSpec = object.Spec.lintPodSpec
+	case !podTemplateKinds[object.Kind]:
+		return problems
+	}
+
+	// A selector its own pods don't match is rejected by the cluster, or leaves the pods orphaned
+	for _, label := range sortedKeys(selector) {
+		if value := selector[label]; object.Kind != "Pod" && object.Spec.Template.Metadata.Labels[label] != value {
+			add(lintPolicyLabels, "its selector wants '%s: %s', but its pod template doesn't have that label", label, value)
+		}
+	}
+
+	for _, c := range append(podSpec.InitContainers, podSpec.Containers...) {
+		if len(c.Resources.Requests) == 0 || len(c.Resources.Limits) == 0 {
+			add(lintPolicyResources, "the container '%s' needs resource requests and limits", c.Name)
+		}
+		if tag := imageTag(c.Image); tag == "" || tag == "latest" {
+			add(lintPolicyNoLatestTag, "the container '%s' uses the image '%s' - give it a tag other than 'latest', so it's clear what's running", c.Name, c.Image)
+		}
+	}
+	if object.Kind == "Deployment" {
+		for _, c := range podSpec.Containers {
+			if c.ReadinessProbe == nil || c.LivenessProbe == nil {
+				add(lintPolicyProbes, "the container '%s' needs a readinessProbe and a livenessProbe", c.Name)
+			}
+		}
+	}
+
+	if object.Kind == "Deployment" && object.Metadata.Name == repoConfig.ReleaseName {
+		found := false
+		for _, c := range podSpec.Containers {
+			found = found || c.Image == repoConfig.ImageFullPath
+		}
+		if !found {
+			add(lintPolicyReleaseImage, "none of its containers run the image for this release, %s (use {{ env \"KD_IMAGE_FULL_PATH\" }})", repoConfig.ImageFullPath)
+		}
+		appName := repoConfig.Application.Name + "-" + repoConfig.GitBranch
+		if object.Metadata.Labels["app"] != appName {
+			add(lintPolicyLabels, "it needs the label 'app: %s' (use {{ env \"KD_APP_NAME\" }}) so kube-deploy can find it", appName)
+		}
+		if object.Spec.Template.Metadata.Labels["app"] != appName {
+			add(lintPolicyLabels, "its pod template needs the label 'app: %s' (use {{ env \"KD_APP_NAME\" }})", appName)
+		}
+	}
+	return problems
+}
+
+// A map of labels from the YAML, with everything as strings
+func labelMap(value interface{}) map[string]string {
+	labels := make(map[string]string)
+	switch m := value.(type) {
+	case map[interface{}]interface{}:
+		for k, v := range m {
+			labels[fmt.Sprint(k)] = fmt.Sprint(v)
+		}
+	case map[string]interface{}:
+		for k, v := range m {
+			labels[k] = fmt.Sprint(v)
+		}
+	}
+	return labels
+}
+
+func sortedKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Checks there's a Deployment for the release at all - without one, the rollout can't go anywhere
+func lintRelease(objects []lintObject) []lintProblem {
+	for _, object := range objects {
+		if object.Kind == "Deployment" && object.Metadata.Name == repoConfig.ReleaseName {
+			return nil
+		}
+	}
+	if level := lintLevel(lintPolicyLabels); level != lintLevelOff {
+		return []lintProblem{{File: repoConfig.Application.PathToKubernetesFiles, Policy: lintPolicyLabels, Level: level,
+			Message: fmt.Sprintf("there's no Deployment named %s (use {{ env \"KD_RELEASE_NAME\" }} as its name) for the rollout to scale", repoConfig.ReleaseName)}}
+	}
+	return nil
+}
+
+// The tag of an image reference, or "" if it has none (a digest counts as a tag)
+func imageTag(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		return image[i+1:]
+	}
+	// A ':' before the last '/' is a registry port, not a tag
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/mycujoo/kube-deploy/config"
+)
+
+func TestImageTag(t *testing.T) {
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{image: "nginx", want: ""},
+		{image: "nginx:latest", want: "latest"},
+		{image: "nginx:1.19", want: "1.19"},
+		{image: "eu.gcr.io/team/api:master-abc1234", want: "master-abc1234"},
+		{image: "registry.example.com:5000/team/api", want: ""},
+		{image: "registry.example.com:5000/team/api:1.0", want: "1.0"},
+		{image: "team/api@sha256:0123abcd", want: "sha256:0123abcd"},
+	}
+	for _, test := range tests {
+		if got := imageTag(test.image); got != test.want {
+			t.Errorf("imageTag(%q) = %q, want %q", test.image, got, test.want)
+		}
+	}
+}
+
+func TestLintObjectPolicies(t *testing.T) {
+	const release = `kind: Deployment
+metadata:
+  name: api-master-abc1234
+  labels:
+    app: api-master
+spec:
+  selector:
+    matchLabels:
+      app: api-master
+  template:
+    metadata:
+      labels:
+        app: api-master
+    spec:
+      containers:
+      - name: api
+        image: eu.gcr.io/team/api:master-abc1234
+        resources:
+          requests: {cpu: 100m}
+          limits: {memory: 128Mi}
+        readinessProbe: {httpGet: {path: /, port: 80}}
+        livenessProbe: {httpGet: {path: /, port: 80}}
+`
+	const sidecar = `kind: DaemonSet
+metadata:
+  name: log-shipper
+spec:
+  selector:
+    matchLabels:
+      app: log-shipper
+      kubedeploy-is-live: "true"
+  template:
+    metadata:
+      labels:
+        app: log-shipper
+    spec:
+      containers:
+      - name: shipper
+        image: fluentd
+`
+
+	tests := []struct {
+		name     string
+		object   string
+		policies map[string]string
+		want     []lintProblem
+	}{
+		{
+			name:   "the release's Deployment as it should be",
+			object: release,
+		},
+		{
+			name:   "the defaults",
+			object: sidecar,
+			want: []lintProblem{
+				{Object: "DaemonSet/log-shipper", Policy: lintPolicyLabels, Level: lintLevelError, Message: "its selector can't use 'kubedeploy-is-live' - kube-deploy manages the 'kubedeploy-' labels itself"},
+				{Object: "DaemonSet/log-shipper", Policy: lintPolicyLabels, Level: lintLevelError, Message: "its selector wants 'kubedeploy-is-live: true', but its pod template doesn't have that label"},
+				{Object: "DaemonSet/log-shipper", Policy: lintPolicyResources, Level: lintLevelWarning, Message: "the container 'shipper' needs resource requests and limits"},
+				{Object: "DaemonSet/log-shipper", Policy: lintPolicyNoLatestTag, Level: lintLevelWarning, Message: "the container 'shipper' uses the image 'fluentd' - give it a tag other than 'latest', so it's clear what's running"},
+			},
+		},
+		{
+			name:     "levels from the deploy.yaml",
+			object:   sidecar,
+			policies: map[string]string{lintPolicyLabels: lintLevelOff, lintPolicyResources: lintLevelError, lintPolicyNoLatestTag: lintLevelOff},
+			want: []lintProblem{
+				{Object: "DaemonSet/log-shipper", Policy: lintPolicyResources, Level: lintLevelError, Message: "the container 'shipper' needs resource requests and limits"},
+			},
+		},
+		{
+			name: "the release's Deployment without probes, its image or its app label",
+			object: `kind: Deployment
+metadata:
+  name: api-master-abc1234
+spec:
+  template:
+    spec:
+      containers:
+      - name: api
+        image: eu.gcr.io/team/api:1.0
+        resources:
+          requests: {cpu: 100m}
+          limits: {memory: 128Mi}
+`,
+			want: []lintProblem{
+				{Object: "Deployment/api-master-abc1234", Policy: lintPolicyProbes, Level: lintLevelWarning, Message: "the container 'api' needs a readinessProbe and a livenessProbe"},
+				{Object: "Deployment/api-master-abc1234", Policy: lintPolicyReleaseImage, Level: lintLevelError, Message: "none of its containers run the image for this release, eu.gcr.io/team/api:master-abc1234 (use {{ env \"KD_IMAGE_FULL_PATH\" }})"},
+				{Object: "Deployment/api-master-abc1234", Policy: lintPolicyLabels, Level: lintLevelError, Message: "it needs the label 'app: api-master' (use {{ env \"KD_APP_NAME\" }}) so kube-deploy can find it"},
+				{Object: "Deployment/api-master-abc1234", Policy: lintPolicyLabels, Level: lintLevelError, Message: "its pod template needs the label 'app: api-master' (use {{ env \"KD_APP_NAME\" }})"},
+			},
+		},
+		{
+			name:   "objects without pods",
+			object: "kind: Service\nmetadata:\n  name: api\nspec:\n  selector:\n    app: api-master\n",
+		},
+	}
+
+	defer func(saved config.RepoConfigMap) { repoConfig = saved }(repoConfig)
+	repoConfig.Application.Name = "api"
+	repoConfig.GitBranch = "master"
+	repoConfig.ReleaseName = "api-master-abc1234"
+	repoConfig.ImageFullPath = "eu.gcr.io/team/api:master-abc1234"
+	for _, test := range tests {
+		repoConfig.Lint.Policies = test.policies
+		var object lintObject
+		if err := yaml.Unmarshal([]byte(test.object), &object); err != nil {
+			t.Fatal(err)
+		}
+		problems := lintObjectPolicies("", object)
+		if !reflect.DeepEqual(problems, test.want) {
+			t.Errorf("%s: lintObjectPolicies() = %+v, want %+v", test.name, problems, test.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/logger"
+	"github.com/mycujoo/kube-deploy/policy"
+)
+
+// Evaluates the Rego policies from the deploy.yaml against the command that's about to run, the config, and the
+// rendered Kubernetes files - failing if any of them deny it. replicas is only given for 'scale'.
+func kubeCheckPolicies(commandName string, replicas *int32) error {
+	if len(repoConfig.Policy.Paths) == 0 {
+		return nil
+	}
+
+	templates, err := kubeMakeTemplates()
+	defer kubeRemoveTemplates()
+	if err != nil {
+		return err
+	}
+	manifests, err := policy.ReadManifests(templates)
+	if err != nil {
+		return failure.Wrap(failure.Config, err, "Uh oh, couldn't read the Kubernetes files for the policies")
+	}
+
+	flagValues := make(map[string]interface{})
+	if c := findCommand(commandName); c != nil {
+		for _, name := range c.Flags {
+			if findFlag(name).IsBool {
+				flagValues[name] = runFlags.Bool(name)
+			} else {
+				flagValues[name] = flagValue(name)
+			}
+		}
+	}
+
+	logger.Info("=> Checking the policies...")
+	decision, err := policy.Evaluate(repoConfig.Policy.Paths, policy.Input{
+		Command:   commandName,
+		Flags:     flagValues,
+		Replicas:  replicas,
+		User:      os.Getenv("USER"),
+		Time:      time.Now().Format(time.RFC3339),
+		Config:    repoConfig,
+		Manifests: manifests,
+	})
+	if err != nil {
+		return failure.Wrap(failure.Config, err, "Uh oh, couldn't evaluate the policies")
+	}
+
+	for _, message := range decision.Warn {
+		logger.Warn("=> Heads up, a policy says: %s", message)
+	}
+	if len(decision.Deny) > 0 {
+		for _, message := range decision.Deny {
+			logger.Error("\t%s", message)
+		}
+		return failure.New(failure.PolicyDenied, "Sorry, the policies don't allow '%s' for %s in %s", commandName, repoConfig.Application.Name, repoConfig.Namespace)
+	}
+	logger.Info("=> The policies are happy with that.")
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/kube/api"
+	"github.com/mycujoo/kube-deploy/logger"
+
+	"k8s.io/api/extensions/v1beta1"
+)
+
+const (
+	defaultMinAvailablePercent     = 100
+	defaultScaleDownTimeoutSeconds = 300
+)
+
+// Scales the old Deployment down to zero in steps, only removing pods while the new release has enough ready pods
+// to take over and no PodDisruptionBudget would be broken. Returns an error if it gave up waiting for enough capacity.
+func kubeSafeScaleDown(oldDeploymentName string, newDeploymentName string, desiredPods int32) error {
+	minAvailablePercent := repoConfig.Rollout.MinAvailablePercent
+	if minAvailablePercent <= 0 {
+		minAvailablePercent = defaultMinAvailablePercent
+	}
+	timeoutSeconds := repoConfig.Rollout.ScaleDownTimeoutSeconds
+	if timeoutSeconds <= 0 {
+		timeoutSeconds = defaultScaleDownTimeoutSeconds
+	}
+	requiredPods := int32(math.Ceil(float64(desiredPods) * float64(minAvailablePercent) / 100))
+
+	for {
+		oldDeployment, err := kubeapi.GetSingleDeployment(oldDeploymentName)
+		if err != nil {
+			return err
+		}
+		currentPods := *oldDeployment.Spec.Replicas
+		if currentPods <= 0 {
+			return nil
+		}
+
+		// Without a configured step, remove all of the old pods at once
+		step := repoConfig.Rollout.ScaleDownStep
+		if step <= 0 || step > currentPods {
+			step = currentPods
+		}
+		nextPods := currentPods - step
+
+		hasCapacity, err := kubeWaitForCapacity(oldDeployment, newDeploymentName, requiredPods, step, time.Duration(timeoutSeconds)*time.Second)
+		if err != nil {
+			return err
+		}
+		if !hasCapacity {
+			return failure.New(failure.RolloutAborted, "Scaling down %s any further isn't safe, so I'm giving up", oldDeploymentName)
+		}
+
+		logger.Info("=> Scaling %s down from %d to %d pod(s).\n", oldDeploymentName, currentPods, nextPods)
+		if nextPods > 0 {
+			// An HPA would scale the old release straight back up again, unless it's pinned to the new size too
+			if err := kubePinAutoscaler(oldDeploymentName, nextPods); err != nil {
+				return err
+			}
+		}
+		if _, err := kubeapi.UpdateDeployment(oldDeploymentName, func(deployment *v1beta1.Deployment) {
+			deployment.Spec.Replicas = &nextPods
+		}); err != nil {
+			return err
+		}
+		if err := kubeWaitForRolloutStatus(oldDeploymentName); err != nil {
+			return err
+		}
+		kubeRecordEvent(oldDeploymentName, eventScaledDown, fmt.Sprintf("Scaled down from %d to %d pod(s), handing over to %s.", currentPods, nextPods, newDeploymentName))
+	}
+}
+
+func kubeWaitForCapacity(oldDeployment *v1beta1.Deployment, newDeploymentName string, requiredPods int32, podsToRemove int32, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		hasCapacity, err := kubeHasCapacity(oldDeployment, newDeploymentName, requiredPods, podsToRemove)
+		if err != nil || hasCapacity {
+			return hasCapacity, err
+		}
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+		if err := cli.Sleep(5 * time.Second); err != nil {
+			return false, err
+		}
+	}
+}
+
+func kubeHasCapacity(oldDeployment *v1beta1.Deployment, newDeploymentName string, requiredPods int32, podsToRemove int32) (bool, error) {
+	newDeployment, err := kubeapi.GetSingleDeployment(newDeploymentName)
+	if err != nil {
+		return false, err
+	}
+	if readyPods := newDeployment.Status.ReadyReplicas; readyPods < requiredPods {
+		logger.Info("=> Only %d of the %d pod(s) needed in %s are ready, so I'll wait before scaling down.\n", readyPods, requiredPods, newDeploymentName)
+		return false, nil
+	}
+
+	pdbs, err := kubeapi.ListPodDisruptionBudgetsForLabels(oldDeployment.Spec.Template.Labels)
+	if err != nil {
+		return false, err
+	}
+	for _, pdb := range pdbs {
+		if pdb.Status.CurrentHealthy-podsToRemove < pdb.Status.DesiredHealthy {
+			logger.Info("=> Removing %d pod(s) would break the PodDisruptionBudget %s (%d healthy, %d required), so I'll wait before scaling down.\n",
+				podsToRemove, pdb.Name, pdb.Status.CurrentHealthy, pdb.Status.DesiredHealthy)
+			return false, nil
+		}
+	}
+	return true, nil
+}
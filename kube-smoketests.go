@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/kube/api"
+	"github.com/mycujoo/kube-deploy/logger"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/api/extensions/v1beta1"
+)
+
+const defaultSmokeTestTimeoutSeconds = 60
+
+// Runs all of the smoke tests against the pods of the given release, stopping at the first failure
+func kubeRunSmokeTests(deployment *v1beta1.Deployment) error {
+	if len(repoConfig.SmokeTests) == 0 {
+		return nil
+	}
+	logger.Info("\n=> Running %d smoke test(s) against the new release.\n", len(repoConfig.SmokeTests))
+
+	for _, smokeTest := range repoConfig.SmokeTests {
+		timeoutSeconds := smokeTest.TimeoutSeconds
+		if timeoutSeconds <= 0 {
+			timeoutSeconds = defaultSmokeTestTimeoutSeconds
+		}
+		timeout := time.Duration(timeoutSeconds) * time.Second
+
+		var err error
+		switch t := smokeTest.Type; t {
+		case "job":
+			err = kubeRunHook(smokeTest.Name, smokeTest.Template, timeout)
+		case "http", "":
+			err = kubeSmokeTestHTTP(deployment, smokeTest.Port, smokeTest.Path, smokeTest.ExpectBody, timeout)
+		default:
+			err = failure.New(failure.Config, "I don't know how to run a smoke test of type '%s'", t)
+		}
+
+		if err != nil {
+			// Keeping the kind, so an interruption is still one
+			return failure.Wrap(failure.KindOf(err), err, "Uh oh, the smoke test '%s' failed", smokeTest.Name)
+		}
+		logger.Info("=> Smoke test '%s' passed.\n", smokeTest.Name)
+	}
+	return nil
+}
+
+// Sends a GET request to every ready pod of the release (through the API server), retrying until they all pass or the timeout is reached
+func kubeSmokeTestHTTP(deployment *v1beta1.Deployment, port int, path string, expectBody string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		failures := 0
+		pods, err := kubeReadyPods(deployment)
+		if err != nil {
+			return err
+		}
+		for _, pod := range pods {
+			body, err := kubeapi.ProxyGetPod(pod.Name, port, path)
+			if err != nil {
+				logger.Warn("=> GET %s on pod %s failed: %s\n", path, pod.Name, err)
+				failures++
+			} else if !strings.Contains(string(body), expectBody) {
+				logger.Warn("=> GET %s on pod %s didn't contain the expected text '%s'.\n", path, pod.Name, expectBody)
+				failures++
+			}
+		}
+		if len(pods) > 0 && failures == 0 {
+			return nil
+		}
+		if len(pods) == 0 {
+			logger.Warn("=> There aren't any ready pods to test yet.")
+		}
+		if time.Now().After(deadline) {
+			return failure.New(failure.RolloutAborted, "GET %s didn't succeed on every ready pod within %s", path, timeout)
+		}
+		if err := cli.Sleep(5 * time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+func kubeReadyPods(deployment *v1beta1.Deployment) ([]v1.Pod, error) {
+	pods, err := kubeapi.ListPods(deployment.Spec.Template.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	var readyPods []v1.Pod
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != v1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue {
+				readyPods = append(readyPods, pod)
+			}
+		}
+	}
+	return readyPods, nil
+}
@@ -1,131 +1,96 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"regexp"
 	"strings"
-	"text/template"
 
 	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/kube/api"
+	"github.com/mycujoo/kube-deploy/logger"
 )
 
 // Returns a list of the filenames of the filled-out templates
-func kubeMakeTemplates() []string {
+func kubeMakeTemplates() ([]string, error) {
 	os.MkdirAll(repoConfig.PWD+"/.kubedeploy-temp", 0755)
 
 	templateFiles, err := ioutil.ReadDir(repoConfig.Application.PathToKubernetesFiles)
 	if err != nil {
-		fmt.Println("=> Unable to get list of kubernetes files.")
-		os.Exit(1)
+		return nil, failure.Wrap(failure.Config, err, "Unable to get list of kubernetes files")
 	}
 
 	var filePaths []string
 	for _, filePointer := range templateFiles {
 		filename := filePointer.Name()
-		fmt.Printf("=> Generating YAML from template for %s\n", filename)
-		kubeFileTemplated := runConsulTemplate(repoConfig.Application.PathToKubernetesFiles + "/" + filename)
+		logger.Info("=> Generating YAML from template for %s\n", filename)
+		kubeFileTemplated, err := runConsulTemplate(repoConfig.Application.PathToKubernetesFiles + "/" + filename)
+		if err != nil {
+			return filePaths, err
+		}
 
 		tempFilePath := repoConfig.PWD + "/.kubedeploy-temp/" + filename
-		err := ioutil.WriteFile(tempFilePath, []byte(kubeFileTemplated), 0644)
-		if err != nil {
-			fmt.Println(err)
+		if err := ioutil.WriteFile(tempFilePath, []byte(kubeFileTemplated), 0644); err != nil {
+			return filePaths, err
 		}
 		filePaths = append(filePaths, tempFilePath)
 	}
-	return filePaths
+	return filePaths, nil
 }
 
 func kubeRemoveTemplates() {
 	if runFlags.Bool("keep-kubernetes-template-files") {
-		fmt.Println("=> Leaving the templated files, like you asked.")
+		logger.Info("=> Leaving the templated files, like you asked.")
 	} else {
 		os.RemoveAll(repoConfig.PWD + "/.kubedeploy-temp")
 	}
 }
 
-func runConsulTemplate(filename string) string {
+func runConsulTemplate(filename string) (string, error) {
+	// The variables only go to consul-template, so one application's variables can't turn up in another's templates
+	var env []string
 	vaultAddr := os.Getenv("VAULT_ADDR")
 	if vaultAddr != "" {
 		vaultAddr = fmt.Sprintf("--vault-renew-token=false --vault-retry=false --vault-addr %s", vaultAddr)
-		os.Setenv("SECRETS_LOCATION", repoConfig.Namespace)
+		env = append(env, "SECRETS_LOCATION="+repoConfig.Namespace)
 	}
 	consulTemplateArgs := fmt.Sprintf("%s -template %s -once -dry", vaultAddr, filename)
 
-	// the map which will contain all environment variables to be set before running consul-template
-	envMap := make(map[string]string)
-
-	// Include the template freebie variables
-	envMap["KD_RELEASE_NAME"] = repoConfig.ReleaseName
-	envMap["KD_APP_NAME"] = repoConfig.Application.Name + "-" + repoConfig.GitBranch
-	envMap["KD_KUBERNETES_NAMESPACE"] = repoConfig.Namespace
-	envMap["KD_GIT_BRANCH"] = repoConfig.GitBranch
-	envMap["KD_GIT_SHA"] = repoConfig.GitSHA
-	envMap["KD_IMAGE_FULL_PATH"] = repoConfig.ImageFullPath
-	envMap["KD_IMAGE_TAG"] = repoConfig.ImageTag
-
-	environmentToBranchMappings := map[string][]string{
-		"production":  []string{"production"},
-		"staging":     []string{"master", "staging"},
-		"development": []string{"else", "dev"},
-		"acceptance":  []string{"acceptance"},
+	variables, err := templateVariables()
+	if err != nil {
+		return "", err
 	}
-
-	headingToLookFor := environmentToBranchMappings[repoConfig.Namespace]
-	branchNameHeadings := repoConfig.Application.KubernetesTemplate.BranchVariables
-	re := regexp.MustCompile(fmt.Sprintf("(%s),?", strings.Join(headingToLookFor, "|")))
-
-	// Parse and add the global env vars
-	for _, envVar := range repoConfig.Application.KubernetesTemplate.GlobalVariables {
-		split := strings.Split(envVar, "=")
-		envMap[split[0]] = split[1]
+	for _, v := range variables {
+		env = append(env, v.Name+"="+v.Value)
 	}
 
-	if runFlags.Bool("debug") {
-		fmt.Println("=> Here's the regex I'm going to use for matching branches (templating process): ", re.String())
-	}
-	// Loop over the branch names we would match with
-	// loop over the un-split headings
-	for heading := range branchNameHeadings {
-		// splitBranches := strings.Split(heading, ",")
-		if re.MatchString(heading) {
-			for _, envVar := range branchNameHeadings[heading] {
-				split := strings.Split(envVar, "=")
-				envMap[split[0]] = split[1]
-			}
+	if logger.IsDebug() {
+		logger.Debug("=> Here are the template variables I'm passing to consul-template:")
+		for _, v := range variables {
+			logger.Debug("\t%s=%s", v.Name, v.Value)
 		}
 	}
 
-	if runFlags.Bool("debug") {
-		fmt.Println(envMap)
+	output, exitCode := cli.GetCommandOutputAndExitCodeWithEnv("consul-template", consulTemplateArgs, env)
+	if exitCode != 0 {
+		return "", failure.New(failure.Config, "Oh no, looks like consul-template failed!")
 	}
 
-	// Add the variables to the environment, doing any inline substitutions
-	for key, value := range envMap {
-		var envVarBuf bytes.Buffer
-		tmplVar, err := template.New("EnvVar: " + key).Parse(value)
-		err = tmplVar.Execute(&envVarBuf, envMap)
-		if err != nil {
-			fmt.Println("=> Uh oh, failed to do a substitution in one of your template variables.")
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		os.Setenv(key, envVarBuf.String())
+	rendered := strings.Join(strings.Split(output, "\n")[1:], "\n")
+	for _, value := range kubeapi.SecretValues([]byte(rendered)) {
+		logger.AddSecret(value)
 	}
+	return rendered, nil
+}
 
-	if runFlags.Bool("debug") {
-		for _, i := range os.Environ() {
-			fmt.Println(i)
+// Template variables which look like they hold credentials are redacted from the output
+func isSecretVariable(name string) bool {
+	upperName := strings.ToUpper(name)
+	for _, marker := range []string{"SECRET", "PASSWORD", "PASSWD", "TOKEN", "KEY", "CREDENTIAL"} {
+		if strings.Contains(upperName, marker) {
+			return true
 		}
 	}
-
-	output, exitCode := cli.GetCommandOutputAndExitCode("consul-template", consulTemplateArgs)
-	if exitCode != 0 {
-		fmt.Println("=> Oh no, looks like consul-template failed!")
-		os.Exit(1)
-	}
-
-	return strings.Join(strings.Split(output, "\n")[1:], "\n")
+	return false
 }
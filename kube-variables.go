@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/mycujoo/kube-deploy/config"
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/logger"
+)
+
+// Where a template variable came from, besides the variable sources
+const (
+	variableSourceGlobal  = "globalVariables"
+	variableSourceFreebie = "kube-deploy"
+)
+
+// templateVariable : a variable for the Kubernetes templates, and where it came from
+type templateVariable struct {
+	Name      string   `json:"name" yaml:"name"`
+	Value     string   `json:"value" yaml:"value"` // After any substitutions
+	Source    string   `json:"source" yaml:"source"`
+	Overrides []string `json:"overrides,omitempty" yaml:"overrides,omitempty"` // The sources it beat, lowest precedence first
+	raw       string   // As it's written, before any substitutions
+}
+
+// The 'KD_' variables kube-deploy works out for itself, sorted by name
+func templateFreebies() []config.Variable {
+	freebies := []config.Variable{
+		{Name: "KD_RELEASE_NAME", Value: repoConfig.ReleaseName},
+		{Name: "KD_APP_NAME", Value: repoConfig.Application.Name + "-" + repoConfig.GitBranch},
+		{Name: "KD_KUBERNETES_NAMESPACE", Value: repoConfig.Namespace},
+		{Name: "KD_GIT_BRANCH", Value: repoConfig.GitBranch},
+		{Name: "KD_GIT_SHA", Value: repoConfig.GitSHA},
+		{Name: "KD_IMAGE_FULL_PATH", Value: repoConfig.ImageFullPath},
+		{Name: "KD_IMAGE_TAG", Value: repoConfig.ImageTag},
+	}
+	sort.Slice(freebies, func(i, j int) bool { return freebies[i].Name < freebies[j].Name })
+	return freebies
+}
+
+// Resolved once per release, since the variable commands might be slow
+var templateVariablesCache = make(map[string][]*templateVariable)
+
+func templateVariables() ([]*templateVariable, error) {
+	if variables, ok := templateVariablesCache[repoConfig.ReleaseName]; ok {
+		return variables, nil
+	}
+	variables, err := resolveTemplateVariables()
+	if err != nil {
+		return nil, err
+	}
+	templateVariablesCache[repoConfig.ReleaseName] = variables
+	return variables, nil
+}
+
+// Works out every template variable for the current branch, sorted by name. From lowest precedence to highest,
+// they come from the 'KD_' freebies, the variableSources (in order), the globalVariables, and the matching branchVariables.
+func resolveTemplateVariables() ([]*templateVariable, error) {
+	variables := make(map[string]*templateVariable)
+	set := func(v config.Variable, source string) {
+		if existing, ok := variables[v.Name]; ok {
+			existing.Overrides = append(existing.Overrides, existing.Source)
+			existing.raw, existing.Source = v.Value, source
+			return
+		}
+		variables[v.Name] = &templateVariable{Name: v.Name, raw: v.Value, Source: source}
+	}
+
+	// Like it always has, a variable set in the deploy.yaml wins over kube-deploy's own
+	freebies := templateFreebies()
+	for _, freebie := range freebies {
+		set(freebie, variableSourceFreebie)
+	}
+
+	for _, variableSource := range repoConfig.Application.KubernetesTemplate.VariableSources {
+		sourceVariables, source, err := readVariableSource(variableSource.File, variableSource.Command, variableSource.VariableFormat(), variableSource.Optional, freebies)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range sourceVariables {
+			set(v, source)
+		}
+	}
+
+	for _, envVar := range repoConfig.Application.KubernetesTemplate.GlobalVariables {
+		name, value, err := config.ParseVariable(envVar)
+		if err != nil {
+			return nil, failure.Wrap(failure.Config, err, "Uh oh, one of your global template variables is broken")
+		}
+		set(config.Variable{Name: name, Value: value}, variableSourceGlobal)
+	}
+
+	environmentToBranchMappings := map[string][]string{
+		"production":  []string{"production"},
+		"staging":     []string{"master", "staging"},
+		"development": []string{"else", "dev"},
+		"acceptance":  []string{"acceptance"},
+	}
+	headingToLookFor := environmentToBranchMappings[repoConfig.Namespace]
+	re := regexp.MustCompile(fmt.Sprintf("(%s),?", strings.Join(headingToLookFor, "|")))
+	logger.Debug("=> Here's the regex I'm going to use for matching branches (templating process): %s", re.String())
+
+	// Sorted, so it's always the same heading that wins when more than one matches
+	branchNameHeadings := repoConfig.Application.KubernetesTemplate.BranchVariables
+	var headings []string
+	for heading := range branchNameHeadings {
+		headings = append(headings, heading)
+	}
+	sort.Strings(headings)
+	for _, heading := range headings {
+		if !re.MatchString(heading) {
+			continue
+		}
+		for _, envVar := range branchNameHeadings[heading] {
+			name, value, err := config.ParseVariable(envVar)
+			if err != nil {
+				return nil, failure.Wrap(failure.Config, err, "Uh oh, one of your '%s' template variables is broken", heading)
+			}
+			set(config.Variable{Name: name, Value: value}, fmt.Sprintf("branchVariables[%s]", heading))
+		}
+	}
+
+	for _, freebie := range freebies {
+		if v := variables[freebie.Name]; v.Source != variableSourceFreebie {
+			logger.Warn("=> Heads up: %s comes from %s, instead of being the one kube-deploy works out itself ('%s').", freebie.Name, v.Source, freebie.Value)
+		}
+	}
+
+	if err := substituteVariables(variables); err != nil {
+		return nil, err
+	}
+	var resolved []*templateVariable
+	for _, v := range variables {
+		if isSecretVariable(v.Name) {
+			logger.AddSecret(v.Value)
+		}
+		resolved = append(resolved, v)
+	}
+	sort.Slice(resolved, func(i, j int) bool { return resolved[i].Name < resolved[j].Name })
+	return resolved, nil
+}
+
+// Does the inline substitutions (like 'DOMAIN={{.KD_GIT_BRANCH}}.example.com'), resolving each variable after the
+// ones it refers to, so substitutions can refer to other substitutions
+func substituteVariables(variables map[string]*templateVariable) error {
+	templates := make(map[string]*template.Template)
+	references := make(map[string][]string)
+	var names []string
+	for name, v := range variables {
+		tmplVar, err := template.New(name).Option("missingkey=error").Parse(v.raw)
+		if err != nil {
+			return failure.Wrap(failure.Config, err, "Uh oh, the template variable %s (from %s) has a broken substitution", name, v.Source)
+		}
+		templates[name] = tmplVar
+		references[name] = templateReferences(tmplVar.Tree.Root)
+		for _, reference := range references[name] {
+			if _, ok := variables[reference]; !ok {
+				return failure.New(failure.Config, "Uh oh, the template variable %s (from %s) refers to %s, which isn't a template variable", name, v.Source, reference)
+			}
+		}
+		names = append(names, name)
+	}
+	// Sorted, so the order (and any cycle reported) is the same every time
+	sort.Strings(names)
+
+	// A depth-first topological sort - 'visiting' is the path being followed, so meeting it again means a cycle
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var order []string
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			cycle := append(path[indexOf(path, name):], name)
+			return failure.New(failure.Config, "Uh oh, these template variables refer to each other in a circle, so they can't be worked out: %s", strings.Join(cycle, " -> "))
+		}
+		state[name] = visiting
+		path = append(path, name)
+		for _, reference := range references[name] {
+			if err := visit(reference); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+
+	values := make(map[string]string)
+	for _, name := range order {
+		var valueBuf bytes.Buffer
+		if err := templates[name].Execute(&valueBuf, values); err != nil {
+			return failure.Wrap(failure.Config, err, "Uh oh, failed to do the substitution in the template variable %s (from %s)", name, variables[name].Source)
+		}
+		values[name] = valueBuf.String()
+		variables[name].Value = values[name]
+	}
+	return nil
+}
+
+// The variables a template refers to (as '{{.NAME}}'), sorted and without duplicates
+func templateReferences(node parse.Node) []string {
+	found := make(map[string]bool)
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, child := range n.Nodes {
+					walk(child)
+				}
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n != nil {
+				for _, cmd := range n.Cmds {
+					walk(cmd)
+				}
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.FieldNode:
+			found[n.Ident[0]] = true
+		case *parse.ChainNode:
+			walk(n.Node)
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		}
+	}
+	walk(node)
+
+	var references []string
+	for name := range found {
+		references = append(references, name)
+	}
+	sort.Strings(references)
+	return references
+}
+
+func indexOf(list []string, s string) int {
+	for i, item := range list {
+		if item == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// Reads the variables from a file or the output of a command, and describes where they came from.
+// Commands are run from the app directory through 'sh', with the 'KD_' freebies in their environment.
+func readVariableSource(file string, command string, format string, optional bool, freebies []config.Variable) ([]config.Variable, string, error) {
+	var data []byte
+	var source string
+	switch {
+	case file != "":
+		file = strings.Replace(file, "{environment}", repoConfig.Namespace, -1)
+		source = "file " + file
+		var err error
+		if data, err = ioutil.ReadFile(file); err != nil {
+			if optional && os.IsNotExist(err) {
+				logger.Debug("=> The optional variable file %s doesn't exist, so I'm skipping it.", file)
+				return nil, source, nil
+			}
+			return nil, source, failure.Wrap(failure.Config, err, "Couldn't read the template variables in %s", file)
+		}
+	case command != "":
+		source = "command " + command
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = os.Environ()
+		for _, freebie := range freebies {
+			cmd.Env = append(cmd.Env, freebie.Name+"="+freebie.Value)
+		}
+		cmd.Stderr = os.Stderr
+		var err error
+		if data, err = cmd.Output(); err != nil {
+			return nil, source, failure.Wrap(failure.Config, err, "Uh oh, the command '%s' for the template variables failed", command)
+		}
+	default:
+		return nil, "", failure.New(failure.Config, "Uh oh - every one of your variableSources needs a 'file' or a 'command'")
+	}
+
+	variables, err := config.ReadVariables(data, format)
+	if err != nil {
+		return nil, source, failure.Wrap(failure.Config, err, "Couldn't read the template variables from %s", source)
+	}
+	return variables, source, nil
+}
+
+// Prints the template variables for the current branch, and where each one came from
+func printTemplateVariables() error {
+	variables, err := resolveTemplateVariables()
+	if err != nil {
+		return err
+	}
+	if !runFlags.Bool("show-secrets") {
+		for _, v := range variables {
+			if isSecretVariable(v.Name) {
+				v.Value = "<redacted>"
+			}
+		}
+	}
+
+	return printOutput(variables, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tVALUE\tSOURCE")
+		for _, v := range variables {
+			source := v.Source
+			if len(v.Overrides) > 0 {
+				source += fmt.Sprintf(" (overrides %s)", strings.Join(v.Overrides, ", "))
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", v.Name, v.Value, source)
+		}
+		tw.Flush()
+	})
+}
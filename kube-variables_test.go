@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mycujoo/kube-deploy/config"
+	"github.com/mycujoo/kube-deploy/failure"
+)
+
+func TestSubstituteVariables(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     map[string]string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "no substitutions",
+			raw:  map[string]string{"A": "1", "B": "two"},
+			want: map[string]string{"A": "1", "B": "two"},
+		},
+		{
+			name: "a chain",
+			raw:  map[string]string{"A": "{{.B}}.example.com", "B": "{{.C}}-api", "C": "master"},
+			want: map[string]string{"A": "master-api.example.com", "B": "master-api", "C": "master"},
+		},
+		{
+			name: "shared references",
+			raw:  map[string]string{"URL": "https://{{.HOST}}:{{.PORT}}", "HOST": "{{.BRANCH}}.dev", "PORT": "80", "BRANCH": "feature", "LABEL": "{{.BRANCH}}/{{.PORT}}"},
+			want: map[string]string{"URL": "https://feature.dev:80", "HOST": "feature.dev", "PORT": "80", "BRANCH": "feature", "LABEL": "feature/80"},
+		},
+		{
+			name: "references inside actions",
+			raw:  map[string]string{"A": `{{if .DEBUG}}debug-{{.B}}{{else}}{{.B}}{{end}}`, "B": "api", "DEBUG": "yes"},
+			want: map[string]string{"A": "debug-api", "B": "api", "DEBUG": "yes"},
+		},
+		{
+			name:    "a variable referring to itself",
+			raw:     map[string]string{"A": "{{.A}}"},
+			wantErr: "A -> A",
+		},
+		{
+			name:    "a cycle",
+			raw:     map[string]string{"A": "{{.B}}", "B": "{{.C}}", "C": "{{.A}}", "D": "ok"},
+			wantErr: "A -> B -> C -> A",
+		},
+		{
+			name:    "a cycle further down",
+			raw:     map[string]string{"A": "{{.B}}", "B": "{{.C}}", "C": "{{.B}}"},
+			wantErr: "B -> C -> B",
+		},
+		{
+			name:    "an unknown reference",
+			raw:     map[string]string{"A": "{{.B}}", "B": "{{.MISSING}}"},
+			wantErr: "refers to MISSING, which isn't a template variable",
+		},
+		{
+			name:    "a broken substitution",
+			raw:     map[string]string{"A": "{{.B"},
+			wantErr: "broken substitution",
+		},
+	}
+	for _, test := range tests {
+		variables := make(map[string]*templateVariable)
+		for name, raw := range test.raw {
+			variables[name] = &templateVariable{Name: name, raw: raw, Source: variableSourceGlobal}
+		}
+
+		err := substituteVariables(variables)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: substituteVariables() = %v, want an error containing %q", test.name, err, test.wantErr)
+			} else if !failure.Is(err, failure.Config) {
+				t.Errorf("%s: substituteVariables() = %v, want a Config failure", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: substituteVariables() = %v", test.name, err)
+			continue
+		}
+		for name, want := range test.want {
+			if got := variables[name].Value; got != want {
+				t.Errorf("%s: %s = %q, want %q", test.name, name, got, want)
+			}
+		}
+	}
+}
+
+func TestResolveTemplateVariablesLetsTheDeployYamlWin(t *testing.T) {
+	defer func(saved config.RepoConfigMap) { repoConfig = saved }(repoConfig)
+	repoConfig.Application.Name = "api"
+	repoConfig.GitBranch = "master"
+	repoConfig.Namespace = "staging"
+	repoConfig.ReleaseName = "api-master-abc1234"
+	repoConfig.Application.KubernetesTemplate.GlobalVariables = []string{"KD_GIT_BRANCH=main", "DOMAIN={{.KD_GIT_BRANCH}}.example.com", "LEVEL=info"}
+	repoConfig.Application.KubernetesTemplate.BranchVariables = map[string][]string{"master": {"LEVEL=debug"}}
+
+	variables, err := resolveTemplateVariables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]templateVariable)
+	for _, v := range variables {
+		got[v.Name] = templateVariable{Value: v.Value, Source: v.Source, Overrides: v.Overrides}
+	}
+	want := map[string]templateVariable{
+		"KD_GIT_BRANCH":   {Value: "main", Source: variableSourceGlobal, Overrides: []string{variableSourceFreebie}},
+		"DOMAIN":          {Value: "main.example.com", Source: variableSourceGlobal},
+		"LEVEL":           {Value: "debug", Source: "branchVariables[master]", Overrides: []string{variableSourceGlobal}},
+		"KD_RELEASE_NAME": {Value: "api-master-abc1234", Source: variableSourceFreebie},
+	}
+	for name, want := range want {
+		if !reflect.DeepEqual(got[name], want) {
+			t.Errorf("%s = %+v, want %+v", name, got[name], want)
+		}
+	}
+}
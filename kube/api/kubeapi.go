@@ -1,10 +1,13 @@
 package kubeapi
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 
+	"github.com/mycujoo/kube-deploy/logger"
+
 	"k8s.io/api/core/v1"
 	"k8s.io/api/extensions/v1beta1"
 
@@ -21,14 +24,13 @@ import (
 var clientSet *kubernetes.Clientset
 var namespace string
 
-func Setup(namespaceParam string) *kubernetes.Clientset {
+func Setup(namespaceParam string) (*kubernetes.Clientset, error) {
 
 	var kubeconfig string
 	var homeDir string
 
 	if homeDir = os.Getenv("HOME"); homeDir == "" {
-		fmt.Println("=> Oh no! Couldn't figure out what your homedir is, please set the environment variable $HOME.")
-		os.Exit(1)
+		return nil, errors.New("Oh no! Couldn't figure out what your homedir is, please set the environment variable $HOME")
 	}
 
 	kubeconfig = filepath.Join(homeDir, ".kube", "config")
@@ -36,48 +38,48 @@ func Setup(namespaceParam string) *kubernetes.Clientset {
 	// use the current context in kubeconfig
 	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 
 	// create the clientset
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		panic(err.Error())
+		return nil, err
 	}
 
 	clientSet = clientset
 	namespace = namespaceParam
-	return clientset
+	return clientset, nil
 }
 
-func GetSingleDeployment(name string) *v1beta1.Deployment {
-	deployment, _ := clientSet.
+func GetSingleDeployment(name string) (*v1beta1.Deployment, error) {
+	return clientSet.
 		ExtensionsV1beta1().Deployments(namespace).
 		Get(name, metav1.GetOptions{})
-	// Return even if nil
-	return deployment
 }
 
-func UpdateDeployment(name string, callback func(*v1beta1.Deployment)) *v1beta1.Deployment {
+func UpdateDeployment(name string, callback func(*v1beta1.Deployment)) (*v1beta1.Deployment, error) {
 
 	var deployment *v1beta1.Deployment
 
 	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		// Retrieve the latest version of Deployment before attempting update
 		// RetryOnConflict uses exponential backoff to avoid exhausting the apiserver
-		// result, getErr := deploymentsClient.Get("demo-deployment", metav1.GetOptions{})
-		deployment = GetSingleDeployment(name)
+		var getErr error
+		if deployment, getErr = GetSingleDeployment(name); getErr != nil {
+			return getErr
+		}
 		callback(deployment)
 		_, updateErr := clientSet.ExtensionsV1beta1().Deployments(namespace).
 			Update(deployment)
 		return updateErr
 	})
 	if retryErr != nil {
-		panic(fmt.Errorf("Update failed: %v", retryErr))
+		return nil, fmt.Errorf("updating deployment %s failed: %v", name, retryErr)
 	}
-	fmt.Printf("=> Updated deployment %s.\n", deployment.Name)
+	logger.Info("=> Updated deployment %s.\n", deployment.Name)
 
-	return deployment
+	return deployment, nil
 }
 
 func AddDeploymentLabel(deployment *v1beta1.Deployment, key string, value string) {
@@ -90,52 +92,38 @@ func RemoveDeploymentLabel(deployment *v1beta1.Deployment, key string) {
 	delete(existingLabels, key)
 }
 
-func DeleteDeployment(deployment *v1beta1.Deployment) {
+func DeleteDeployment(deployment *v1beta1.Deployment) error {
 	deletePolicy := metav1.DeletePropagationForeground
 
-	if err := clientSet.
+	return clientSet.
 		ExtensionsV1beta1().Deployments(namespace).
 		Delete(deployment.Name, &metav1.DeleteOptions{
 			PropagationPolicy: &deletePolicy,
-		}); err != nil {
-		panic(err.Error())
-	}
+		})
 }
 
-func DeleteService(service *v1.Service) {
-	if err := clientSet.CoreV1().Services(namespace).
-		Delete(service.Name, nil); err != nil {
-		panic(err.Error())
-	}
+func DeleteService(service *v1.Service) error {
+	return clientSet.CoreV1().Services(namespace).
+		Delete(service.Name, nil)
 }
 
-func DeleteSecret(secret *v1.Secret) {
-	if err := clientSet.CoreV1().Secrets(namespace).
-		Delete(secret.Name, nil); err != nil {
-		panic(err.Error())
-	}
+func DeleteSecret(secret *v1.Secret) error {
+	return clientSet.CoreV1().Secrets(namespace).
+		Delete(secret.Name, nil)
 }
 
-func DeleteIngress(ingress *v1beta1.Ingress) {
-	if err := clientSet.ExtensionsV1beta1().Ingresses(namespace).
-		Delete(ingress.Name, nil); err != nil {
-		panic(err.Error())
-	}
+func DeleteIngress(ingress *v1beta1.Ingress) error {
+	return clientSet.ExtensionsV1beta1().Ingresses(namespace).
+		Delete(ingress.Name, nil)
 }
 
-func ListDeployments(labelFilter map[string]string) *v1beta1.DeploymentList {
+func ListDeployments(labelFilter map[string]string) (*v1beta1.DeploymentList, error) {
 
 	label := labels.Set(labelFilter)
 
-	deployments, err := clientSet.
+	return clientSet.
 		ExtensionsV1beta1().Deployments(namespace).
 		List(metav1.ListOptions{LabelSelector: label.String()})
-
-	if err != nil {
-		panic(err.Error())
-	}
-
-	return deployments
 	// // Examples for error handling:
 	// // - Use helper functions like e.g. errors.IsNotFound()
 	// // - And/or cast to StatusError and use its properties like e.g. ErrStatus.Message
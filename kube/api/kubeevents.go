@@ -0,0 +1,42 @@
+package kubeapi
+
+import (
+	"time"
+
+	"github.com/mycujoo/kube-deploy/logger"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RecordDeploymentEvent adds an Event to the Deployment, so that 'kubectl describe' shows what kube-deploy did to it.
+// Events are only informational, so failing to create one doesn't stop anything.
+func RecordDeploymentEvent(deployment *v1beta1.Deployment, eventType string, reason string, message string) {
+	now := metav1.NewTime(time.Now())
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: deployment.Name + ".",
+			Namespace:    namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:            "Deployment",
+			APIVersion:      "extensions/v1beta1",
+			Name:            deployment.Name,
+			Namespace:       namespace,
+			UID:             deployment.UID,
+			ResourceVersion: deployment.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         v1.EventSource{Component: "kube-deploy"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+
+	if _, err := clientSet.CoreV1().Events(namespace).Create(event); err != nil {
+		logger.Warn("=> I couldn't record the event '%s' on %s: %s\n", reason, deployment.Name, err)
+	}
+}
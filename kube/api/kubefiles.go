@@ -1,9 +1,18 @@
 package kubeapi
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"runtime/debug"
 
+	"github.com/mycujoo/kube-deploy/logger"
+
+	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/kubernetes/scheme"
 )
 
@@ -13,9 +22,80 @@ func ParseKubeFile(fileContents []byte) runtime.Object {
 	obj, _, err := decode(fileContents, nil, nil)
 
 	if err != nil {
-		fmt.Println(fmt.Sprintf("=> Error while decoding YAML into kube object. Err was: %s", err))
+		logger.Error("=> Error while decoding YAML into kube object. Err was: %s", err)
 		return nil
 	}
 
 	return obj
 }
+
+// SecretValues returns the values in the file if it's a Secret (which is where values from Vault usually end up), or nothing otherwise
+func SecretValues(fileContents []byte) []string {
+	decode := scheme.Codecs.UniversalDeserializer().Decode
+	obj, _, err := decode(fileContents, nil, nil)
+	if err != nil {
+		return nil
+	}
+	secret, ok := obj.(*v1.Secret)
+	if !ok {
+		return nil
+	}
+
+	var values []string
+	for _, value := range secret.Data {
+		// The templates hold the base64 encoded version, so both could turn up in the output
+		values = append(values, string(value), base64.StdEncoding.EncodeToString(value))
+	}
+	for _, value := range secret.StringData {
+		values = append(values, value)
+	}
+	return values
+}
+
+// BuiltInSchemaVersion is the version of the Kubernetes API types (k8s.io/api) kube-deploy was built with
+func BuiltInSchemaVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dependency := range info.Deps {
+			if dependency.Path == "k8s.io/api" {
+				return dependency.Version
+			}
+		}
+	}
+	return "unknown"
+}
+
+// ValidateAgainstBuiltInSchema checks a single YAML object against the Kubernetes API types built into kube-deploy,
+// without needing a cluster - unknown fields and values of the wrong type are errors. That's the schema of
+// BuiltInSchemaVersion, not of the cluster it's going to, so a field or API version only one of them has is reported
+// wrongly. Objects from API groups it doesn't know (like custom resources) can't be checked, so checked is false for those.
+func ValidateAgainstBuiltInSchema(document []byte) (checked bool, err error) {
+	jsonDocument, err := yaml.ToJSON(document)
+	if err != nil {
+		return false, err
+	}
+	var typeMeta runtime.TypeMeta
+	if err := json.Unmarshal(jsonDocument, &typeMeta); err != nil {
+		return false, err
+	}
+	if typeMeta.APIVersion == "" || typeMeta.Kind == "" {
+		return true, fmt.Errorf("it needs an 'apiVersion' and a 'kind'")
+	}
+	gvk := schema.FromAPIVersionAndKind(typeMeta.APIVersion, typeMeta.Kind)
+	if !scheme.Scheme.IsGroupRegistered(gvk.Group) {
+		return false, nil
+	}
+	if !scheme.Scheme.IsVersionRegistered(gvk.GroupVersion()) {
+		return true, fmt.Errorf("'%s' isn't a version of the API group '%s' I know", typeMeta.APIVersion, gvk.Group)
+	}
+	object, err := scheme.Scheme.New(gvk)
+	if err != nil {
+		return true, fmt.Errorf("there's no kind '%s' in '%s'", typeMeta.Kind, typeMeta.APIVersion)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonDocument))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(object); err != nil {
+		return true, err
+	}
+	return true, nil
+}
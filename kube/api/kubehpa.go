@@ -0,0 +1,51 @@
+package kubeapi
+
+import (
+	"fmt"
+
+	"github.com/mycujoo/kube-deploy/logger"
+
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// GetHPAForDeployment returns the HorizontalPodAutoscaler targeting the named Deployment, or nil if there isn't one
+func GetHPAForDeployment(deploymentName string) (*autoscalingv1.HorizontalPodAutoscaler, error) {
+	hpas, err := clientSet.AutoscalingV1().HorizontalPodAutoscalers(namespace).
+		List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hpa := range hpas.Items {
+		if hpa.Spec.ScaleTargetRef.Kind == "Deployment" && hpa.Spec.ScaleTargetRef.Name == deploymentName {
+			return &hpa, nil
+		}
+	}
+	return nil, nil
+}
+
+func UpdateHPA(name string, callback func(*autoscalingv1.HorizontalPodAutoscaler)) (*autoscalingv1.HorizontalPodAutoscaler, error) {
+
+	var hpa *autoscalingv1.HorizontalPodAutoscaler
+
+	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var getErr error
+		hpa, getErr = clientSet.AutoscalingV1().HorizontalPodAutoscalers(namespace).
+			Get(name, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		callback(hpa)
+		_, updateErr := clientSet.AutoscalingV1().HorizontalPodAutoscalers(namespace).
+			Update(hpa)
+		return updateErr
+	})
+	if retryErr != nil {
+		return nil, fmt.Errorf("updating HorizontalPodAutoscaler %s failed: %v", name, retryErr)
+	}
+	logger.Info("=> Updated HorizontalPodAutoscaler %s.\n", hpa.Name)
+
+	return hpa, nil
+}
@@ -0,0 +1,83 @@
+package kubeapi
+
+import (
+	"bufio"
+	"context"
+	"strconv"
+
+	"github.com/mycujoo/kube-deploy/logger"
+
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func GetSingleJob(name string) (*batchv1.Job, error) {
+	return clientSet.BatchV1().Jobs(namespace).
+		Get(name, metav1.GetOptions{})
+}
+
+func CreateJob(job *batchv1.Job) (*batchv1.Job, error) {
+	return clientSet.BatchV1().Jobs(namespace).Create(job)
+}
+
+// DeleteJob removes the Job and its pods, ignoring Jobs which don't exist
+func DeleteJob(name string) error {
+	deletePolicy := metav1.DeletePropagationForeground
+
+	if err := clientSet.BatchV1().Jobs(namespace).
+		Delete(name, &metav1.DeleteOptions{
+			PropagationPolicy: &deletePolicy,
+		}); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func ListPods(labelFilter map[string]string) (*v1.PodList, error) {
+	label := labels.Set(labelFilter)
+
+	return clientSet.CoreV1().Pods(namespace).
+		List(metav1.ListOptions{LabelSelector: label.String()})
+}
+
+// StreamPodLogs follows the logs of a pod until its containers exit, printing each line - or until ctx is done, when it
+// stops following them and returns ctx's error
+func StreamPodLogs(ctx context.Context, podName string) error {
+	stream, err := clientSet.CoreV1().Pods(namespace).
+		GetLogs(podName, &v1.PodLogOptions{Follow: true}).
+		Stream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	// Closing the stream is the only way to stop a read that's waiting for the next line
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			stream.Close()
+		case <-finished:
+		}
+	}()
+
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		logger.Info("\t|  %s", scanner.Text())
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return scanner.Err()
+}
+
+// ProxyGetPod sends an HTTP GET request to a pod through the API server, so the pod doesn't need to be exposed
+func ProxyGetPod(podName string, port int, path string) ([]byte, error) {
+	return clientSet.CoreV1().Pods(namespace).
+		ProxyGet("http", podName, strconv.Itoa(port), path, nil).
+		DoRaw()
+}
@@ -0,0 +1,28 @@
+package kubeapi
+
+import (
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ListPodDisruptionBudgetsForLabels returns the PodDisruptionBudgets which select pods with the given labels
+func ListPodDisruptionBudgetsForLabels(podLabels map[string]string) ([]policyv1beta1.PodDisruptionBudget, error) {
+	pdbs, err := clientSet.PolicyV1beta1().PodDisruptionBudgets(namespace).
+		List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []policyv1beta1.PodDisruptionBudget
+	for _, pdb := range pdbs.Items {
+		selector, err := metav1.LabelSelectorAsSelector(pdb.Spec.Selector)
+		if err != nil || selector.Empty() {
+			continue
+		}
+		if selector.Matches(labels.Set(podLabels)) {
+			matching = append(matching, pdb)
+		}
+	}
+	return matching, nil
+}
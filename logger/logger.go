@@ -0,0 +1,196 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level : how important a message is - only messages at or above the configured level are written
+type Level int
+
+// The log levels, from the chattiest to the quietest
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+// Secrets shorter than this would redact half of every message, so they're left alone
+const minSecretLength = 4
+
+const redacted = "[REDACTED]"
+
+var (
+	mu       sync.Mutex
+	level              = LevelInfo
+	jsonMode           = false
+	out      io.Writer = os.Stdout // For debug and info
+	errOut   io.Writer = os.Stderr // For warn and error
+	logFile  *os.File
+	secrets  []string
+)
+
+type record struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+}
+
+// ParseLevel turns a level name (debug, info, warn or error) into a Level
+func ParseLevel(name string) (Level, error) {
+	for l, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s'", name)
+}
+
+// SetLevel sets the lowest level which is written
+func SetLevel(l Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	level = l
+}
+
+// IsDebug is true when debug messages are being written, for skipping expensive debug output
+func IsDebug() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return level <= LevelDebug
+}
+
+// SetJSON switches between the friendly text output and one JSON object per line (for CI log ingestion)
+func SetJSON(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	jsonMode = enabled
+}
+
+// SetOutput sets where debug and info messages are written - stdout by default. Warnings and errors always go to stderr.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// OpenFile additionally appends every message to the file at path
+func OpenFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	logFile = f
+	return nil
+}
+
+// Close closes the log file, if there is one
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	if logFile != nil {
+		logFile.Close()
+		logFile = nil
+	}
+}
+
+// AddSecret makes sure the value never appears in any message, eg. values read from Vault or secret variables
+func AddSecret(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < minSecretLength {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, s := range secrets {
+		if s == value {
+			return
+		}
+	}
+	secrets = append(secrets, value)
+	// Longer secrets first, in case one secret contains another
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// Redact replaces every known secret in s
+func Redact(s string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	return redact(s)
+}
+
+func redact(s string) string {
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	return s
+}
+
+// Debug writes extra-fun information, only shown with '--debug'
+func Debug(format string, a ...interface{}) {
+	write(LevelDebug, format, a...)
+}
+
+// Info writes the usual progress messages
+func Info(format string, a ...interface{}) {
+	write(LevelInfo, format, a...)
+}
+
+// Warn writes messages about something that didn't work out, but doesn't stop kube-deploy
+func Warn(format string, a ...interface{}) {
+	write(LevelWarn, format, a...)
+}
+
+// Error writes messages about something that stops kube-deploy in its tracks
+func Error(format string, a ...interface{}) {
+	write(LevelError, format, a...)
+}
+
+func write(l Level, format string, a ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if l < level {
+		return
+	}
+
+	msg := redact(fmt.Sprintf(format, a...))
+	var line string
+	if jsonMode {
+		jsonBytes, _ := json.Marshal(record{
+			Time:  time.Now().Format(time.RFC3339),
+			Level: levelNames[l],
+			Msg:   strings.TrimPrefix(strings.TrimSpace(msg), "=> "),
+		})
+		line = string(jsonBytes) + "\n"
+	} else {
+		line = msg
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+	}
+
+	if l >= LevelWarn {
+		io.WriteString(errOut, line)
+	} else {
+		io.WriteString(out, line)
+	}
+	if logFile != nil {
+		io.WriteString(logFile, line)
+	}
+}
@@ -0,0 +1,113 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Sends the output to buffers, and puts everything back afterwards
+func captureOutput(t *testing.T) (*bytes.Buffer, *bytes.Buffer) {
+	t.Helper()
+	savedOut, savedErrOut, savedLevel, savedJSON, savedSecrets := out, errOut, level, jsonMode, secrets
+	t.Cleanup(func() {
+		out, errOut, level, jsonMode, secrets = savedOut, savedErrOut, savedLevel, savedJSON, savedSecrets
+		Close()
+	})
+	var stdout, stderr bytes.Buffer
+	out, errOut, level, jsonMode, secrets = &stdout, &stderr, LevelInfo, false, nil
+	return &stdout, &stderr
+}
+
+func TestLevels(t *testing.T) {
+	tests := []struct {
+		level      Level
+		wantStdout string
+		wantStderr string
+	}{
+		{level: LevelDebug, wantStdout: "debug\ninfo\n", wantStderr: "warn\nerror\n"},
+		{level: LevelInfo, wantStdout: "info\n", wantStderr: "warn\nerror\n"},
+		{level: LevelWarn, wantStderr: "warn\nerror\n"},
+		{level: LevelError, wantStderr: "error\n"},
+	}
+	for _, test := range tests {
+		stdout, stderr := captureOutput(t)
+		SetLevel(test.level)
+		Debug("debug")
+		Info("info")
+		Warn("warn\n")
+		Error("error")
+		if stdout.String() != test.wantStdout || stderr.String() != test.wantStderr {
+			t.Errorf("at %s, stdout = %q and stderr = %q, want %q and %q", levelNames[test.level], stdout, stderr, test.wantStdout, test.wantStderr)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "Warn": LevelWarn, "error": LevelError} {
+		if got, err := ParseLevel(name); got != want || err != nil {
+			t.Errorf("ParseLevel(%q) = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("ParseLevel(\"loud\") worked, want an error")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	stdout, stderr := captureOutput(t)
+	SetJSON(true)
+	Info("=> Starting rollout.\n")
+	Error("=> Uh oh, %s", "it broke")
+
+	for _, test := range []struct {
+		output    *bytes.Buffer
+		wantLevel string
+		wantMsg   string
+	}{
+		{output: stdout, wantLevel: "info", wantMsg: "Starting rollout."},
+		{output: stderr, wantLevel: "error", wantMsg: "Uh oh, it broke"},
+	} {
+		var got record
+		if err := json.Unmarshal(test.output.Bytes(), &got); err != nil {
+			t.Errorf("%q isn't one JSON object: %s", test.output, err)
+			continue
+		}
+		if got.Level != test.wantLevel || got.Msg != test.wantMsg || got.Time == "" {
+			t.Errorf("got %+v, want level %q and msg %q with the time", got, test.wantLevel, test.wantMsg)
+		}
+	}
+}
+
+func TestSecretsAreRedacted(t *testing.T) {
+	stdout, stderr := captureOutput(t)
+	logFilePath := filepath.Join(t.TempDir(), "kube-deploy.log")
+	if err := OpenFile(logFilePath); err != nil {
+		t.Fatal(err)
+	}
+	AddSecret("hunter2")
+	AddSecret("hunter2-and-more")
+	AddSecret("abc") // Too short to redact
+	AddSecret("  hunter2  ")
+
+	Info("password=hunter2 token=hunter2-and-more id=abc")
+	Warn("still %s", "hunter2")
+	Close()
+
+	const wantStdout = "password=[REDACTED] token=[REDACTED] id=abc\n"
+	const wantStderr = "still [REDACTED]\n"
+	if stdout.String() != wantStdout || stderr.String() != wantStderr {
+		t.Errorf("stdout = %q and stderr = %q, want %q and %q", stdout, stderr, wantStdout, wantStderr)
+	}
+	if logged, _ := ioutil.ReadFile(logFilePath); string(logged) != wantStdout+wantStderr {
+		t.Errorf("the log file has %q, want %q", logged, wantStdout+wantStderr)
+	}
+	if got := Redact("hunter2"); got != redacted {
+		t.Errorf("Redact() = %q, want %q", got, redacted)
+	}
+	if len(secrets) != 2 {
+		t.Errorf("there are %d secrets, want the same one added twice to count once", len(secrets))
+	}
+}
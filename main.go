@@ -2,46 +2,96 @@ package main
 
 import (
 	"bufio"
-	"io/ioutil"
-	"strconv"
-	"strings"
 	// "flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	// "os/user"
-	"github.com/mycujoo/kube-deploy/build"
 	"github.com/mycujoo/kube-deploy/cli"
 	"github.com/mycujoo/kube-deploy/config"
-	"github.com/simonleung8/flags"
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/logger"
 )
 
 // var userConfig userConfigMap
 var repoConfig config.RepoConfigMap
 var reader *bufio.Reader
-var osstdout *os.File
 
 func main() {
-	parseFlags()
-	pwd, _ := os.Getwd()
+	cli.CatchInterrupts(exit)
+	exit(run())
+}
+
+// Finishes with the exit code for err, after saying what went wrong
+func exit(err error) {
+	if failure.Is(err, failure.Cancelled) {
+		logger.Info("=> %s", err)
+	} else if err != nil {
+		logger.Error("=> %s", err)
+	}
+	logger.Close()
+	os.Exit(failure.ExitCode(err))
+}
+
+func run() error {
+	c, err := parseFlags()
+	if err != nil {
+		return err
+	}
+	// The arguments after the executable and command names
+	var commandArgs []string
+	if len(args) > 2 {
+		commandArgs = args[2:]
+	}
+	if runFlags.Bool("help") {
+		showCommandHelp(os.Stdout, c)
+		return nil
+	}
+	if err := checkArguments(c, commandArgs); err != nil {
+		return err
+	}
+
 	// user, _ := user.Current()
 	// userHome := user.HomeDir
 	reader = bufio.NewReader(os.Stdin)
 
-	osstdout = os.Stdout
-	if runFlags.Bool("quiet") {
-		os.Stdout = nil
+	if err := setUpLogging(); err != nil {
+		return err
+	}
+	if c.hasFlag("output") {
+		if err := checkOutputFormat(); err != nil {
+			return err
+		}
+	}
+	if c.Standalone {
+		return c.Run(commandArgs)
 	}
+
 	// TODO: for some reason, on a linux machine, if any command other than 'curl' is executed first, all
 	//		 subcommands fail - but sometimes, the first-run after 'go build' works. Who knows...
 	if exitCode := cli.GetCommandExitCode("curl", "-s --connect-timeout 3 https://ifconfig.io"); exitCode != 0 {
-		fmt.Println("=> Uh oh, looks like you're not connected to the internet (or maybe it's just too slow).")
-		os.Exit(1)
+		return failure.New(failure.Unknown, "Uh oh, looks like you're not connected to the internet (or maybe it's just too slow).")
+	}
+
+	if runFlags.Bool("test-only") {
+		logger.Info("\n=> You've chosen the action '%s'. Proceeding...\n----------\n\n", c.Name)
+		return c.Run(commandArgs)
+	}
+
+	logger.Info("=> First, I'm going to read the repo configuration file.")
+	appConfigs, err := loadRepoConfigs(c)
+	if err != nil {
+		return err
+	}
+	if len(appConfigs) > 0 && appConfigs[0].APIVersion != config.APIVersion {
+		logger.Warn("=> Heads up: your deploy.yaml is in an older format, which I've converted as I read it. Run 'kube-deploy config migrate' to update it to '%s'.", config.APIVersion)
 	}
 
-	if !runFlags.Bool("test-only") {
-		fmt.Println("=> First, I'm going to read the repo configuration file.")
-		repoConfig = config.InitRepoConfig(fmt.Sprintf("%s/deploy.yaml", pwd))
-		fmt.Printf(`=> I found the following data:
+	// The json and yaml output for several applications is one list, rather than a document for each
+	collectingOutput = len(appConfigs) > 1 && c.hasFlag("output") && outputFormat() != outputTable
+	for _, appConfig := range appConfigs {
+		repoConfig = appConfig
+		logger.Info(`=> I found the following data:
 	Repository name: %s
 	Current branch: %s
 	HEAD hash: %s
@@ -49,135 +99,137 @@ func main() {
 => That means we're dealing with the image tag:
 	%s
 `, repoConfig.Application.Name, repoConfig.GitBranch, repoConfig.GitSHA, repoConfig.ImageFullPath)
+
+		logger.Info("\n=> You've chosen the action '%s'. Proceeding...\n----------\n\n", c.Name)
+		if err := c.Run(commandArgs); err != nil {
+			return err
+		}
+	}
+	if collectingOutput {
+		return writeOutput(collectedOutput)
+	}
+	return nil
+}
+
+// Moves into the app directory, since git, docker and the Kubernetes files all work from there - and finds its deploy.yaml
+func useAppDir() (string, error) {
+	configFilePath := flagValue("config")
+	if configFilePath != "" {
+		// A relative path is relative to where kube-deploy was run, not the app directory
+		absolutePath, err := filepath.Abs(configFilePath)
+		if err != nil {
+			return "", failure.Wrap(failure.Config, err, "Couldn't find the config file %s", configFilePath)
+		}
+		configFilePath = absolutePath
 	}
 
-	// args has to have at least length 2, since the first element is the executable name
-	if len(args) >= 2 {
-		fmt.Printf("\n=> You've chosen the action '%s'. Proceeding...\n----------\n\n", args[1])
-
-		switch c := args[1]; c {
-
-		case "name":
-			fmt.Fprintln(osstdout, repoConfig.ImageFullPath)
-		case "environment":
-			fmt.Fprintln(osstdout, repoConfig.Namespace)
-		case "cluster":
-			fmt.Fprintln(osstdout, repoConfig.ClusterName)
-		case "release":
-			fmt.Fprintln(osstdout, repoConfig.ReleaseName)
-
-		case "build":
-			build.MakeAndPushBuild(
-				runFlags.Bool("force-push-image"),
-				runFlags.Bool("override-dirty-workdir"),
-				runFlags.Bool("keep-test-container"),
-				repoConfig,
-			)
-		case "make":
-			build.MakeAndPushBuild(
-				runFlags.Bool("force-push-image"),
-				runFlags.Bool("override-dirty-workdir"),
-				runFlags.Bool("keep-test-container"),
-				repoConfig,
-			)
-		case "test":
-			build.MakeAndTestBuild(
-				runFlags.Bool("override-dirty-workdir"),
-				runFlags.Bool("keep-test-container"),
-				repoConfig,
-			)
-		case "testonly":
-			build.RunBuildTests(runFlags.Bool("keep-test-container"))
-
-		case "start-rollout":
-			kubeStartRollout()
-		case "scale":
-			replicas, _ := strconv.ParseInt(args[2], 0, 32)
-			kubeScaleDeployment(int32(replicas))
-		case "rollback":
-			kubeInstantRollback()
-		case "rolling-restart":
-			kubeRollingRestart()
-		case "template-only":
-			fmt.Println("The files can be found at: ")
-			fmt.Fprint(osstdout, strings.Join(kubeMakeTemplates(), "\n"))
-
-		case "remove":
-			kubeRemove()
-
-		case "active-deployments":
-			kubeListDeployments()
-		case "list-tags":
-			build.DockerListTags()
-
-		case "status":
-			if status := cli.IsLocked(repoConfig.Application.Name); status == false {
-				fmt.Print("=> No rollout in progress for this repo and branch.\n\n")
-			}
-
-		case "lock":
-			cli.WriteLockFile(repoConfig.Application.Name, "manually blocked rollouts for "+repoConfig.Application.Name)
-		case "unlock":
-			cli.DeleteLockFile(repoConfig.Application.Name)
-		case "lock-all":
-			cli.WriteLockFile("all", "manually blocked all rollouts")
-		case "unlock-all":
-			cli.DeleteLockFile("all")
-		default:
-			{
-				fmt.Println("=> Uh oh - that command isn't recongised. Please enter a valid command. Do you need some help?")
-				fmt.Print("=> Press 'y' to show the help menu, anything else to exit.\n>>>  ")
-				pleaseHelpMe, _ := reader.ReadString('\n')
-				if pleaseHelpMe != "y\n" && pleaseHelpMe != "Y\n" {
-					fmt.Println("Better luck next time.")
-					os.Exit(0)
-				}
-				showHelp()
-			}
+	if appDir := flagValue("app-dir"); appDir != "" {
+		if err := os.Chdir(appDir); err != nil {
+			return "", failure.Wrap(failure.Config, err, "Couldn't use the app directory %s", appDir)
 		}
-	} else {
-		fmt.Println("You'll need to add a command.")
-		os.Exit(0)
+		logger.Info("=> Working in the app directory %s.", appDir)
 	}
+
+	if configFilePath == "" {
+		pwd, _ := os.Getwd()
+		configFilePath = fmt.Sprintf("%s/deploy.yaml", pwd)
+	}
+	return configFilePath, nil
 }
 
-func askToProceed(promptMessage string) bool {
-	fmt.Printf("=> %s\n=> Press 'y' to proceed, anything else to exit.\n>>> ", promptMessage)
-	if proceed, _ := reader.ReadString('\n'); proceed != "y\n" && proceed != "Y\n" {
-		return false
+// Checks the deploy.yaml, listing every problem with the line it's on
+func validateRepoConfig() error {
+	configFilePath, err := useAppDir()
+	if err != nil {
+		return err
+	}
+	problems, fileVersion, err := config.Validate(configFilePath)
+	if err != nil {
+		return failure.Wrap(failure.Config, err, "Failed reading repo config file")
+	}
+	if len(problems) == 0 && fileVersion != config.APIVersion {
+		logger.Warn("=> %s is in an older format - run 'kube-deploy config migrate' to update it to '%s'.", configFilePath, config.APIVersion)
 	}
-	return true
+	if len(problems) == 0 {
+		logger.Info("=> %s looks good to me!", configFilePath)
+		return nil
+	}
+
+	logger.Error("=> Uh oh, I found some problems in %s:", configFilePath)
+	for _, problem := range problems {
+		if problem.Line > 0 {
+			logger.Error("\t%s:%d: %s", configFilePath, problem.Line, problem.Message)
+		} else {
+			logger.Error("\t%s: %s", configFilePath, problem.Message)
+		}
+	}
+	return failure.New(failure.Config, "The deploy.yaml has %d problem(s)", len(problems))
 }
 
-func showHelp() {
-	helpData, err := ioutil.ReadFile("README.md")
-	// TODO: make this part of the application bundle, since right now it will print the README of whatever project you're trying to deploy :|
+// Rewrites the deploy.yaml in the current format
+func migrateRepoConfig() error {
+	configFilePath, err := useAppDir()
 	if err != nil {
-		fmt.Println("=> Oh no, we couldn't even read the help file!")
-		panic(err)
+		return err
+	}
+	fileVersion, err := config.Migrate(configFilePath)
+	if err != nil {
+		return err
+	}
+	if fileVersion == config.APIVersion {
+		logger.Info("=> %s is already in the current format ('%s'), so there's nothing to do.", configFilePath, config.APIVersion)
+		return nil
 	}
-	fmt.Print(string(helpData))
+	if fileVersion == "" {
+		fileVersion = "no apiVersion"
+	}
+	logger.Info("=> Migrated %s from '%s' to '%s'. Have a look at the changes before you commit them!", configFilePath, fileVersion, config.APIVersion)
+	return nil
 }
 
-var args []string
-var runFlags flags.FlagContext
-
-func parseFlags() {
-
-	runFlags = flags.New()
-	runFlags.NewBoolFlag("debug", "", "Print extra-fun information.")
-	runFlags.NewBoolFlag("override-dirty-workdir", "", "Forces a build even if the git working directory is dirty (only needed for 'production' and 'master' branches).")
-	runFlags.NewBoolFlag("force", "", "Unwisely bypasses the sanity checks, which you really need. Even you.")
-	runFlags.NewBoolFlag("force-push-image", "", "Automatically push the built Docker image if the tests pass (useful for CI/CD).")
-	runFlags.NewBoolFlag("keep-test-container", "", "Don't clean up (docker rm) the test containers (Default false).")
-	runFlags.NewBoolFlag("no-canary", "", "Bypass the canary release points (useful for CI/CD).")
-	runFlags.NewBoolFlag("test-only", "", "Skips the run configuration and only tests that the binary can start.")
-	runFlags.NewBoolFlag("quiet", "q", "Silences as much output as possible.")
-	runFlags.NewBoolFlag("keep-kubernetes-template-files", "", "Leaves the templated-out kubernetes files under the directory '.kubedeploy-temp'.")
-	if err := runFlags.Parse(os.Args...); err != nil {
-		fmt.Println("\n=> Oh no, I don't know what to do with those command line flags. Sorry...\n")
-		fmt.Println(runFlags.ShowUsage(4))
-		os.Exit(1)
-	}
-	args = runFlags.Args()
+// Asks whether to go on - giving up on the answer if kube-deploy is told to stop while it waits for one
+func askToProceed(promptMessage string) (bool, error) {
+	fmt.Printf("=> %s\n=> Press 'y' to proceed, anything else to exit.\n>>> ", promptMessage)
+	answers := make(chan string, 1)
+	go func() {
+		answer, _ := reader.ReadString('\n')
+		answers <- answer
+	}()
+	select {
+	case <-cli.AbortContext().Done():
+		return false, cli.Aborted()
+	case proceed := <-answers:
+		return proceed == "y\n" || proceed == "Y\n", nil
+	}
+}
+
+func setUpLogging() error {
+	level, err := logger.ParseLevel(runFlags.String("log-level"))
+	if err != nil {
+		return failure.New(failure.Config, "Uh oh - %s. It should be one of: debug, info, warn, error.", err)
+	}
+	if runFlags.Bool("debug") {
+		level = logger.LevelDebug
+	} else if runFlags.Bool("quiet") {
+		level = logger.LevelWarn
+	}
+	logger.SetLevel(level)
+
+	switch format := runFlags.String("log-format"); format {
+	case "text":
+	case "json":
+		logger.SetJSON(true)
+	default:
+		return failure.New(failure.Config, "Uh oh - the log format '%s' isn't recognised. It should be one of: text, json.", format)
+	}
+
+	if logFile := runFlags.String("log-file"); logFile != "" {
+		if err := logger.OpenFile(logFile); err != nil {
+			return failure.Wrap(failure.Config, err, "Oh no, I couldn't open the log file")
+		}
+	}
+
+	// The Vault token is used by consul-template, and should never end up in a log
+	logger.AddSecret(os.Getenv("VAULT_TOKEN"))
+	return nil
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/config"
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/kube/api"
+	"github.com/mycujoo/kube-deploy/logger"
+)
+
+// Reads the config of each application the command works on - just the one, unless it's a monorepo and no '--app'
+// was chosen. Then it's every application that has changed since its live release for the ChangedApps commands, only
+// the first for the AllApps ones, and every application for the rest - except the OneApp ones, which need '--app'.
+func loadRepoConfigs(c *command) ([]config.RepoConfigMap, error) {
+	configFilePath, err := useAppDir()
+	if err != nil {
+		return nil, err
+	}
+	overrides := config.Overrides{
+		Application: flagValue("app"),
+		Namespace:   flagValue("namespace"),
+		ClusterName: flagValue("cluster"),
+		ImageTag:    flagValue("image-tag"),
+	}
+
+	appNames, err := config.ApplicationNames(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(appNames) == 0 || overrides.Application != "" {
+		appConfig, err := config.InitRepoConfig(configFilePath, overrides)
+		if err != nil {
+			return nil, err
+		}
+		return []config.RepoConfigMap{appConfig}, nil
+	}
+	switch {
+	case c.AllApps:
+		appNames = appNames[:1]
+	case c.OneApp:
+		return nil, failure.New(failure.Config, "The deploy.yaml has several applications, so choose the one to %s with '--app': %s", c.Name, strings.Join(appNames, ", "))
+	}
+
+	var appConfigs []config.RepoConfigMap
+	for _, name := range appNames {
+		overrides.Application = name
+		appConfig, err := config.InitRepoConfig(configFilePath, overrides)
+		if err != nil {
+			return nil, err
+		}
+		if !c.ChangedApps {
+			appConfigs = append(appConfigs, appConfig)
+			continue
+		}
+
+		changed, err := appChangedSinceLiveRelease(appConfig)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			logger.Info("=> %s has changed since its live release.", name)
+			appConfigs = append(appConfigs, appConfig)
+		} else {
+			logger.Info("=> %s hasn't changed since its live release, so I'll leave it be.", name)
+		}
+	}
+	if c.ChangedApps && len(appConfigs) == 0 {
+		logger.Info("=> None of the applications have changed since their live releases - use '--app' to choose one anyway.")
+	}
+	return appConfigs, nil
+}
+
+// Compares the application's files with the git commit its live release was made from
+func appChangedSinceLiveRelease(appConfig config.RepoConfigMap) (bool, error) {
+	liveDeployments, err := kubeapi.ListDeployments(map[string]string{"app": appConfig.Application.Name + "-" + appConfig.GitBranch, "kubedeploy-is-live": "true"})
+	if err != nil {
+		return false, err
+	}
+	// Without exactly one live release to compare with, it's safest to say it has changed
+	if len(liveDeployments.Items) != 1 {
+		return true, nil
+	}
+	liveSHA := liveDeployments.Items[0].Annotations[gitSHAAnnotation]
+	if liveSHA == "" {
+		return true, nil
+	}
+
+	changedFiles, exitCode := cli.GetCommandOutputAndExitCode("git", fmt.Sprintf("diff --name-only %s HEAD -- %s", liveSHA, strings.Join(appConfig.Application.Paths(), " ")))
+	if exitCode != 0 { // eg. the commit isn't in this clone
+		return true, nil
+	}
+	return strings.TrimSpace(changedFiles) != "", nil
+}
@@ -0,0 +1,129 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/config"
+	"github.com/mycujoo/kube-deploy/logger"
+)
+
+// The rollout lifecycle events which can be sent to the notification sinks
+const (
+	RolloutStarted    = "rollout-started"
+	RolloutCompleted  = "rollout-completed"
+	RolloutBailedOut  = "rollout-bailed-out"
+	RollbackStarted   = "rollback-started"
+	RollbackCompleted = "rollback-completed"
+	Scaled            = "scaled"
+	Locked            = "locked"
+	Unlocked          = "unlocked"
+	FreezeBroken      = "freeze-broken"
+)
+
+const defaultTemplate = "[{{.Environment}}] {{.Application}}: {{.Message}} ({{.User}})"
+
+// Event : the data available to the message templates, also sent as-is to generic webhooks
+type Event struct {
+	Name        string `json:"name"`
+	Application string `json:"application"`
+	Environment string `json:"environment"`
+	Cluster     string `json:"cluster"`
+	Release     string `json:"release"`
+	GitSHA      string `json:"gitSHA"`
+	User        string `json:"user"`
+	Message     string `json:"message"`
+	Time        string `json:"time"`
+	Text        string `json:"text"`
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// Send delivers the event to every configured sink which is interested in it.
+// Notifications are best-effort - a failing sink never stops a rollout.
+func Send(repoConfig config.RepoConfigMap, name string, message string) {
+	event := Event{
+		Name:        name,
+		Application: repoConfig.Application.Name,
+		Environment: repoConfig.Namespace,
+		Cluster:     repoConfig.ClusterName,
+		Release:     repoConfig.ReleaseName,
+		GitSHA:      repoConfig.GitSHA,
+		User:        os.Getenv("USER"),
+		Message:     message,
+		Time:        time.Now().Format(time.RFC3339),
+	}
+
+	for _, sink := range repoConfig.Notifications {
+		if !contains(sink.Environments, event.Environment) || !contains(sink.Events, event.Name) {
+			continue
+		}
+		if err := send(sink.Type, sink.URL, sink.Template, event); err != nil {
+			logger.Warn("=> I couldn't send the '%s' notification to the %s sink: %s\n", name, sink.Type, err)
+		}
+	}
+}
+
+func send(sinkType string, url string, messageTemplate string, event Event) error {
+	if messageTemplate == "" {
+		messageTemplate = defaultTemplate
+	}
+	tmpl, err := template.New("notification").Parse(messageTemplate)
+	if err != nil {
+		return err
+	}
+	var textBuf bytes.Buffer
+	if err := tmpl.Execute(&textBuf, event); err != nil {
+		return err
+	}
+	event.Text = textBuf.String()
+
+	var payload interface{}
+	switch sinkType {
+	case "slack":
+		payload = map[string]string{"text": event.Text}
+	case "teams":
+		payload = map[string]string{
+			"@type":    "MessageCard",
+			"@context": "http://schema.org/extensions",
+			"summary":  event.Name,
+			"text":     event.Text,
+		}
+	case "webhook", "":
+		payload = event
+	default:
+		return fmt.Errorf("unknown sink type '%s'", sinkType)
+	}
+
+	jsonBytes, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	response, err := httpClient.Post(url, "application/json", bytes.NewReader(jsonBytes))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("the sink responded with status %s", response.Status)
+	}
+	return nil
+}
+
+// An empty filter matches everything
+func contains(filter []string, value string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		if f == value {
+			return true
+		}
+	}
+	return false
+}
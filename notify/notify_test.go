@@ -0,0 +1,139 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/mycujoo/kube-deploy/config"
+)
+
+// A fake sink, recording the body of each notification it gets and answering with the given status
+type fakeSink struct {
+	*httptest.Server
+	status int
+
+	mutex  sync.Mutex
+	bodies []map[string]interface{}
+}
+
+func newFakeSink(t *testing.T, status int) *fakeSink {
+	s := &fakeSink{status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		s.mutex.Lock()
+		s.bodies = append(s.bodies, body)
+		s.mutex.Unlock()
+		w.WriteHeader(s.status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeSink) received() []map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.bodies
+}
+
+func notifyRepoConfig(t *testing.T, notifications string) config.RepoConfigMap {
+	var repoConfig config.RepoConfigMap
+	if err := yaml.UnmarshalStrict([]byte(notifications), &repoConfig); err != nil {
+		t.Fatal(err)
+	}
+	repoConfig.Application.Name = "api"
+	repoConfig.Namespace = "production"
+	repoConfig.ClusterName = "production"
+	repoConfig.ReleaseName = "api-master-abc1234"
+	repoConfig.GitSHA = "abc1234"
+	return repoConfig
+}
+
+func TestSend(t *testing.T) {
+	t.Setenv("USER", "alice")
+	slack, teams, webhook, staging := newFakeSink(t, http.StatusOK), newFakeSink(t, http.StatusOK), newFakeSink(t, http.StatusNoContent), newFakeSink(t, http.StatusOK)
+	repoConfig := notifyRepoConfig(t, fmt.Sprintf(`notifications:
+- type: slack
+  url: %s
+  events: [rollback-completed]
+- type: teams
+  url: %s
+  template: "{{.Release}} on {{.Cluster}}: {{.Message}}"
+- url: %s
+  environments: [production]
+- type: webhook
+  url: %s
+  environments: [staging]
+`, slack.URL, teams.URL, webhook.URL, staging.URL))
+
+	Send(repoConfig, RolloutStarted, "Started rolling out api-master-abc1234")
+	Send(repoConfig, RollbackCompleted, "Rolled back from api-master-abc1234 to api-master-0000000")
+
+	if got := slack.received(); len(got) != 1 || got[0]["text"] != "[production] api: Rolled back from api-master-abc1234 to api-master-0000000 (alice)" {
+		t.Errorf("the Slack sink got %v, want only the rollback, with the default template", got)
+	}
+	if got := teams.received(); len(got) != 2 || got[0]["@type"] != "MessageCard" || got[0]["summary"] != RolloutStarted ||
+		got[0]["text"] != "api-master-abc1234 on production: Started rolling out api-master-abc1234" {
+		t.Errorf("the Teams sink got %v, want a MessageCard for each event, with its template", got)
+	}
+	if got := webhook.received(); len(got) != 2 {
+		t.Errorf("the webhook got %d notifications, want 2", len(got))
+	} else {
+		want := map[string]interface{}{
+			"name": RollbackCompleted, "application": "api", "environment": "production", "cluster": "production",
+			"release": "api-master-abc1234", "gitSHA": "abc1234", "user": "alice",
+			"message": "Rolled back from api-master-abc1234 to api-master-0000000",
+			"text":    "[production] api: Rolled back from api-master-abc1234 to api-master-0000000 (alice)",
+		}
+		for key, value := range want {
+			if got[1][key] != value {
+				t.Errorf("the webhook got %s = %v, want %v", key, got[1][key], value)
+			}
+		}
+		if got[1]["time"] == "" {
+			t.Error("the webhook got no time")
+		}
+	}
+	if got := staging.received(); len(got) != 0 {
+		t.Errorf("the staging sink got %v, want nothing from production", got)
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	broken := newFakeSink(t, http.StatusInternalServerError)
+	ok := newFakeSink(t, http.StatusOK)
+	tests := []struct {
+		name     string
+		sinkType string
+		url      string
+		template string
+		wantErr  string
+	}{
+		{name: "a sink which fails", url: broken.URL, wantErr: "500"},
+		{name: "an unknown sink type", sinkType: "carrier-pigeon", url: ok.URL, wantErr: "unknown sink type"},
+		{name: "a broken template", url: ok.URL, template: "{{.Release", wantErr: "unclosed action"},
+		{name: "a template with a field which isn't there", url: ok.URL, template: "{{.Branch}}", wantErr: "Branch"},
+	}
+	for _, test := range tests {
+		err := send(test.sinkType, test.url, test.template, Event{Name: RolloutStarted})
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: send() = %v, want an error containing %q", test.name, err, test.wantErr)
+		}
+	}
+	if got := ok.received(); len(got) != 0 {
+		t.Errorf("the sink got %v, want nothing for broken notifications", got)
+	}
+
+	// Send itself never fails, so a broken sink can't stop a rollout
+	Send(notifyRepoConfig(t, fmt.Sprintf("notifications:\n- url: %s\n", broken.URL)), Locked, "Locked")
+	if got := broken.received(); len(got) != 2 {
+		t.Errorf("the broken sink got %d notifications, want 2", len(got))
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mycujoo/kube-deploy/build"
+	"github.com/mycujoo/kube-deploy/cli"
+	"github.com/mycujoo/kube-deploy/failure"
+	"github.com/mycujoo/kube-deploy/logger"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The output formats of the informational commands
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// infoOutput : everything kube-deploy derives from the deploy.yaml and git, as printed by 'info'
+type infoOutput struct {
+	Application          string `json:"application" yaml:"application"`
+	Version              string `json:"version" yaml:"version"`
+	GitBranch            string `json:"gitBranch" yaml:"gitBranch"`
+	GitSHA               string `json:"gitSHA" yaml:"gitSHA"`
+	SourceRepoURL        string `json:"sourceRepoURL" yaml:"sourceRepoURL"`
+	Environment          string `json:"environment" yaml:"environment"`
+	Cluster              string `json:"cluster" yaml:"cluster"`
+	DockerRepositoryName string `json:"dockerRepositoryName" yaml:"dockerRepositoryName"`
+	ImageTag             string `json:"imageTag" yaml:"imageTag"`
+	ImageFullPath        string `json:"imageFullPath" yaml:"imageFullPath"`
+	ReleaseName          string `json:"releaseName" yaml:"releaseName"`
+	ConfigHash           string `json:"configHash" yaml:"configHash"`
+}
+
+// deploymentOutput : a single Deployment, as printed by 'active-deployments'
+type deploymentOutput struct {
+	Name           string `json:"name" yaml:"name"`
+	Replicas       int32  `json:"replicas" yaml:"replicas"`
+	ReadyReplicas  int32  `json:"readyReplicas" yaml:"readyReplicas"`
+	Created        string `json:"created" yaml:"created"`
+	Live           bool   `json:"live" yaml:"live"`
+	RollbackTarget bool   `json:"rollbackTarget" yaml:"rollbackTarget"`
+	GitSHA         string `json:"gitSHA,omitempty" yaml:"gitSHA,omitempty"`
+}
+
+// appOutput : what a command printed for one application, when it runs for several
+type appOutput struct {
+	Application string      `json:"application" yaml:"application"`
+	Output      interface{} `json:"output" yaml:"output"`
+}
+
+// While collectingOutput, the json and yaml output is kept here, to be written as one list once every application is done
+var collectingOutput bool
+var collectedOutput = []appOutput{}
+
+func outputFormat() string {
+	return runFlags.String("output")
+}
+
+// Makes sure the output format is valid - anything but a table also moves the usual chatter to stderr, so the output can be parsed
+func checkOutputFormat() error {
+	switch format := outputFormat(); format {
+	case outputTable:
+	case outputJSON, outputYAML:
+		logger.SetOutput(os.Stderr)
+	default:
+		return failure.New(failure.Config, "Uh oh - the output format '%s' isn't recognised. It should be one of: %s, %s, %s.", format, outputTable, outputJSON, outputYAML)
+	}
+	return nil
+}
+
+// Prints the data in the chosen format to stdout (even with '--quiet'), using printTable for the 'table' format
+func printOutput(data interface{}, printTable func(w io.Writer)) error {
+	if outputFormat() == outputTable {
+		printTable(os.Stdout)
+		return nil
+	}
+	if collectingOutput {
+		collectedOutput = append(collectedOutput, appOutput{Application: repoConfig.Application.Name, Output: data})
+		return nil
+	}
+	return writeOutput(data)
+}
+
+// Writes the data as json or yaml to stdout
+func writeOutput(data interface{}) error {
+	switch outputFormat() {
+	case outputJSON:
+		jsonBytes, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stdout, string(jsonBytes))
+	case outputYAML:
+		yamlBytes, err := yaml.Marshal(data)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(os.Stdout, string(yamlBytes))
+	}
+	return nil
+}
+
+// Prints a single value - as plain text for 'table', or as an object with one key otherwise
+func printValue(key string, value string) error {
+	return printOutput(map[string]string{key: value}, func(w io.Writer) {
+		fmt.Fprintln(w, value)
+	})
+}
+
+func printInfo() error {
+	info := infoOutput{
+		Application:          repoConfig.Application.Name,
+		Version:              repoConfig.Application.Version,
+		GitBranch:            repoConfig.GitBranch,
+		GitSHA:               repoConfig.GitSHA,
+		SourceRepoURL:        repoConfig.SourceRepoURL,
+		Environment:          repoConfig.Namespace,
+		Cluster:              repoConfig.ClusterName,
+		DockerRepositoryName: repoConfig.DockerRepositoryName,
+		ImageTag:             repoConfig.ImageTag,
+		ImageFullPath:        repoConfig.ImageFullPath,
+		ReleaseName:          repoConfig.ReleaseName,
+		ConfigHash:           repoConfig.ConfigHash,
+	}
+
+	return printOutput(info, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "Application:\t%s\n", info.Application)
+		fmt.Fprintf(tw, "Version:\t%s\n", info.Version)
+		fmt.Fprintf(tw, "Git branch:\t%s\n", info.GitBranch)
+		fmt.Fprintf(tw, "Git SHA:\t%s\n", info.GitSHA)
+		fmt.Fprintf(tw, "Source repo:\t%s\n", info.SourceRepoURL)
+		fmt.Fprintf(tw, "Environment:\t%s\n", info.Environment)
+		fmt.Fprintf(tw, "Cluster:\t%s\n", info.Cluster)
+		fmt.Fprintf(tw, "Docker repository:\t%s\n", info.DockerRepositoryName)
+		fmt.Fprintf(tw, "Image tag:\t%s\n", info.ImageTag)
+		fmt.Fprintf(tw, "Image:\t%s\n", info.ImageFullPath)
+		fmt.Fprintf(tw, "Release name:\t%s\n", info.ReleaseName)
+		fmt.Fprintf(tw, "Config hash:\t%s\n", info.ConfigHash)
+		tw.Flush()
+	})
+}
+
+func printLockStatus() error {
+	status, err := cli.GetLockStatus(repoConfig.Application.Name)
+	if err != nil {
+		return err
+	}
+	if status.Freeze, err = repoConfig.ActiveFreeze(time.Now()); err != nil {
+		return failure.Wrap(failure.Config, err, "Uh oh, couldn't check the freeze windows")
+	}
+	return printOutput(status, func(w io.Writer) {
+		if status.Freeze != nil {
+			fmt.Fprintf(w, "=> Rollouts to %s are frozen until %s, for '%s': %s\n", repoConfig.Namespace, status.Freeze.Until.Format("Mon Jan _2 15:04 MST"), status.Freeze.Name, status.Freeze.Reason)
+		}
+		if !status.Locked {
+			fmt.Fprint(w, "=> No rollout in progress for this repo and branch.\n\n")
+			return
+		}
+		if status.Scope == "all" {
+			fmt.Fprintln(w, "=> All rollouts are currently blocked.")
+		} else {
+			fmt.Fprintf(w, "=> Rollouts for %s are blocked.\n", status.Scope)
+		}
+		fmt.Fprintf(w, "\tBlocked by: %s\n\tFor reason: %s\n\tOn date: %s\n", status.Author, status.Reason, status.DateStarted)
+	})
+}
+
+func printDockerTags() error {
+	tags, err := build.DockerListTags(repoConfig)
+	if err != nil {
+		return err
+	}
+	return printOutput(tags, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, fmt.Sprintf("%s  \t  %s", "List of Tags", "Date Tagged"))
+		fmt.Fprintln(tw, fmt.Sprintf("%s  \t  %s", "----------", "----------"))
+		for _, tag := range tags {
+			fmt.Fprintln(tw, fmt.Sprintf("%s  \t  %s", strings.Join(tag.Tags, ", "), tag.DateTagged))
+		}
+		tw.Flush()
+	})
+}
@@ -0,0 +1,130 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/rego"
+	yamlnodes "gopkg.in/yaml.v3"
+
+	"github.com/mycujoo/kube-deploy/config"
+)
+
+// Package : the Rego package the policies' 'deny' and 'warn' rules are read from
+const Package = "kubedeploy"
+
+// Input : the document the policies are evaluated against, as 'input'
+type Input struct {
+	Command   string                 `json:"command"`            // 'start-rollout', 'scale' or 'remove'
+	Flags     map[string]interface{} `json:"flags"`              // The command's own flags, set or not
+	Replicas  *int32                 `json:"replicas,omitempty"` // For 'scale'
+	User      string                 `json:"user"`
+	Time      string                 `json:"time"`      // RFC 3339, in the local time zone
+	Config    config.RepoConfigMap   `json:"config"`    // With Go's field names, eg. 'DockerRepository.ProductionRepositoryName'
+	Manifests []interface{}          `json:"manifests"` // The rendered Kubernetes objects
+}
+
+// Decision : what the policies said - anything in Deny means no
+type Decision struct {
+	Deny []string
+	Warn []string
+}
+
+// Evaluate loads the Rego files (and any data files) in paths, and evaluates their 'deny' and 'warn' rules
+func Evaluate(paths []string, input Input) (Decision, error) {
+	query := rego.New(
+		rego.Query("data."+Package),
+		rego.Load(paths, nil),
+		rego.Input(input),
+	)
+	results, err := query.Eval(context.Background())
+	if err != nil {
+		return Decision{}, err
+	}
+	// Without the package, nothing would ever be denied - which is more likely a typo than what was meant
+	if len(results) == 0 || len(results[0].Expressions) == 0 {
+		return Decision{}, fmt.Errorf("none of the policies in %s are in the package '%s'", strings.Join(paths, ", "), Package)
+	}
+	document, _ := results[0].Expressions[0].Value.(map[string]interface{})
+	return Decision{Deny: messages("deny", document["deny"]), Warn: messages("warn", document["warn"])}, nil
+}
+
+// The messages from a rule, sorted. A rule can give strings, or objects with a 'msg' (like conftest's). A complete rule
+// (like 'deny { ... }' or 'deny = "no"') counts too, so a rule which is written differently can't fail open - only an
+// undefined, false or empty one gives nothing.
+func messages(name string, rule interface{}) []string {
+	var found []string
+	switch value := rule.(type) {
+	case nil:
+	case bool:
+		if value {
+			found = append(found, fmt.Sprintf("the '%s' rule is true", name))
+		}
+	case string:
+		if value != "" {
+			found = append(found, value)
+		}
+	case []interface{}:
+		for _, item := range value {
+			found = append(found, message(item))
+		}
+	case map[string]interface{}:
+		if _, ok := value["msg"]; ok {
+			found = append(found, message(value))
+			break
+		}
+		// A partial object rule, like 'deny[name] = msg { ... }'
+		for _, item := range value {
+			found = append(found, message(item))
+		}
+	default:
+		found = append(found, message(value))
+	}
+	sort.Strings(found)
+	return found
+}
+
+func message(item interface{}) string {
+	if message, ok := item.(string); ok {
+		return message
+	}
+	if object, ok := item.(map[string]interface{}); ok {
+		if message, ok := object["msg"].(string); ok {
+			return message
+		}
+	}
+	encoded, _ := json.Marshal(item)
+	return string(encoded)
+}
+
+// ReadManifests reads every object in the rendered Kubernetes files, for the policies to look at
+func ReadManifests(files []string) ([]interface{}, error) {
+	manifests := []interface{}{}
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		decoder := yamlnodes.NewDecoder(bytes.NewReader(contents))
+		for {
+			var object map[string]interface{}
+			err := decoder.Decode(&object)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", file, err)
+			}
+			if object != nil {
+				manifests = append(manifests, object)
+			}
+		}
+	}
+	return manifests, nil
+}
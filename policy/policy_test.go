@@ -0,0 +1,113 @@
+package policy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		rule interface{}
+		want []string
+	}{
+		{name: "undefined", rule: nil},
+		{name: "an empty set", rule: []interface{}{}},
+		{name: "a set of strings", rule: []interface{}{"b", "a"}, want: []string{"a", "b"}},
+		{
+			name: "a set of objects with a msg",
+			rule: []interface{}{map[string]interface{}{"msg": "no", "details": "why"}, map[string]interface{}{"reason": "other"}},
+			want: []string{"no", `{"reason":"other"}`},
+		},
+		{name: "a complete rule which is false", rule: false},
+		{name: "a complete rule which is true", rule: true, want: []string{"the 'deny' rule is true"}},
+		{name: "a complete rule with an empty string", rule: ""},
+		{name: "a complete rule with a string", rule: "no", want: []string{"no"}},
+		{name: "a complete rule with a msg", rule: map[string]interface{}{"msg": "no"}, want: []string{"no"}},
+		{name: "a partial object rule", rule: map[string]interface{}{"api": "no", "web": "nope"}, want: []string{"no", "nope"}},
+		{name: "an empty partial object rule", rule: map[string]interface{}{}},
+		{name: "anything else", rule: 3, want: []string{"3"}},
+	}
+	for _, test := range tests {
+		if got := messages("deny", test.rule); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: messages() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		want    Decision
+		wantErr bool
+	}{
+		{
+			name: "deny and warn sets",
+			policy: `package kubedeploy
+deny[msg] { input.command == "remove"; msg := "No removing" }
+deny[msg] { input.user == "alice"; msg := "Not alice" }
+deny[msg] { input.command == "scale"; msg := "No scaling" }
+warn[msg] { input.flags["no-canary"]; msg := "No canary" }
+`,
+			want: Decision{Deny: []string{"No removing", "Not alice"}, Warn: []string{"No canary"}},
+		},
+		{
+			name: "messages in objects",
+			policy: `package kubedeploy
+deny[{"msg": "No removing", "rule": "remove"}] { input.command == "remove" }
+`,
+			want: Decision{Deny: []string{"No removing"}},
+		},
+		{
+			name: "nothing denied",
+			policy: `package kubedeploy
+deny[msg] { input.command == "scale"; msg := "No scaling" }
+`,
+		},
+		{
+			name: "a complete rule",
+			policy: `package kubedeploy
+deny { input.command == "remove" }
+`,
+			want: Decision{Deny: []string{"the 'deny' rule is true"}},
+		},
+		{
+			name: "a complete rule with a message",
+			policy: `package kubedeploy
+deny = "No removing" { input.command == "remove" }
+`,
+			want: Decision{Deny: []string{"No removing"}},
+		},
+		{
+			name: "another package",
+			policy: `package kubedeplyo
+deny[msg] { msg := "No" }
+`,
+			wantErr: true,
+		},
+	}
+	input := Input{Command: "remove", User: "alice", Flags: map[string]interface{}{"no-canary": true}, Manifests: []interface{}{}}
+	for _, test := range tests {
+		policyPath := filepath.Join(t.TempDir(), "policy.rego")
+		if err := ioutil.WriteFile(policyPath, []byte(test.policy), 0644); err != nil {
+			t.Fatal(err)
+		}
+		decision, err := Evaluate([]string{policyPath}, input)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: Evaluate() = %+v, want an error", test.name, decision)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Evaluate() = %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(decision, test.want) {
+			t.Errorf("%s: Evaluate() = %+v, want %+v", test.name, decision, test.want)
+		}
+	}
+}